@@ -0,0 +1,96 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+// Package auth implements access control for the administrative functions
+// of BulkTracker.
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+)
+
+// Admin checks requests for administrator credentials, which are passed
+// using HTTP basic authentication. If Password is empty, or if the Admin
+// itself is nil, all administrative requests are denied.
+//
+// Browsers resend basic authentication credentials with requests that
+// other sites make them send, so requests that change state must also come
+// from a page of this site; see sameOrigin.
+type Admin struct {
+	User, Password string
+}
+
+// Allowed returns true if r carries valid administrator credentials.
+func (a *Admin) Allowed(r *http.Request) bool {
+	if a == nil || a.Password == "" {
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+	return userOK && passwordOK
+}
+
+// Check is like Allowed, but it also writes a 401 response asking for
+// credentials to w if the request is not allowed. A request with valid
+// credentials from another site gets a 403 response. The caller must not
+// write anything else to w in either case.
+func (a *Admin) Check(w http.ResponseWriter, r *http.Request) bool {
+	if !a.Allowed(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="BulkTracker", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// sameOrigin returns true if r is a safe request, or if its Origin header,
+// or the Referer header in its absence, names the host that r was sent to.
+// Browsers set at least one of them on cross-site form submissions.
+// Requests without either, e.g. from scripts, are allowed.
+func sameOrigin(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	src := r.Header.Get("Origin")
+	if src == "" {
+		src = r.Header.Get("Referer")
+	}
+	if src == "" {
+		return true
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	// Behind a reverse proxy, the original host may only be in
+	// X-Forwarded-Host.
+	return u.Host == r.Host || u.Host == r.Header.Get("X-Forwarded-Host")
+}
@@ -0,0 +1,186 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminCheck(t *testing.T) {
+	var tests = []struct {
+		name           string
+		admin          *Admin
+		user, password string
+		want           bool
+	}{
+		{
+			name:     "valid",
+			admin:    &Admin{User: "admin", Password: "s3cret"},
+			user:     "admin",
+			password: "s3cret",
+			want:     true,
+		}, {
+			name:     "wrong password",
+			admin:    &Admin{User: "admin", Password: "s3cret"},
+			user:     "admin",
+			password: "guess",
+		}, {
+			name:  "no credentials",
+			admin: &Admin{User: "admin", Password: "s3cret"},
+		}, {
+			name:  "disabled",
+			admin: &Admin{User: "admin"},
+			user:  "admin",
+		}, {
+			name: "nil",
+			user: "admin",
+		},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/build/1?a=reindex", nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		if got := tc.admin.Check(w, r); got != tc.want {
+			t.Errorf("%s: Check() = %v, want %v", tc.name, got, tc.want)
+		}
+		if !tc.want && w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestAdminCheckOrigin(t *testing.T) {
+	var tests = []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{
+			name:   "no origin",
+			method: http.MethodPost,
+			want:   http.StatusOK,
+		}, {
+			name:    "same origin",
+			method:  http.MethodPost,
+			headers: map[string]string{"Origin": "http://bulktracker.example"},
+			want:    http.StatusOK,
+		}, {
+			name:    "same referer",
+			method:  http.MethodPost,
+			headers: map[string]string{"Referer": "https://bulktracker.example/build/1"},
+			want:    http.StatusOK,
+		}, {
+			name:    "cross origin",
+			method:  http.MethodPost,
+			headers: map[string]string{"Origin": "https://evil.example"},
+			want:    http.StatusForbidden,
+		}, {
+			name:    "cross referer",
+			method:  http.MethodPost,
+			headers: map[string]string{"Referer": "https://evil.example/page"},
+			want:    http.StatusForbidden,
+		}, {
+			name:    "null origin",
+			method:  http.MethodPost,
+			headers: map[string]string{"Origin": "null"},
+			want:    http.StatusForbidden,
+		}, {
+			name:   "forwarded host",
+			method: http.MethodPost,
+			headers: map[string]string{
+				"Origin":           "https://public.example",
+				"X-Forwarded-Host": "public.example",
+			},
+			want: http.StatusOK,
+		}, {
+			name:    "cross-origin GET",
+			method:  http.MethodGet,
+			headers: map[string]string{"Origin": "https://evil.example"},
+			want:    http.StatusOK,
+		},
+	}
+
+	admin := &Admin{User: "admin", Password: "s3cret"}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, "http://bulktracker.example/build/1?a=delete", nil)
+		r.SetBasicAuth("admin", "s3cret")
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ok := admin.Check(w, r)
+		if ok != (tc.want == http.StatusOK) || w.Code != tc.want {
+			t.Errorf("%s: Check() = %v with status %d, want status %d", tc.name, ok, w.Code, tc.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader(`
+# builder token
+joyent   abc123
+netbsd	 def456
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		header string
+		want   string
+	}{
+		{"Bearer abc123", "joyent"},
+		{"Bearer def456", "netbsd"},
+		{"Bearer abc", ""},
+		{"Bearer ", ""},
+		{"Basic abc123", ""},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		got, ok := tokens.Builder(r)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("Builder with %q: got %q, %v; want %q", tc.header, got, ok, tc.want)
+		}
+	}
+}
+
+func TestParseTokensErrors(t *testing.T) {
+	for _, in := range []string{
+		"joyent\n",
+		"joyent abc def\n",
+		"joyent abc\nnetbsd abc\n",
+	} {
+		if _, err := ParseTokens(strings.NewReader(in)); err == nil {
+			t.Errorf("ParseTokens(%q) succeeded", in)
+		}
+	}
+}
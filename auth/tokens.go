@@ -0,0 +1,94 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tokens maps API tokens to the name of the builder they belong to.
+// Builders pass their token in an "Authorization: Bearer <token>" header.
+type Tokens map[string]string
+
+// LoadTokens reads a token file. Each line contains a builder name and its
+// token, separated by whitespace. Empty lines and lines starting with '#'
+// are ignored.
+func LoadTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t, err := ParseTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// ParseTokens reads tokens in the format described for LoadTokens from r.
+func ParseTokens(r io.Reader) (Tokens, error) {
+	t := make(Tokens)
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"builder token\", got %d fields", n, len(fields))
+		}
+		if _, ok := t[fields[1]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate token", n)
+		}
+		t[fields[1]] = fields[0]
+	}
+	return t, s.Err()
+}
+
+// Builder returns the name of the builder whose token is passed in r. It
+// returns false if there is no valid token.
+func (t Tokens) Builder(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if token == "" {
+		return "", false
+	}
+	// Compare against all tokens so that the timing does not reveal
+	// which ones exist.
+	var builder string
+	for k, v := range t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k)) == 1 {
+			builder = v
+		}
+	}
+	return builder, builder != ""
+}
@@ -0,0 +1,165 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// A mailbox returns the raw messages from an mbox file or a Maildir, one at
+// a time. Next returns io.EOF after the last message.
+type mailbox interface {
+	Next() (name string, msg []byte, err error)
+	Close() error
+}
+
+// openMailbox opens path as a Maildir if it is a directory, and as an mbox
+// file otherwise.
+func openMailbox(path string) (mailbox, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return openMaildir(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mbox{
+		name: path,
+		r:    bufio.NewReader(f),
+		c:    f,
+	}, nil
+}
+
+// mbox reads messages from a file in mbox format. Messages are separated by
+// "From " lines; ">From " quoting (mboxrd) is removed.
+type mbox struct {
+	name string
+	r    *bufio.Reader
+	c    io.Closer
+	n    int
+	// next holds the "From " line that starts the next message.
+	next []byte
+}
+
+func (m *mbox) Next() (string, []byte, error) {
+	var msg bytes.Buffer
+	started := m.next != nil
+	m.next = nil
+	for {
+		line, err := m.r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if started {
+					m.next = line
+					m.n++
+					return m.msgName(), msg.Bytes(), nil
+				}
+				started = true
+			case started:
+				if isQuotedFrom(line) {
+					line = line[1:]
+				}
+				msg.Write(line)
+			}
+		}
+		if err == io.EOF {
+			if !started {
+				return "", nil, io.EOF
+			}
+			m.n++
+			return m.msgName(), msg.Bytes(), nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+func (m *mbox) msgName() string {
+	return m.name + "#" + strconv.Itoa(m.n)
+}
+
+func (m *mbox) Close() error {
+	return m.c.Close()
+}
+
+// isQuotedFrom returns true for lines like ">From " or ">>From ".
+func isQuotedFrom(line []byte) bool {
+	i := 0
+	for i < len(line) && line[i] == '>' {
+		i++
+	}
+	return i > 0 && bytes.HasPrefix(line[i:], []byte("From "))
+}
+
+// maildir reads the messages in the cur and new subdirectories of a
+// Maildir, in the order of their file names.
+type maildir struct {
+	files []string
+}
+
+func openMaildir(dir string) (*maildir, error) {
+	var files []string
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(dir, sub, e.Name()))
+			}
+		}
+	}
+	// Maildir file names start with the delivery timestamp.
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	return &maildir{files: files}, nil
+}
+
+func (m *maildir) Next() (string, []byte, error) {
+	if len(m.files) == 0 {
+		return "", nil, io.EOF
+	}
+	name := m.files[0]
+	m.files = m.files[1:]
+	msg, err := os.ReadFile(name)
+	return name, msg, err
+}
+
+func (m *maildir) Close() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func readAll(t *testing.T, path string) []string {
+	t.Helper()
+	mb, err := openMailbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mb.Close()
+
+	var msgs []string
+	for {
+		_, msg, err := mb.Next()
+		if errors.Is(err, io.EOF) {
+			return msgs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, string(msg))
+	}
+}
+
+func TestMbox(t *testing.T) {
+	const mbox = `From pkgsrc@joyent.com Sun Dec 25 04:09:54 2016
+Subject: first
+
+>From the report:
+body 1
+From builder@example.com Mon Dec 26 04:09:54 2016
+Subject: second
+
+body 2
+`
+	path := filepath.Join(t.TempDir(), "mbox")
+	if err := os.WriteFile(path, []byte(mbox), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Subject: first\n\nFrom the report:\nbody 1\n",
+		"Subject: second\n\nbody 2\n",
+	}
+	if diff := cmp.Diff(want, readAll(t, path)); diff != "" {
+		t.Errorf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cur/1482638994.M1.host:2,S": "Subject: first\n\n",
+		"new/1482725394.M2.host":     "Subject: second\n\n",
+		"tmp/1482725395.M3.host":     "Subject: incomplete\n\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		"Subject: first\n\n",
+		"Subject: second\n\n",
+	}
+	if diff := cmp.Diff(want, readAll(t, dir)); diff != "" {
+		t.Errorf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestLocalReport(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "localhost:9876", "meta", "report.xz")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := localReport(dir, "http://localhost:9876/meta/report.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != path {
+		t.Errorf("localReport: got %q, want %q", got, path)
+	}
+	if _, err := localReport(dir, "http://localhost:9876/other/report.xz"); err == nil {
+		t.Error("localReport of a missing report succeeded")
+	}
+}
@@ -0,0 +1,238 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+// backfill imports archived bulk build report mails, e.g. from the
+// pkgsrc-bulk mailing list, into the BulkTracker database. It reads mbox
+// files and Maildir directories.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/bsiegert/BulkTracker/ingest"
+)
+
+var (
+	dbDriver     = flag.String("db_driver", "sqlite3", "The database driver to use, either \"sqlite3\" or \"postgres\".")
+	dbPath       = flag.String("db_path", "BulkTracker.db", "The path to the SQLite database file, or the PostgreSQL connection string.")
+	reportDir    = flag.String("report_dir", "", "If set, read the machine-readable reports from this directory instead of fetching them. A report is looked up as <report_dir>/<host>/<path> (the layout created by wget -x), then as <report_dir>/<path>.")
+	dryRun       = flag.Bool("dry_run", false, "Only parse the mails, do not write anything to the database.")
+	skipExisting = flag.Bool("skip_existing", true, "Skip builds that are already in the database.")
+	verbose      = flag.Bool("v", false, "Verbose logging.")
+)
+
+// summary counts the outcome for each message.
+type summary struct {
+	Added, Skipped, NotReports int
+	Failures                   []failure
+}
+
+type failure struct {
+	Name string
+	Err  error
+}
+
+func (s *summary) fail(name string, err error) {
+	log.Printf("%s: %v", name, err)
+	s.Failures = append(s.Failures, failure{name, err})
+}
+
+func (s *summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d added, %d skipped as already ingested, %d not bulk reports, %d failed\n",
+		s.Added, s.Skipped, s.NotReports, len(s.Failures))
+	for _, f := range s.Failures {
+		fmt.Fprintf(w, "\t%s: %v\n", f.Name, f.Err)
+	}
+}
+
+// localReport returns the path of the local copy of the report at
+// reportURL.
+func localReport(dir, reportURL string) (string, error) {
+	u, err := url.Parse(reportURL)
+	if err != nil {
+		return "", err
+	}
+	candidates := []string{
+		filepath.Join(dir, u.Host, filepath.FromSlash(u.Path)),
+		filepath.Join(dir, filepath.FromSlash(u.Path)),
+	}
+	for _, c := range candidates {
+		if st, err := os.Stat(c); err == nil && st.Mode().IsRegular() {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("no local copy of %q in %s", reportURL, dir)
+}
+
+type backfiller struct {
+	db      *ddao.DB
+	handler *ingest.IncomingMailHandler
+	summary summary
+}
+
+func (b *backfiller) message(ctx context.Context, name string, raw []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		b.summary.fail(name, err)
+		return
+	}
+	build, err := ingest.BuildFromMail(ctx, msg)
+	if err != nil {
+		b.summary.fail(name, err)
+		return
+	}
+	if build == nil {
+		b.summary.NotReports++
+		return
+	}
+	desc := fmt.Sprintf("%s (%s %s on %s by %s)", name, build.Branch, build.Platform, build.Date(), build.BuildUser)
+
+	if *skipExisting {
+		ids, err := b.handler.FindDuplicates(ctx, build)
+		if err != nil {
+			b.summary.fail(desc, err)
+			return
+		}
+		if len(ids) > 0 {
+			log.Printf("%s: already ingested as build %v", desc, ids[0])
+			b.summary.Skipped++
+			return
+		}
+	}
+
+	var report string
+	if *reportDir != "" {
+		report, err = localReport(*reportDir, build.ReportUrl)
+		if err != nil {
+			b.summary.fail(desc, err)
+			return
+		}
+	}
+	if *dryRun {
+		log.Printf("%s: would add build", desc)
+		b.summary.Added++
+		return
+	}
+
+	id, err := b.handler.PutBuild(ctx, build)
+	if err != nil {
+		b.summary.fail(desc, err)
+		return
+	}
+	if report == "" {
+		err = b.handler.FetchReport(ctx, id, build.ReportUrl)
+	} else {
+		err = b.ingestFile(ctx, id, report)
+	}
+	if err != nil {
+		// Do not leave a build without its results behind, or the next
+		// run would skip the message as already ingested.
+		if err := b.db.DeleteBuild(ctx, id); err != nil {
+			log.Printf("%s: deleting incomplete build %v: %v", desc, id, err)
+		}
+		b.summary.fail(desc, fmt.Errorf("build %v: %w", id, err))
+		return
+	}
+	log.Printf("%s: added as build %v", desc, id)
+	b.summary.Added++
+}
+
+func (b *backfiller) ingestFile(ctx context.Context, buildID int64, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.handler.IngestReport(ctx, buildID, path, f)
+}
+
+func (b *backfiller) mailbox(ctx context.Context, path string) error {
+	mb, err := openMailbox(path)
+	if err != nil {
+		return err
+	}
+	defer mb.Close()
+	for {
+		name, raw, err := mb.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.message(ctx, name, raw)
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] mbox-or-maildir ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	ctx := context.Background()
+
+	db, err := ddao.Open(*dbDriver, *dbPath)
+	if err != nil {
+		log.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close()
+	if err := ddao.CheckSchema(ctx, db); err != nil {
+		log.Fatalf("database schema: %s", err)
+	}
+	ddb := &ddao.DB{Queries: *ddao.New(db)}
+	b := &backfiller{
+		db:      ddb,
+		handler: &ingest.IncomingMailHandler{DB: ddb},
+	}
+
+	for _, path := range flag.Args() {
+		if err := b.mailbox(ctx, path); err != nil {
+			b.summary.fail(path, err)
+		}
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing was written.")
+	}
+	b.summary.Print(os.Stdout)
+	if len(b.summary.Failures) > 0 {
+		os.Exit(1)
+	}
+}
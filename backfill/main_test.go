@@ -0,0 +1,78 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/bsiegert/BulkTracker/ingest"
+)
+
+func TestMessageFailureRemovesBuild(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "bulktracker.db")+"?_fk=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := ddao.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	ddb := &ddao.DB{Queries: *ddao.New(db)}
+
+	// The local copy of the report is not a valid xz file.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "localhost:9876", "report.xz")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("not xz"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { *reportDir = old }(*reportDir)
+	*reportDir = dir
+
+	raw, err := os.ReadFile("../testing/btinject/data/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backfiller{
+		db:      ddb,
+		handler: &ingest.IncomingMailHandler{DB: ddb},
+	}
+	b.message(ctx, "report.txt", raw)
+	if len(b.summary.Failures) != 1 {
+		t.Fatalf("got failures %v, want one", b.summary.Failures)
+	}
+
+	builds, err := ddb.LatestBuilds(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 0 {
+		t.Errorf("got %d builds after a failed ingestion, want none", len(builds))
+	}
+}
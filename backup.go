@@ -0,0 +1,117 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/backup"
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+// parseDate parses a YYYY-MM-DD flag value. The empty string is the zero
+// time.
+func parseDate(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-%s: %w", name, err)
+	}
+	return t, nil
+}
+
+// runExport implements the "export" subcommand, which writes the database
+// as JSON Lines.
+func runExport(ctx context.Context, db *ddao.DB, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	since := fs.String("since", "", "Only export builds from this date (YYYY-MM-DD) on.")
+	until := fs.String("until", "", "Only export builds before this date (YYYY-MM-DD).")
+	platforms := fs.String("platform", "", "Comma-separated list of platforms to export. If empty, all are exported.")
+	output := fs.String("o", "-", "The file to write the export to, or \"-\" for standard output.")
+	fs.Parse(args)
+
+	var f backup.Filter
+	var err error
+	if f.Since, err = parseDate("since", *since); err != nil {
+		return err
+	}
+	if f.Until, err = parseDate("until", *until); err != nil {
+		return err
+	}
+	if *platforms != "" {
+		f.Platforms = strings.Split(*platforms, ",")
+	}
+
+	w := os.Stdout
+	if *output != "-" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	stats, err := backup.Export(ctx, db, w, f)
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d builds with %d packages and %d results\n", stats.Builds, stats.Pkgs, stats.Results)
+	return nil
+}
+
+// runImport implements the "import" subcommand, which adds the builds
+// from one or more exports to the database. With no files, it reads
+// standard input.
+func runImport(ctx context.Context, db *ddao.DB, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		stats, err := backup.Import(ctx, db, r)
+		fmt.Fprintf(os.Stderr, "%s: imported %d builds with %d results, %d skipped as already present\n", name, stats.Builds, stats.Results, stats.Skipped)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
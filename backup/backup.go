@@ -0,0 +1,269 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+// Package backup exports the BulkTracker database as JSON Lines and
+// imports such exports into another database.
+//
+// Each line of an export is a Record holding a build, a package or a
+// result. A build is followed by its results. A package comes before the
+// first result that refers to it. IDs are only meaningful within one
+// export; they are reassigned on import, so that exports from several
+// instances can be merged into one database.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+// A Record is one line of an export. Exactly one of its fields is set.
+type Record struct {
+	Build  *Build  `json:"build,omitempty"`
+	Pkg    *Pkg    `json:"pkg,omitempty"`
+	Result *Result `json:"result,omitempty"`
+}
+
+// Build is a bulk build.
+type Build struct {
+	ID                   int64     `json:"id"`
+	Platform             string    `json:"platform"`
+	BuildTs              time.Time `json:"build_ts"`
+	Branch               string    `json:"branch"`
+	Compiler             string    `json:"compiler"`
+	BuildUser            string    `json:"build_user"`
+	ReportURL            string    `json:"report_url"`
+	NumOK                int64     `json:"num_ok"`
+	NumPrefailed         int64     `json:"num_prefailed"`
+	NumFailed            int64     `json:"num_failed"`
+	NumIndirectFailed    int64     `json:"num_indirect_failed"`
+	NumIndirectPrefailed int64     `json:"num_indirect_prefailed"`
+}
+
+// Pkg is a package directory.
+type Pkg struct {
+	ID       int64  `json:"id"`
+	Category string `json:"category"`
+	Dir      string `json:"dir"`
+}
+
+// Result is the result for one package in a build.
+type Result struct {
+	ID           int64  `json:"id"`
+	BuildID      int64  `json:"build_id"`
+	PkgID        int64  `json:"pkg_id"`
+	PkgName      string `json:"pkg_name"`
+	BuildStatus  int64  `json:"build_status"`
+	Breaks       int64  `json:"breaks"`
+	FailedDeps   string `json:"failed_deps"`
+	FailReason   string `json:"fail_reason"`
+	SkipReason   string `json:"skip_reason"`
+	Maintainer   string `json:"maintainer"`
+	Categories   string `json:"categories"`
+	PkgDepth     int64  `json:"pkg_depth"`
+	MultiVersion string `json:"multi_version"`
+	Restricted   string `json:"restricted"`
+	NoBinOnFtp   string `json:"no_bin_on_ftp"`
+	BootstrapPkg bool   `json:"bootstrap_pkg"`
+	// Depends and FailedBecause hold the IDs of the results in the same
+	// build that this one depends on, and that made it fail.
+	Depends       []int64 `json:"depends,omitempty"`
+	FailedBecause []int64 `json:"failed_because,omitempty"`
+}
+
+// A Filter selects the builds to export.
+type Filter struct {
+	// Since and Until limit the build timestamps, Until being exclusive.
+	// The zero value means no limit.
+	Since, Until time.Time
+	// If Platforms is not empty, only builds for these platforms are
+	// exported.
+	Platforms []string
+}
+
+func (f *Filter) match(b *ddao.Build) bool {
+	if len(f.Platforms) == 0 {
+		return true
+	}
+	for _, p := range f.Platforms {
+		if b.Platform == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats counts the records written or read.
+type Stats struct {
+	Builds, Skipped, Pkgs, Results int
+}
+
+// farFuture is used as the upper limit when Filter.Until is zero.
+var farFuture = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Export writes the builds selected by f, together with their packages
+// and results, to w. It reads from a single read-only transaction, so that
+// the export is consistent.
+func Export(ctx context.Context, db *ddao.DB, w io.Writer, f Filter) (Stats, error) {
+	var stats Stats
+	tx, cancel, err := db.BeginReadOnlyTransaction(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer cancel()
+
+	until := f.Until
+	if until.IsZero() {
+		until = farFuture
+	}
+	builds, err := tx.GetBuildsBetween(ctx, ddao.GetBuildsBetweenParams{
+		Since: f.Since,
+		Until: until,
+	})
+	if err != nil {
+		return stats, err
+	}
+	allPkgs, err := tx.GetAllPkgs(ctx)
+	if err != nil {
+		return stats, err
+	}
+	pkgs := make(map[int64]ddao.Pkg, len(allPkgs))
+	for _, p := range allPkgs {
+		pkgs[p.PkgID] = p
+	}
+	written := make(map[int64]bool)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for i := range builds {
+		b := &builds[i]
+		if !f.match(b) {
+			continue
+		}
+		if err := enc.Encode(Record{Build: buildRecord(b)}); err != nil {
+			return stats, err
+		}
+		stats.Builds++
+
+		results, err := resultRecords(ctx, tx, b.BuildID)
+		if err != nil {
+			return stats, err
+		}
+		for _, r := range results {
+			if !written[r.PkgID] {
+				p := pkgs[r.PkgID]
+				err := enc.Encode(Record{Pkg: &Pkg{
+					ID:       p.PkgID,
+					Category: p.Category,
+					Dir:      p.Dir,
+				}})
+				if err != nil {
+					return stats, err
+				}
+				written[r.PkgID] = true
+				stats.Pkgs++
+			}
+			if err := enc.Encode(Record{Result: r}); err != nil {
+				return stats, err
+			}
+			stats.Results++
+		}
+	}
+	return stats, bw.Flush()
+}
+
+func buildRecord(b *ddao.Build) *Build {
+	return &Build{
+		ID:                   b.BuildID,
+		Platform:             b.Platform,
+		BuildTs:              b.BuildTs,
+		Branch:               b.Branch,
+		Compiler:             b.Compiler,
+		BuildUser:            b.BuildUser,
+		ReportURL:            b.ReportUrl,
+		NumOK:                b.NumOk,
+		NumPrefailed:         b.NumPrefailed,
+		NumFailed:            b.NumFailed,
+		NumIndirectFailed:    b.NumIndirectFailed,
+		NumIndirectPrefailed: b.NumIndirectPrefailed,
+	}
+}
+
+// resultRecords returns the results of the given build, with the links
+// between them.
+func resultRecords(ctx context.Context, db *ddao.DB, buildID int64) ([]*Result, error) {
+	results, err := db.GetResultsForBuild(ctx, sql.NullInt64{Int64: buildID, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*Result, len(results))
+	byID := make(map[int64]*Result, len(results))
+	for i, r := range results {
+		recs[i] = &Result{
+			ID:           r.ResultID,
+			BuildID:      buildID,
+			PkgID:        r.PkgID.Int64,
+			PkgName:      r.PkgName,
+			BuildStatus:  r.BuildStatus,
+			Breaks:       r.Breaks,
+			FailedDeps:   r.FailedDeps,
+			FailReason:   r.FailReason,
+			SkipReason:   r.SkipReason,
+			Maintainer:   r.Maintainer,
+			Categories:   r.Categories,
+			PkgDepth:     r.PkgDepth,
+			MultiVersion: r.MultiVersion,
+			Restricted:   r.Restricted,
+			NoBinOnFtp:   r.NoBinOnFtp,
+			BootstrapPkg: r.BootstrapPkg,
+		}
+		byID[r.ResultID] = recs[i]
+	}
+
+	deps, err := db.GetDependenciesForBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deps {
+		if r := byID[d.ResultID]; r != nil {
+			r.Depends = append(r.Depends, d.DepResultID)
+		}
+	}
+	failedDeps, err := db.GetFailedDependenciesForBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range failedDeps {
+		if r := byID[d.ResultID]; r != nil {
+			r.FailedBecause = append(r.FailedBecause, d.FailedResultID)
+		}
+	}
+	for _, r := range recs {
+		sort.Slice(r.Depends, func(i, j int) bool { return r.Depends[i] < r.Depends[j] })
+		sort.Slice(r.FailedBecause, func(i, j int) bool { return r.FailedBecause[i] < r.FailedBecause[j] })
+	}
+	return recs, nil
+}
@@ -0,0 +1,294 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+func setup(t *testing.T) *ddao.DB {
+	t.Helper()
+	db, err := ddao.Open("sqlite3", filepath.Join(t.TempDir(), "bulktracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := ddao.Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return &ddao.DB{Queries: *ddao.New(db)}
+}
+
+func result(category, dir, pkgName string, status int64) ddao.PkgResult {
+	return ddao.PkgResult{
+		Pkg:    ddao.Pkg{Category: category, Dir: dir},
+		Result: ddao.Result{PkgName: pkgName, BuildStatus: status},
+	}
+}
+
+// addBuild writes a build with libtool, foo failing and bar failing
+// because of foo, and returns its ID.
+func addBuild(t *testing.T, db *ddao.DB, platform string, ts time.Time) int64 {
+	t.Helper()
+	ctx := context.Background()
+	buildID, err := db.PutBuild(ctx, ddao.PutBuildParams{
+		Platform:  platform,
+		BuildTs:   ts,
+		Branch:    "HEAD",
+		Compiler:  "gcc",
+		BuildUser: "builder",
+		NumOk:     1,
+		NumFailed: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.NewResultWriter(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	foo := result("devel/", "foo", "foo-1.0", 2)
+	foo.FailReason = "build"
+	for _, r := range []ddao.PkgResult{
+		result("devel/", "libtool", "libtool-2.4", 0),
+		foo,
+		result("www/", "bar", "bar-1.0", 3),
+	} {
+		if err := w.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, step := range []error{
+		w.Fixup(ctx, 2, "foo-1.0", 0),
+		w.Depend(ctx, 2, 0),
+		w.Depend(ctx, 2, 1),
+		w.FailedDep(ctx, 2, 1),
+		w.Commit(ctx),
+	} {
+		if step != nil {
+			t.Fatal(step)
+		}
+	}
+	return buildID
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := setup(t)
+	addBuild(t, src, "NetBSD", time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC))
+	addBuild(t, src, "Linux", time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	var export bytes.Buffer
+	stats, err := Export(ctx, src, &export, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Builds: 2, Pkgs: 3, Results: 6}); stats != want {
+		t.Errorf("Export: got %+v, want %+v", stats, want)
+	}
+
+	dst := setup(t)
+	stats, err = Import(ctx, dst, bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Builds: 2, Pkgs: 3, Results: 6}); stats != want {
+		t.Errorf("Import: got %+v, want %+v", stats, want)
+	}
+
+	// Into an empty database, the IDs are the same.
+	var again bytes.Buffer
+	if _, err := Export(ctx, dst, &again, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := again.String(), export.String(); got != want {
+		t.Errorf("export after import:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Importing again skips the existing builds.
+	stats, err = Import(ctx, dst, bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{Skipped: 2, Pkgs: 3}); stats != want {
+		t.Errorf("Import again: got %+v, want %+v", stats, want)
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	ctx := context.Background()
+	src := setup(t)
+	addBuild(t, src, "NetBSD", time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC))
+	var export bytes.Buffer
+	if _, err := Export(ctx, src, &export, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination already has builds, packages and results with the
+	// IDs used in the export.
+	dst := setup(t)
+	addBuild(t, dst, "SunOS", time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := Import(ctx, dst, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := dst.FindBuilds(ctx, ddao.FindBuildsParams{
+		Platform:  "NetBSD",
+		BuildTs:   time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC),
+		Branch:    "HEAD",
+		Compiler:  "gcc",
+		BuildUser: "builder",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("FindBuilds: got %v, want one build", ids)
+	}
+	deps, err := dst.GetDependencies(ctx, ddao.GetDependenciesParams{
+		BuildID:  sql.NullInt64{Int64: ids[0], Valid: true},
+		Category: "www/",
+		Dir:      "bar",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range deps {
+		names = append(names, d.DepPkgName)
+	}
+	if len(names) != 2 || names[0] != "foo-1.0" || names[1] != "libtool-2.4" {
+		t.Errorf("dependencies of bar: got %q, want foo-1.0 and libtool-2.4", names)
+	}
+	failed, err := dst.GetFailedDependencies(ctx, deps[0].ResultID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ResultID != deps[0].DepResultID {
+		t.Errorf("failed dependencies of bar: got %+v, want result %d (foo-1.0)", failed, deps[0].DepResultID)
+	}
+}
+
+func TestImportRegressions(t *testing.T) {
+	ctx := context.Background()
+	src := setup(t)
+	addBuild(t, src, "NetBSD", time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC))
+	var export bytes.Buffer
+	if _, err := Export(ctx, src, &export, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// In the destination, the same packages built before.
+	dst := setup(t)
+	prev, err := dst.PutBuild(ctx, ddao.PutBuildParams{
+		Platform:  "NetBSD",
+		BuildTs:   time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Branch:    "HEAD",
+		Compiler:  "gcc",
+		BuildUser: "builder",
+		NumOk:     3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.PutResults(ctx, []ddao.PkgResult{
+		result("devel/", "libtool", "libtool-2.4", 0),
+		result("devel/", "foo", "foo-1.0", 0),
+		result("www/", "bar", "bar-1.0", 0),
+	}, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Import(ctx, dst, &export); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := dst.GetNextBuild(ctx, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, err := dst.GetRegressions(ctx, next.BuildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range regs {
+		names = append(names, r.PkgName)
+	}
+	if len(names) != 2 || names[0] != "foo-1.0" || names[1] != "bar-1.0" {
+		t.Errorf("regressions of build %d: got %q, want foo-1.0 and bar-1.0", next.BuildID, names)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	ctx := context.Background()
+	db := setup(t)
+	addBuild(t, db, "NetBSD", time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC))
+	addBuild(t, db, "Linux", time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC))
+	addBuild(t, db, "NetBSD", time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC))
+
+	feb := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		builds int
+	}{
+		{"all", Filter{}, 3},
+		{"since", Filter{Since: feb}, 2},
+		{"until", Filter{Until: feb}, 1},
+		{"platform", Filter{Platforms: []string{"NetBSD"}}, 2},
+		{"since and platform", Filter{Since: feb, Platforms: []string{"NetBSD"}}, 1},
+	} {
+		var buf bytes.Buffer
+		stats, err := Export(ctx, db, &buf, tc.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if stats.Builds != tc.builds {
+			t.Errorf("%s: exported %d builds, want %d", tc.name, stats.Builds, tc.builds)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, input string
+	}{
+		{"bad JSON", "{"},
+		{"empty record", "{}"},
+		{"result without build", `{"result":{"id":1,"build_id":1,"pkg_id":1}}`},
+		{"unknown package", `{"build":{"id":1}}` + "\n" + `{"result":{"id":1,"build_id":1,"pkg_id":1}}`},
+	} {
+		if _, err := Import(context.Background(), setup(t), bytes.NewBufferString(tc.input)); err == nil {
+			t.Errorf("%s: Import succeeded, want error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// maxLineSize is the maximum length of a line in an export.
+const maxLineSize = 16 << 20
+
+// An importer holds the state of an Import.
+type importer struct {
+	db    *ddao.DB
+	stats Stats
+	// pkgs maps the package IDs of the export to the packages.
+	pkgs map[int64]*Pkg
+	// build and results are the build being read and its results.
+	build   *Build
+	results []*Result
+}
+
+// Import reads an export from r and adds its builds to db, assigning new
+// IDs. Builds that already exist in db, that is with the same platform,
+// timestamp, branch, compiler and user, are skipped. Each build is
+// written in its own transaction; if Import fails, the builds before the
+// failing one have been imported.
+func Import(ctx context.Context, db *ddao.DB, r io.Reader) (Stats, error) {
+	im := &importer{
+		db:   db,
+		pkgs: make(map[int64]*Pkg),
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxLineSize)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return im.stats, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := im.add(ctx, &rec); err != nil {
+			return im.stats, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return im.stats, err
+	}
+	return im.stats, im.flush(ctx)
+}
+
+func (im *importer) add(ctx context.Context, rec *Record) error {
+	switch {
+	case rec.Build != nil:
+		if err := im.flush(ctx); err != nil {
+			return err
+		}
+		im.build = rec.Build
+	case rec.Pkg != nil:
+		im.pkgs[rec.Pkg.ID] = rec.Pkg
+		im.stats.Pkgs++
+	case rec.Result != nil:
+		if im.build == nil || rec.Result.BuildID != im.build.ID {
+			return fmt.Errorf("result %d does not follow build %d", rec.Result.ID, rec.Result.BuildID)
+		}
+		if im.pkgs[rec.Result.PkgID] == nil {
+			return fmt.Errorf("result %d refers to unknown package %d", rec.Result.ID, rec.Result.PkgID)
+		}
+		im.results = append(im.results, rec.Result)
+	default:
+		return errors.New("empty record")
+	}
+	return nil
+}
+
+// flush writes the current build and its results.
+func (im *importer) flush(ctx context.Context) error {
+	b := im.build
+	if b == nil {
+		return nil
+	}
+	results := im.results
+	im.build, im.results = nil, nil
+
+	ids, err := im.db.FindBuilds(ctx, ddao.FindBuildsParams{
+		Platform:  b.Platform,
+		BuildTs:   b.BuildTs,
+		Branch:    b.Branch,
+		Compiler:  b.Compiler,
+		BuildUser: b.BuildUser,
+	})
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		log.Infof(ctx, "Skipping build %d (%s %s), already present as %d", b.ID, b.Platform, b.BuildTs.Format("2006-01-02"), ids[0])
+		im.stats.Skipped++
+		return nil
+	}
+
+	buildID, err := im.db.PutBuild(ctx, ddao.PutBuildParams{
+		Platform:             b.Platform,
+		BuildTs:              b.BuildTs,
+		Branch:               b.Branch,
+		Compiler:             b.Compiler,
+		BuildUser:            b.BuildUser,
+		ReportUrl:            b.ReportURL,
+		NumOk:                b.NumOK,
+		NumPrefailed:         b.NumPrefailed,
+		NumFailed:            b.NumFailed,
+		NumIndirectFailed:    b.NumIndirectFailed,
+		NumIndirectPrefailed: b.NumIndirectPrefailed,
+	})
+	if err != nil {
+		return err
+	}
+	if err := im.writeResults(ctx, buildID, results); err != nil {
+		if err := im.db.DeleteBuild(ctx, buildID); err != nil {
+			log.Errorf(ctx, "Deleting partially imported build %d: %v", buildID, err)
+		}
+		return fmt.Errorf("build %d: %w", b.ID, err)
+	}
+	// As in ingestion, a failure to compare the build with its neighbours
+	// does not fail the import.
+	if _, err := im.db.PutRegressions(ctx, buildID); err != nil {
+		log.Warningf(ctx, "Computing regressions for build %d: %v", buildID, err)
+	}
+	im.stats.Builds++
+	im.stats.Results += len(results)
+	return nil
+}
+
+// writeResults writes the results of a build, which has the given ID in
+// db, with the links between them.
+func (im *importer) writeResults(ctx context.Context, buildID int64, results []*Result) error {
+	w, err := im.db.NewResultWriter(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// index maps the result IDs of the export to the position in the
+	// build.
+	index := make(map[int64]int, len(results))
+	for i, r := range results {
+		p := im.pkgs[r.PkgID]
+		err := w.Write(ctx, ddao.PkgResult{
+			Pkg: ddao.Pkg{
+				Category: p.Category,
+				Dir:      p.Dir,
+			},
+			Result: ddao.Result{
+				PkgName:      r.PkgName,
+				BuildStatus:  r.BuildStatus,
+				FailedDeps:   r.FailedDeps,
+				Breaks:       r.Breaks,
+				FailReason:   r.FailReason,
+				SkipReason:   r.SkipReason,
+				Maintainer:   r.Maintainer,
+				Categories:   r.Categories,
+				PkgDepth:     r.PkgDepth,
+				MultiVersion: r.MultiVersion,
+				Restricted:   r.Restricted,
+				NoBinOnFtp:   r.NoBinOnFtp,
+				BootstrapPkg: r.BootstrapPkg,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		index[r.ID] = i
+	}
+	for i, r := range results {
+		for _, id := range r.Depends {
+			dep, ok := index[id]
+			if !ok {
+				return fmt.Errorf("result %d depends on unknown result %d", r.ID, id)
+			}
+			if err := w.Depend(ctx, i, dep); err != nil {
+				return err
+			}
+		}
+		for _, id := range r.FailedBecause {
+			failed, ok := index[id]
+			if !ok {
+				return fmt.Errorf("result %d failed because of unknown result %d", r.ID, id)
+			}
+			if err := w.FailedDep(ctx, i, failed); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Commit(ctx)
+}
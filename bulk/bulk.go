@@ -29,6 +29,7 @@ import (
 	"errors"
 	"io"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -153,60 +154,330 @@ type Pkg struct {
 	Breaks int
 }
 
-func PkgsFromReport(r io.Reader) ([]ddao.PkgResult, error) {
-	var pkgs []ddao.PkgResult
-	// Failed packages. The key is the name, the value an index into pkgs.
-	var failedPkgs = make(map[string]int)
-	var p *ddao.PkgResult
-	n := 0
+// A ReportReader parses a machine-readable bulk build report incrementally,
+// one package at a time.
+type ReportReader struct {
+	s *bufio.Scanner
+	// cur is the package currently being parsed.
+	cur  ddao.PkgResult
+	have bool
+	// curDeps holds the ALL_DEPENDS pkgpaths of cur, deps those of the
+	// package last returned by Next.
+	curDeps, deps []string
+}
 
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		b := s.Bytes()
+// NewReportReader returns a ReportReader that parses the report in r.
+func NewReportReader(r io.Reader) *ReportReader {
+	return &ReportReader{s: bufio.NewScanner(r)}
+}
+
+// Next returns the next package result in the report, or io.EOF at the
+// end. FailedDeps contains all the dependencies of the package and Breaks
+// is zero; see StreamReport for the final values.
+func (rr *ReportReader) Next() (ddao.PkgResult, error) {
+	for rr.s.Scan() {
+		b := rr.s.Bytes()
 		split := bytes.IndexRune(b, '=')
 		if split == -1 {
 			continue
 		}
 		key, val := b[:split], b[split+1:]
+		if bytes.Equal(key, []byte("PKGNAME")) {
+			// Next package, return the one before.
+			prev, had := rr.cur, rr.have
+			rr.deps = rr.curDeps
+			rr.cur = ddao.PkgResult{}
+			rr.cur.PkgName = string(val)
+			rr.curDeps = nil
+			rr.have = true
+			if had {
+				return prev, nil
+			}
+			continue
+		}
+		if !rr.have {
+			continue
+		}
 		switch {
-		case bytes.Equal(key, []byte("PKGNAME")):
-			// Next package, finish the one before.
-			pkgs = append(pkgs, ddao.PkgResult{})
-			p = &pkgs[n]
-			n++
-			p.PkgName = string(val)
 		case bytes.Equal(key, []byte("PKG_LOCATION")):
-			p.Category, p.Dir = path.Split(string(val))
+			rr.cur.Category, rr.cur.Dir = path.Split(string(val))
 		case bytes.Equal(key, []byte("BUILD_STATUS")):
-			p.BuildStatus = statuses[string(val)]
-			switch p.BuildStatus {
+			rr.cur.BuildStatus = statuses[string(val)]
+		case bytes.Equal(key, []byte("DEPENDS")):
+			rr.cur.FailedDeps = string(val)
+		case bytes.Equal(key, []byte("ALL_DEPENDS")):
+			rr.curDeps = dependPaths(string(val))
+		case bytes.Equal(key, []byte("PKG_FAIL_REASON")):
+			rr.cur.FailReason = string(val)
+		case bytes.Equal(key, []byte("PKG_SKIP_REASON")):
+			rr.cur.SkipReason = string(val)
+		case bytes.Equal(key, []byte("MAINTAINER")):
+			rr.cur.Maintainer = string(val)
+		case bytes.Equal(key, []byte("CATEGORIES")):
+			rr.cur.Categories = string(val)
+		case bytes.Equal(key, []byte("PKG_DEPTH")):
+			rr.cur.PkgDepth, _ = strconv.ParseInt(string(val), 10, 64)
+		case bytes.Equal(key, []byte("MULTI_VERSION")):
+			rr.cur.MultiVersion = string(bytes.TrimSpace(val))
+		case bytes.Equal(key, []byte("RESTRICTED")):
+			rr.cur.Restricted = string(val)
+		case bytes.Equal(key, []byte("NO_BIN_ON_FTP")):
+			rr.cur.NoBinOnFtp = string(val)
+		case bytes.Equal(key, []byte("BOOTSTRAP_PKG")):
+			rr.cur.BootstrapPkg = bytes.Equal(val, []byte("yes"))
+		}
+	}
+	if err := rr.s.Err(); err != nil {
+		return ddao.PkgResult{}, err
+	}
+	if !rr.have {
+		return ddao.PkgResult{}, io.EOF
+	}
+	rr.have = false
+	rr.deps = rr.curDeps
+	return rr.cur, nil
+}
+
+// AllDepends returns the pkgpaths from ALL_DEPENDS of the package last
+// returned by Next, e.g. "devel/gettext-lib".
+func (rr *ReportReader) AllDepends() []string {
+	return rr.deps
+}
+
+// dependPaths returns the pkgpaths of the dependencies in an ALL_DEPENDS
+// line. Each entry has the form "pattern:../../category/dir".
+func dependPaths(allDepends string) []string {
+	var paths []string
+	for _, d := range strings.Fields(allDepends) {
+		i := strings.LastIndexByte(d, ':')
+		if i == -1 {
+			continue
+		}
+		paths = append(paths, strings.TrimPrefix(d[i+1:], "../../"))
+	}
+	return paths
+}
+
+// A ResultSink receives the package results of a report from StreamReport.
+type ResultSink interface {
+	// Write adds the next result.
+	Write(ctx context.Context, r ddao.PkgResult) error
+	// Fixup sets the FailedDeps and Breaks fields of the n-th result
+	// passed to Write, counting from zero.
+	Fixup(ctx context.Context, n int, failedDeps string, breaks int64) error
+	// Depend records that the n-th result depends on the dep-th one.
+	Depend(ctx context.Context, n, dep int) error
+	// FailedDep records that the n-th result failed because of the
+	// failed-th one, which is one of its root causes.
+	FailedDep(ctx context.Context, n, failed int) error
+}
+
+// StreamReport parses the machine-readable report in r and passes each
+// package result to sink as soon as it has been read. It returns the
+// number of results.
+//
+// FailedDeps and Breaks depend on packages further down in the report, so
+// the results are written with empty values first. Once the whole report
+// has been read, a second pass sets them through sink.Fixup: FailedDeps of
+// an indirect-failed package lists the failed packages that are the root
+// cause, following chains of indirect failures through the dependency
+// graph, and Breaks of a failed package is the number of packages that
+// list it in FailedDeps. Each root cause is also passed to sink.FailedDep.
+// Finally, every dependency between two packages in the report is passed
+// to sink.Depend, once per pair. The dependencies are taken from
+// ALL_DEPENDS, which names pkgpaths; if several packages in the report are
+// built from the same pkgpath, e.g. for different Python versions, the
+// ones listed in DEPENDS are used. Only the names, pkgpaths, build status
+// and dependencies of the packages are kept in memory.
+func StreamReport(ctx context.Context, r io.Reader, sink ResultSink) (int, error) {
+	var (
+		rr = NewReportReader(r)
+		// All packages. The key is the name, the value the index
+		// of the result.
+		index = make(map[string]int)
+		// The packages built from each pkgpath.
+		byPath = make(map[string][]int)
+		// Name, build status, DEPENDS and ALL_DEPENDS of each package,
+		// by index.
+		names      []string
+		status     []int64
+		depends    [][]string
+		allDepends [][]string
+		n          int
+	)
+	for {
+		res, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		index[res.PkgName] = n
+		if res.Dir != "" {
+			p := res.Category + res.Dir
+			byPath[p] = append(byPath[p], n)
+		}
+		names = append(names, res.PkgName)
+		status = append(status, res.BuildStatus)
+		depends = append(depends, strings.Fields(res.FailedDeps))
+		allDepends = append(allDepends, rr.AllDepends())
+		res.FailedDeps = ""
+		res.Breaks = 0
+		if err := sink.Write(ctx, res); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	// Second pass: find the root causes of indirect failures.
+	roots := make(map[int][]int)
+	var rootsOf func(i int) []int
+	rootsOf = func(i int) []int {
+		if r, ok := roots[i]; ok {
+			return r
+		}
+		// Break dependency cycles, which should not exist.
+		roots[i] = nil
+		seen := make(map[int]bool)
+		var r []int
+		add := func(fp int) {
+			if !seen[fp] {
+				seen[fp] = true
+				r = append(r, fp)
+			}
+		}
+		for _, dep := range depends[i] {
+			d, ok := index[dep]
+			if !ok {
+				continue
+			}
+			switch status[d] {
 			case Failed, Prefailed:
-				failedPkgs[p.PkgName] = n - 1
+				add(d)
+			case IndirectFailed, IndirectPrefailed:
+				for _, fp := range rootsOf(d) {
+					add(fp)
+				}
 			}
-		case bytes.Equal(key, []byte("DEPENDS")):
-			p.FailedDeps = string(val)
 		}
+		roots[i] = r
+		return r
 	}
-	// Do another run over all indirect-failed packages, only keep
-	// dependencies that actually failed.
-	for i := range pkgs {
-		if pkgs[i].BuildStatus != IndirectFailed && pkgs[i].BuildStatus != IndirectPrefailed {
-			pkgs[i].FailedDeps = ""
+	breaks := make(map[int]int64)
+	for i := range depends {
+		if status[i] != IndirectFailed && status[i] != IndirectPrefailed {
+			continue
+		}
+		r := rootsOf(i)
+		if len(r) == 0 {
+			continue
 		}
-		failedDeps := strings.Fields(pkgs[i].FailedDeps)
-		f := make([]string, 0, len(failedDeps))
-		for _, dep := range failedDeps {
-			if fp, ok := failedPkgs[dep]; ok {
-				f = append(f, dep)
-				pkgs[fp].Breaks++
+		f := make([]string, 0, len(r))
+		for _, fp := range r {
+			f = append(f, names[fp])
+			breaks[fp]++
+			if err := sink.FailedDep(ctx, i, fp); err != nil {
+				return n, err
 			}
 		}
-		if len(f) == 0 {
-			f = nil
+		sort.Strings(f)
+		if err := sink.Fixup(ctx, i, strings.Join(f, " "), 0); err != nil {
+			return n, err
 		}
-		pkgs[i].FailedDeps = strings.Join(f, " ")
 	}
-	return pkgs, s.Err()
+	failedIdx := make([]int, 0, len(breaks))
+	for fp := range breaks {
+		failedIdx = append(failedIdx, fp)
+	}
+	sort.Ints(failedIdx)
+	for _, fp := range failedIdx {
+		if err := sink.Fixup(ctx, fp, "", breaks[fp]); err != nil {
+			return n, err
+		}
+	}
+
+	// Dependencies on packages that are not part of the report are
+	// dropped.
+	for i := range depends {
+		for _, d := range dependencies(i, depends[i], allDepends[i], index, byPath) {
+			if err := sink.Depend(ctx, i, d); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// dependencies returns the indexes of the packages that package i depends
+// on, without duplicates and without i itself. Old reports without
+// ALL_DEPENDS only have the package names in DEPENDS.
+func dependencies(i int, depends, allDepends []string, index map[string]int, byPath map[string][]int) []int {
+	seen := make(map[int]bool)
+	var deps []int
+	add := func(d int) {
+		if d != i && !seen[d] {
+			seen[d] = true
+			deps = append(deps, d)
+		}
+	}
+	named := make(map[int]bool, len(depends))
+	for _, dep := range depends {
+		if d, ok := index[dep]; ok {
+			named[d] = true
+		}
+	}
+	for _, p := range allDepends {
+		candidates := byPath[p]
+		if len(candidates) == 1 {
+			add(candidates[0])
+			continue
+		}
+		for _, d := range candidates {
+			if named[d] {
+				add(d)
+			}
+		}
+	}
+	for _, dep := range depends {
+		if d, ok := index[dep]; ok {
+			add(d)
+		}
+	}
+	return deps
+}
+
+// sliceSink is a ResultSink that collects the results in memory.
+type sliceSink []ddao.PkgResult
+
+func (s *sliceSink) Write(_ context.Context, r ddao.PkgResult) error {
+	*s = append(*s, r)
+	return nil
+}
+
+func (s *sliceSink) Fixup(_ context.Context, n int, failedDeps string, breaks int64) error {
+	(*s)[n].FailedDeps = failedDeps
+	(*s)[n].Breaks = breaks
+	return nil
+}
+
+// Depend is a no-op, PkgsFromReport does not return the dependency graph.
+func (s *sliceSink) Depend(context.Context, int, int) error {
+	return nil
+}
+
+// FailedDep is a no-op, the root causes are part of FailedDeps.
+func (s *sliceSink) FailedDep(context.Context, int, int) error {
+	return nil
+}
+
+// PkgsFromReport parses the machine-readable report in r and returns all
+// package results. See StreamReport for a version that does not keep all
+// of them in memory.
+func PkgsFromReport(r io.Reader) ([]ddao.PkgResult, error) {
+	var pkgs sliceSink
+	_, err := StreamReport(context.Background(), r, &pkgs)
+	return pkgs, err
 }
 
 // PkgsByName allows sorting a list of Pkgs by their package names.
@@ -21,11 +21,16 @@
 package bulk
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/ulikunitz/xz"
 )
 
 const pkgFoo = `
@@ -40,6 +45,27 @@ BUILD_STATUS=failed
 DEPENDS=
 `
 
+const pkgQux = `
+PKGNAME=qux-1.0
+BUILD_STATUS=indirect-failed
+DEPENDS=foo-1.0
+`
+
+const pkgBaz = `
+PKGNAME=baz-3.0
+BUILD_STATUS=prefailed
+DEPENDS=
+PKG_FAIL_REASON="baz-3.0 is marked as broken:" Does\ not\ build.
+PKG_SKIP_REASON="baz-3.0 is not available for Linux-3.13.0-x86_64"
+MAINTAINER=pkgsrc-users@NetBSD.org
+CATEGORIES=devel python
+PKG_DEPTH=3
+MULTI_VERSION= PYTHON_VERSION_REQD=27
+RESTRICTED=Redistribution not permitted
+NO_BIN_ON_FTP=Redistribution not permitted
+BOOTSTRAP_PKG=yes
+`
+
 var pkgsFromReportTests = []struct {
 	report string
 	want   []ddao.PkgResult
@@ -71,6 +97,49 @@ var pkgsFromReportTests = []struct {
 			},
 		},
 	},
+	{
+		// qux only depends on bar through foo.
+		pkgQux + pkgFoo + pkgBar,
+		[]ddao.PkgResult{
+			{
+				Result: ddao.Result{
+					PkgName:     "qux-1.0",
+					BuildStatus: IndirectFailed,
+					FailedDeps:  "bar-2.0",
+				},
+			}, {
+				Result: ddao.Result{
+					PkgName:     "foo-1.0",
+					BuildStatus: IndirectFailed,
+					FailedDeps:  "bar-2.0",
+				},
+			}, {
+				Result: ddao.Result{
+					PkgName:     "bar-2.0",
+					BuildStatus: Failed,
+					Breaks:      2,
+				},
+			},
+		},
+	},
+	{
+		pkgBaz,
+		[]ddao.PkgResult{{
+			Result: ddao.Result{
+				PkgName:      "baz-3.0",
+				BuildStatus:  Prefailed,
+				FailReason:   `"baz-3.0 is marked as broken:" Does\ not\ build.`,
+				SkipReason:   `"baz-3.0 is not available for Linux-3.13.0-x86_64"`,
+				Maintainer:   "pkgsrc-users@NetBSD.org",
+				Categories:   "devel python",
+				PkgDepth:     3,
+				MultiVersion: "PYTHON_VERSION_REQD=27",
+				Restricted:   "Redistribution not permitted",
+				NoBinOnFtp:   "Redistribution not permitted",
+				BootstrapPkg: true,
+			},
+		}},
+	},
 }
 
 func TestPkgsFromReport(t *testing.T) {
@@ -81,3 +150,139 @@ func TestPkgsFromReport(t *testing.T) {
 		}
 	}
 }
+
+// countingSink is a ResultSink that only counts the results.
+type countingSink struct {
+	n, fixups, deps, failedDeps int
+}
+
+func (c *countingSink) Write(context.Context, ddao.PkgResult) error {
+	c.n++
+	return nil
+}
+
+func (c *countingSink) Fixup(context.Context, int, string, int64) error {
+	c.fixups++
+	return nil
+}
+
+func (c *countingSink) Depend(context.Context, int, int) error {
+	c.deps++
+	return nil
+}
+
+func (c *countingSink) FailedDep(context.Context, int, int) error {
+	c.failedDeps++
+	return nil
+}
+
+func TestStreamReport(t *testing.T) {
+	var sink countingSink
+	n, err := StreamReport(context.Background(), strings.NewReader(pkgFoo+pkgBar), &sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// foo's FailedDeps and bar's Breaks, and foo depends on and is
+	// broken by bar.
+	if n != 2 || sink.n != 2 || sink.fixups != 2 || sink.deps != 1 || sink.failedDeps != 1 {
+		t.Errorf("got %d results, %d written, %d fixups, %d dependencies, %d failed dependencies; want 2, 2, 2, 1, 1",
+			n, sink.n, sink.fixups, sink.deps, sink.failedDeps)
+	}
+}
+
+// edgeSink is a ResultSink that records the dependencies by name.
+type edgeSink struct {
+	countingSink
+	names []string
+	edges []string
+}
+
+func (e *edgeSink) Write(_ context.Context, r ddao.PkgResult) error {
+	e.names = append(e.names, r.PkgName)
+	return nil
+}
+
+func (e *edgeSink) Depend(_ context.Context, n, dep int) error {
+	e.edges = append(e.edges, e.names[n]+" -> "+e.names[dep])
+	return nil
+}
+
+const allDependsReport = `
+PKGNAME=app-1.0
+PKG_LOCATION=misc/app
+BUILD_STATUS=OK
+ALL_DEPENDS=gettext-lib>=0.18:../../devel/gettext-lib py39-foo-[0-9]*:../../devel/py-foo gettext-lib>=0.20:../../devel/gettext-lib
+DEPENDS=gettext-lib-0.21 py39-foo-1.0 gettext-lib-0.21
+PKGNAME=gettext-lib-0.21
+PKG_LOCATION=devel/gettext-lib
+BUILD_STATUS=OK
+PKGNAME=py38-foo-1.0
+PKG_LOCATION=devel/py-foo
+BUILD_STATUS=OK
+PKGNAME=py39-foo-1.0
+PKG_LOCATION=devel/py-foo
+BUILD_STATUS=OK
+PKGNAME=tool-2.0
+PKG_LOCATION=devel/tool
+BUILD_STATUS=OK
+ALL_DEPENDS=gettext-lib>=0.18:../../devel/gettext-lib missing-[0-9]*:../../devel/missing
+`
+
+func TestStreamReportAllDepends(t *testing.T) {
+	var sink edgeSink
+	if _, err := StreamReport(context.Background(), strings.NewReader(allDependsReport), &sink); err != nil {
+		t.Fatal(err)
+	}
+	// Duplicates are dropped, the version built from a multi-version
+	// pkgpath is taken from DEPENDS, and packages without DEPENDS get
+	// their dependencies from ALL_DEPENDS.
+	want := []string{
+		"app-1.0 -> gettext-lib-0.21",
+		"app-1.0 -> py39-foo-1.0",
+		"tool-2.0 -> gettext-lib-0.21",
+	}
+	if !reflect.DeepEqual(sink.edges, want) {
+		t.Errorf("got dependencies %q, want %q", sink.edges, want)
+	}
+}
+
+// readReport returns the uncompressed test report.
+func readReport(b *testing.B) []byte {
+	b.Helper()
+	f, err := os.Open("../testing/btinject/data/report.xz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	r, err := xz.NewReader(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	report, err := io.ReadAll(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return report
+}
+
+func BenchmarkPkgsFromReport(b *testing.B) {
+	report := readReport(b)
+	b.SetBytes(int64(len(report)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := PkgsFromReport(bytes.NewReader(report)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamReport(b *testing.B) {
+	report := readReport(b)
+	b.SetBytes(int64(len(report)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := StreamReport(context.Background(), bytes.NewReader(report), &countingSink{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -23,6 +23,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"embed"
 	"flag"
 	"fmt"
@@ -30,6 +31,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,7 +39,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/exporter-toolkit/web"
 
-	"github.com/bsiegert/BulkTracker/dao"
+	"github.com/bsiegert/BulkTracker/auth"
 	"github.com/bsiegert/BulkTracker/ddao"
 	"github.com/bsiegert/BulkTracker/ingest"
 	"github.com/bsiegert/BulkTracker/json"
@@ -49,11 +51,27 @@ import (
 var (
 	port        = flag.Int("port", 8080, "The port to use.")
 	metricsAddr = flag.String("metrics_addr", "", "host:port for serving Prometheus metrics, or 'main' to serve them on the main port")
-	dbPath      = flag.String("db_path", "BulkTracker.db", "The path to the SQLite database file.")
+	dbDriver    = flag.String("db_driver", "sqlite3", "The database driver to use, either \"sqlite3\" or \"postgres\".")
+	dbPath      = flag.String("db_path", "BulkTracker.db", "The path to the SQLite database file, or the PostgreSQL connection string.")
+	autoMigrate = flag.Bool("auto_migrate", true, "Apply pending schema migrations at startup. If false, run \"bulktracker migrate\" instead.")
+
+	smtpAddr       = flag.String("smtp_addr", "", "host:port for receiving build reports via SMTP. If empty, no SMTP server is started.")
+	smtpRecipients = flag.String("smtp_recipients", "", "Comma-separated list of addresses to accept mail for via SMTP. If empty, all are accepted.")
+
+	adminUser         = flag.String("admin_user", "admin", "The user name for administrative actions.")
+	adminPassword     = flag.String("admin_password", "", "The password for administrative actions. Command line arguments are visible to other users; prefer -admin_password_file or the BULKTRACKER_ADMIN_PASSWORD environment variable. If no password is set, administrative actions are disabled.")
+	adminPasswordFile = flag.String("admin_password_file", "", "Path to a file containing the password for administrative actions.")
+
+	uploadTokens = flag.String("upload_tokens", "", "Path to a file with \"builder token\" lines for the /upload endpoint. If empty, uploads are disabled.")
+
+	maxFetchAttempts = flag.Int("max_fetch_attempts", ingest.DefaultMaxFetchAttempts, "The number of times to try fetching a report before giving up.")
+
+	duplicates ingest.DuplicatePolicy
 )
 
 func init() {
 	flag.StringVar(&templates.BasePath, "base_path", "/", "The path under which to serve the UI, e.g. '/bulktracker/'.")
+	flag.Var(&duplicates, "duplicates", "What to do with reports for builds that already exist: skip, replace or keep.")
 }
 
 //go:embed images mock static robots.txt
@@ -74,6 +92,35 @@ func fileHandler(name string) (http.HandlerFunc, error) {
 	}, nil
 }
 
+// splitList splits a comma-separated flag value, ignoring whitespace
+// around the entries and empty entries.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// loadAdminPassword returns the administrator password from
+// -admin_password_file, -admin_password or the BULKTRACKER_ADMIN_PASSWORD
+// environment variable, in that order.
+func loadAdminPassword() (string, error) {
+	if *adminPasswordFile != "" {
+		b, err := os.ReadFile(*adminPasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	if *adminPassword != "" {
+		return *adminPassword, nil
+	}
+	return os.Getenv("BULKTRACKER_ADMIN_PASSWORD"), nil
+}
+
 func registerCategories(ctx context.Context, mux *http.ServeMux, ddb *ddao.DB, handler http.Handler) error {
 	categories, err := ddb.GetCategories(ctx)
 	if err != nil {
@@ -86,43 +133,144 @@ func registerCategories(ctx context.Context, mux *http.ServeMux, ddb *ddao.DB, h
 	return nil
 }
 
+// migrateDB applies the pending schema migrations to the database if apply
+// is true. Otherwise, it only checks that the schema is up to date.
+func migrateDB(ctx context.Context, db *sql.DB, apply bool) error {
+	if apply {
+		return ddao.Migrate(ctx, db)
+	}
+	return ddao.CheckSchema(ctx, db)
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate | export [export flags] | import [file ...]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	ctx := context.Background()
 
-	mux := http.NewServeMux()
+	switch flag.Arg(0) {
+	case "", "migrate", "export", "import":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	db, err := dao.New(ctx, "sqlite3", *dbPath)
+	db, err := ddao.Open(*dbDriver, *dbPath)
 	if err != nil {
 		log.Errorf(ctx, "failed to open database: %s", err)
 		os.Exit(1)
 	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := migrateDB(ctx, db, true); err != nil {
+			log.Errorf(ctx, "failed to migrate database: %s", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := migrateDB(ctx, db, *autoMigrate); err != nil {
+		log.Errorf(ctx, "database schema: %s", err)
+		os.Exit(1)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "export", "import":
+		run := runExport
+		if cmd == "import" {
+			run = runImport
+		}
+		ddb := ddao.DB{Queries: *ddao.New(db)}
+		if err := run(ctx, &ddb, flag.Args()[1:]); err != nil {
+			log.Errorf(ctx, "%s: %s", cmd, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	mux := http.NewServeMux()
+
 	var ddb ddao.DB
-	ddb.Queries = *ddao.New(db.DB)
+	ddb.Queries = *ddao.New(db)
+
+	mailHandler := &ingest.IncomingMailHandler{
+		DB:               &ddb,
+		Duplicates:       duplicates,
+		MaxFetchAttempts: *maxFetchAttempts,
+	}
+	password, err := loadAdminPassword()
+	if err != nil {
+		log.Errorf(ctx, "failed to read the admin password: %s", err)
+		os.Exit(1)
+	}
+	admin := &auth.Admin{
+		User:     *adminUser,
+		Password: password,
+	}
 
 	// Do not serve this under basePath.
-	http.Handle("/_ah/mail/", &ingest.IncomingMailHandler{
-		DB: &ddb,
-	})
+	http.Handle("/_ah/mail/", mailHandler)
+	go mailHandler.RetryFetches(ctx, time.Minute)
+
+	if *uploadTokens != "" {
+		tokens, err := auth.LoadTokens(*uploadTokens)
+		if err != nil {
+			log.Errorf(ctx, "failed to load upload tokens: %s", err)
+			os.Exit(1)
+		}
+		// Do not serve this under basePath either.
+		http.Handle("/upload", &ingest.UploadHandler{
+			Ingest: mailHandler,
+			Tokens: tokens,
+		})
+	}
+
+	if *smtpAddr != "" {
+		smtpServer := &ingest.SMTPServer{
+			Addr:    *smtpAddr,
+			Deliver: mailHandler.HandleMail,
+		}
+		if *smtpRecipients != "" {
+			smtpServer.Recipients = splitList(*smtpRecipients)
+		}
+		go func() {
+			log.Errorf(ctx, "SMTP server: %v", smtpServer.ListenAndServe())
+		}()
+	}
 
 	mux.Handle("/", &pages.StartPage{
 		DB:       &ddb,
 		BasePath: templates.BasePath,
 	})
 	mux.Handle("/build/", &pages.BuildDetails{
-		DB: &ddb,
+		DB:     &ddb,
+		Ingest: mailHandler,
+		Admin:  admin,
 	})
 	mux.HandleFunc("/builds", pages.ShowBuilds)
+	mux.Handle("/diff/", &pages.BuildDiff{
+		DB: &ddb,
+	})
+	mux.Handle("/admin/fetches", &pages.FailedFetches{
+		DB:     &ddb,
+		Ingest: mailHandler,
+		Admin:  admin,
+	})
 	mux.Handle("/robots.txt", http.FileServer(http.FS(staticContent)))
 	mux.Handle("/images/", http.FileServer(http.FS(staticContent)))
 	mux.Handle("/mock/", http.FileServer(http.FS(staticContent)))
 	mux.Handle("/static/", http.FileServer(http.FS(staticContent)))
 	mux.Handle("/json/", &json.API{
-		DB: &ddb,
+		DB:    &ddb,
+		Admin: admin,
 	})
 	mux.Handle("/pkg/", &pages.PkgDetails{
 		DB: &ddb,
 	})
+	mux.Handle("/search", &pages.Search{
+		DB: &ddb,
+	})
 
 	h, err := fileHandler("static/favicon.ico")
 	if err != nil {
@@ -22,12 +22,13 @@ package dao
 
 import (
 	"context"
+	"database/sql"
 	"os"
-	"os/exec"
 	"testing"
 	"time"
 
 	"github.com/bsiegert/BulkTracker/bulk"
+	"github.com/bsiegert/BulkTracker/ddao"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	_ "github.com/mattn/go-sqlite3"
@@ -45,16 +46,13 @@ func setup(t *testing.T) *DB {
 		tempfile.Close()
 	})
 
-	schema, err := os.Open("../schema.sql")
+	ctx := context.Background()
+	sqldb, err := sql.Open("sqlite3", tempfile.Name()+"?_fk=true")
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	ctx := context.Background()
-	cmd := exec.CommandContext(ctx, "sqlite3", tempfile.Name())
-	cmd.Stdin = schema
-	err = cmd.Run()
-	if err != nil {
+	defer sqldb.Close()
+	if err := ddao.Migrate(ctx, sqldb); err != nil {
 		t.Fatal(err)
 	}
 
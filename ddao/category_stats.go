@@ -0,0 +1,65 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import "context"
+
+// add counts a package with the given build status. The values are those
+// of the constants in the bulk package.
+func (c *CategoryStat) add(status int64) {
+	switch status {
+	case 0:
+		c.NumOk++
+	case 1:
+		c.NumPrefailed++
+	case 2:
+		c.NumFailed++
+	case 3:
+		c.NumIndirectFailed++
+	case 4:
+		c.NumIndirectPrefailed++
+	}
+}
+
+// Total returns the number of packages in the category.
+func (c *CategoryStat) Total() int64 {
+	return c.NumOk + c.NumPrefailed + c.NumFailed + c.NumIndirectFailed + c.NumIndirectPrefailed
+}
+
+// FailedPercent returns the percentage of packages in the category that
+// failed, either directly or because of a failed dependency.
+func (c *CategoryStat) FailedPercent() float64 {
+	total := c.Total()
+	if total == 0 {
+		return 0
+	}
+	return float64(c.NumFailed+c.NumIndirectFailed) * 100 / float64(total)
+}
+
+// putCategoryStats writes the category statistics of a build.
+func putCategoryStats(ctx context.Context, q *Queries, stats map[string]*CategoryStat) error {
+	for _, c := range stats {
+		if err := q.PutCategoryStat(ctx, PutCategoryStatParams(*c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
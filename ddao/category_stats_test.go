@@ -0,0 +1,109 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCategoryStats(t *testing.T) {
+	forEachDB(t, testCategoryStats)
+}
+
+func testCategoryStats(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	buildID := addBuild(t, db, "NetBSD",
+		pkgResult("devel/", "libtool", "libtool-2.4", 0),
+		pkgResult("devel/", "foo", "foo-1.0", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 3),
+		pkgResult("www/", "baz", "baz-1.0", 1),
+	)
+	want := []CategoryStat{
+		{BuildID: buildID, Category: "devel/", NumOk: 1, NumFailed: 1, NumIndirectFailed: 1},
+		{BuildID: buildID, Category: "www/", NumPrefailed: 1},
+	}
+	got, err := db.GetCategoryStats(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetCategoryStats: diff (-want +got):\n%s", diff)
+	}
+	if p := want[0].FailedPercent(); p < 66.6 || p > 66.7 {
+		t.Errorf("FailedPercent() = %v, want 66.7", p)
+	}
+
+	// The migration computes the same statistics for existing results.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM category_stats"); err != nil {
+		t.Fatal(err)
+	}
+	rerunBackfill(t, db, 10)
+	got, err = db.GetCategoryStats(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetCategoryStats after migration: diff (-want +got):\n%s", diff)
+	}
+
+	// Writing the results again replaces the statistics.
+	err = db.PutResults(ctx, []PkgResult{pkgResult("devel/", "foo", "foo-1.0", 0)}, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.GetCategoryStats(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []CategoryStat{{BuildID: buildID, Category: "devel/", NumOk: 1}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetCategoryStats after PutResults: diff (-want +got):\n%s", diff)
+	}
+
+	// Dropping the results keeps the statistics, and the build page can
+	// tell that the results are gone.
+	if err := db.DeleteResults(ctx, buildID); err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.GetCategoryStats(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetCategoryStats after DeleteResults: diff (-want +got):\n%s", diff)
+	}
+	n, err := db.CountResultsForBuild(ctx, sql.NullInt64{Int64: buildID, Valid: true})
+	if err != nil || n != 0 {
+		t.Errorf("CountResultsForBuild after DeleteResults = %d, %v; want 0", n, err)
+	}
+
+	if err := db.DeleteBuild(ctx, buildID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetCategoryStats(ctx, buildID); err != nil || len(got) != 0 {
+		t.Errorf("GetCategoryStats after DeleteBuild: got %v, %v, want none", got, err)
+	}
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+)
+
+// A PkgChange is a package whose result differs between two builds. For
+// an added package, the Old fields are zero, and for a removed one, the
+// New fields.
+type PkgChange struct {
+	PkgPath      string
+	MultiVersion string
+
+	OldResultID    int64
+	OldPkgName     string
+	OldBuildStatus int64
+
+	NewResultID    int64
+	NewPkgName     string
+	NewBuildStatus int64
+}
+
+// A BuildDiff lists what changed from one build to another. A package
+// can appear in more than one list, e.g. if it was updated and failed.
+type BuildDiff struct {
+	From, To Build
+
+	NewlyFailed    []PkgChange
+	NewlyFixed     []PkgChange
+	NewlyPrefailed []PkgChange
+	Added          []PkgChange
+	Removed        []PkgChange
+	VersionChanged []PkgChange
+}
+
+// The build statuses, as in the bulk package.
+const (
+	statusOK = iota
+	statusPrefailed
+	statusFailed
+	statusIndirectFailed
+	statusIndirectPrefailed
+)
+
+func isFailed(status int64) bool {
+	return status == statusFailed || status == statusIndirectFailed
+}
+
+func isPrefailed(status int64) bool {
+	return status == statusPrefailed || status == statusIndirectPrefailed
+}
+
+// diffKey identifies a package within a build. Packages built for several
+// versions of e.g. Python have one result per version.
+type diffKey struct {
+	pkgPath, multiVersion string
+}
+
+// DiffBuilds compares the results of the builds from and to.
+func (d *DB) DiffBuilds(ctx context.Context, from, to int64) (*BuildDiff, error) {
+	var diff BuildDiff
+	var err error
+	if diff.From, err = d.GetBuild(ctx, from); err != nil {
+		return nil, err
+	}
+	if diff.To, err = d.GetBuild(ctx, to); err != nil {
+		return nil, err
+	}
+	oldResults, err := d.GetResultStatuses(ctx, sql.NullInt64{Int64: from, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+	newResults, err := d.GetResultStatuses(ctx, sql.NullInt64{Int64: to, Valid: true})
+	if err != nil {
+		return nil, err
+	}
+
+	old := make(map[diffKey]GetResultStatusesRow, len(oldResults))
+	for _, r := range oldResults {
+		old[diffKey{r.Category + r.Dir, r.MultiVersion}] = r
+	}
+	for _, n := range newResults {
+		key := diffKey{n.Category + n.Dir, n.MultiVersion}
+		c := PkgChange{
+			PkgPath:        key.pkgPath,
+			MultiVersion:   key.multiVersion,
+			NewResultID:    n.ResultID,
+			NewPkgName:     n.PkgName,
+			NewBuildStatus: n.BuildStatus,
+		}
+		o, ok := old[key]
+		if !ok {
+			diff.Added = append(diff.Added, c)
+			continue
+		}
+		delete(old, key)
+		c.OldResultID = o.ResultID
+		c.OldPkgName = o.PkgName
+		c.OldBuildStatus = o.BuildStatus
+
+		switch {
+		case isFailed(n.BuildStatus) && !isFailed(o.BuildStatus):
+			diff.NewlyFailed = append(diff.NewlyFailed, c)
+		case n.BuildStatus == statusOK && isFailed(o.BuildStatus):
+			diff.NewlyFixed = append(diff.NewlyFixed, c)
+		case isPrefailed(n.BuildStatus) && !isPrefailed(o.BuildStatus):
+			diff.NewlyPrefailed = append(diff.NewlyPrefailed, c)
+		}
+		if n.PkgName != o.PkgName {
+			diff.VersionChanged = append(diff.VersionChanged, c)
+		}
+	}
+	for key, o := range old {
+		diff.Removed = append(diff.Removed, PkgChange{
+			PkgPath:        key.pkgPath,
+			MultiVersion:   key.multiVersion,
+			OldResultID:    o.ResultID,
+			OldPkgName:     o.PkgName,
+			OldBuildStatus: o.BuildStatus,
+		})
+	}
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		a, b := diff.Removed[i], diff.Removed[j]
+		if a.PkgPath != b.PkgPath {
+			return a.PkgPath < b.PkgPath
+		}
+		return a.MultiVersion < b.MultiVersion
+	})
+	return &diff, nil
+}
+
+// DiffWithPrevious compares the given build with the previous one from the
+// same builder. It returns sql.ErrNoRows if there is none.
+func (d *DB) DiffWithPrevious(ctx context.Context, buildID int64) (*BuildDiff, error) {
+	prev, err := d.GetPreviousBuild(ctx, buildID)
+	if err != nil {
+		return nil, err
+	}
+	return d.DiffBuilds(ctx, prev.BuildID, buildID)
+}
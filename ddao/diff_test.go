@@ -0,0 +1,107 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// changedPaths reduces a list of changes to the package paths.
+func changedPaths(changes []PkgChange) []string {
+	var paths []string
+	for _, c := range changes {
+		paths = append(paths, c.PkgPath)
+	}
+	return paths
+}
+
+func TestDiffBuilds(t *testing.T) {
+	forEachDB(t, testDiffBuilds)
+}
+
+func testDiffBuilds(t *testing.T, db *DB) {
+	ctx := context.Background()
+	day := func(n int) time.Time {
+		return time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	b1 := addBuildAt(t, db, "NetBSD", day(10),
+		pkgResult("devel/", "broken", "broken-1.0", 0),
+		pkgResult("devel/", "fixed", "fixed-1.0", 2),
+		pkgResult("devel/", "pre", "pre-1.0", 0),
+		pkgResult("devel/", "updated", "updated-1.0", 0),
+		pkgResult("devel/", "gone", "gone-1.0", 0),
+		pkgResult("devel/", "same", "same-1.0", 3),
+	)
+	b2 := addBuildAt(t, db, "NetBSD", day(12),
+		pkgResult("devel/", "broken", "broken-1.0", 3),
+		pkgResult("devel/", "fixed", "fixed-1.0", 0),
+		pkgResult("devel/", "pre", "pre-1.0", 4),
+		pkgResult("devel/", "updated", "updated-1.1", 0),
+		pkgResult("devel/", "new", "new-1.0", 0),
+		pkgResult("devel/", "same", "same-1.0", 3),
+	)
+	// Builds from other builders or before b1 are not the previous build.
+	addBuildAt(t, db, "Linux", day(11), pkgResult("devel/", "broken", "broken-1.0", 0))
+	addBuildAt(t, db, "NetBSD", day(1), pkgResult("devel/", "broken", "broken-1.0", 0))
+
+	diff, err := db.DiffWithPrevious(ctx, b2)
+	if err != nil {
+		t.Fatalf("DiffWithPrevious(%d): %v", b2, err)
+	}
+	if diff.From.BuildID != b1 || diff.To.BuildID != b2 {
+		t.Errorf("DiffWithPrevious(%d) compared %d to %d, want %d to %d", b2, diff.From.BuildID, diff.To.BuildID, b1, b2)
+	}
+	for _, tc := range []struct {
+		name string
+		got  []PkgChange
+		want []string
+	}{
+		{"NewlyFailed", diff.NewlyFailed, []string{"devel/broken"}},
+		{"NewlyFixed", diff.NewlyFixed, []string{"devel/fixed"}},
+		{"NewlyPrefailed", diff.NewlyPrefailed, []string{"devel/pre"}},
+		{"Added", diff.Added, []string{"devel/new"}},
+		{"Removed", diff.Removed, []string{"devel/gone"}},
+		{"VersionChanged", diff.VersionChanged, []string{"devel/updated"}},
+	} {
+		if d := cmp.Diff(tc.want, changedPaths(tc.got)); d != "" {
+			t.Errorf("%s: diff (-want +got):\n%s", tc.name, d)
+		}
+	}
+	if c := diff.VersionChanged[0]; c.OldPkgName != "updated-1.0" || c.NewPkgName != "updated-1.1" {
+		t.Errorf("VersionChanged: got %q -> %q, want updated-1.0 -> updated-1.1", c.OldPkgName, c.NewPkgName)
+	}
+
+	// The oldest build of a builder has nothing to compare with.
+	b0, err := db.GetPreviousBuild(ctx, b1)
+	if err != nil {
+		t.Fatalf("GetPreviousBuild(%d): %v", b1, err)
+	}
+	if _, err := db.DiffWithPrevious(ctx, b0.BuildID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("DiffWithPrevious(%d): got err %v, want sql.ErrNoRows", b0.BuildID, err)
+	}
+}
@@ -0,0 +1,140 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// latest is a result from GetLatestPkgResults, reduced to what identifies
+// it.
+type latest struct {
+	BuildID     int64
+	Platform    string
+	BuildStatus int64
+}
+
+func latestResults(t *testing.T, db *DB, dir string) []latest {
+	t.Helper()
+	rows, err := db.LatestPkgResults(context.Background(), "devel/", dir)
+	if err != nil {
+		t.Fatalf("LatestPkgResults(%q): %v", dir, err)
+	}
+	var got []latest
+	for _, r := range rows {
+		got = append(got, latest{r.BuildID, r.Platform, r.BuildStatus})
+	}
+	return got
+}
+
+func TestLatestResults(t *testing.T) {
+	forEachDB(t, testLatestResults)
+}
+
+func testLatestResults(t *testing.T, db *DB) {
+	ctx := context.Background()
+	day := func(n int) time.Time {
+		return time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	b1 := addBuildAt(t, db, "NetBSD", day(10),
+		pkgResult("devel/", "foo", "foo-1.0", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 0),
+	)
+	b2 := addBuildAt(t, db, "NetBSD", day(12), pkgResult("devel/", "foo", "foo-1.1", 0))
+	b3 := addBuildAt(t, db, "Linux", day(11), pkgResult("devel/", "foo", "foo-1.0", 2))
+	// An older build written later does not replace newer results.
+	addBuildAt(t, db, "NetBSD", day(1), pkgResult("devel/", "foo", "foo-0.9", 1))
+
+	want := []latest{{b2, "NetBSD", 0}, {b3, "Linux", 2}}
+	if diff := cmp.Diff(want, latestResults(t, db, "foo")); diff != "" {
+		t.Errorf("foo: diff (-want +got):\n%s", diff)
+	}
+	// bar is missing from the newest build.
+	if diff := cmp.Diff([]latest{{b1, "NetBSD", 0}}, latestResults(t, db, "bar")); diff != "" {
+		t.Errorf("bar: diff (-want +got):\n%s", diff)
+	}
+
+	// The migration computes the same table for existing results.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM latest_results"); err != nil {
+		t.Fatal(err)
+	}
+	rerunBackfill(t, db, 11)
+	if diff := cmp.Diff(want, latestResults(t, db, "foo")); diff != "" {
+		t.Errorf("foo after migration: diff (-want +got):\n%s", diff)
+	}
+
+	// Deleting the newest build brings back the previous results.
+	if err := db.DeleteBuild(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	want = []latest{{b3, "Linux", 2}, {b1, "NetBSD", 2}}
+	if diff := cmp.Diff(want, latestResults(t, db, "foo")); diff != "" {
+		t.Errorf("foo after DeleteBuild: diff (-want +got):\n%s", diff)
+	}
+
+	// Writing the results again replaces them.
+	if err := db.PutResults(ctx, []PkgResult{pkgResult("devel/", "foo", "foo-1.0", 0)}, b1); err != nil {
+		t.Fatal(err)
+	}
+	want = []latest{{b3, "Linux", 2}, {b1, "NetBSD", 0}}
+	if diff := cmp.Diff(want, latestResults(t, db, "foo")); diff != "" {
+		t.Errorf("foo after PutResults: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLatestResultsMultiVersion(t *testing.T) {
+	forEachDB(t, testLatestResultsMultiVersion)
+}
+
+func testLatestResultsMultiVersion(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	// A package built for several Python versions has one result per
+	// version in the same build. On PostgreSQL, the upsert fails if it
+	// sees more than one of them.
+	multiVersion := func(pkgName, version string, status int64) PkgResult {
+		r := pkgResult("devel/", "py-foo", pkgName, status)
+		r.MultiVersion = "PYTHON_VERSION_REQD=" + version
+		return r
+	}
+	b1 := addBuild(t, db, "NetBSD",
+		multiVersion("py38-foo-1.0", "38", 2),
+		multiVersion("py39-foo-1.0", "39", 0),
+	)
+	want := []latest{{b1, "NetBSD", 0}}
+	if diff := cmp.Diff(want, latestResults(t, db, "py-foo")); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// The migration picks the same result.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM latest_results"); err != nil {
+		t.Fatal(err)
+	}
+	rerunBackfill(t, db, 11)
+	if diff := cmp.Diff(want, latestResults(t, db, "py-foo")); diff != "" {
+		t.Errorf("after migration: diff (-want +got):\n%s", diff)
+	}
+}
@@ -24,7 +24,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"net/url"
 	"path"
 	"strings"
@@ -87,8 +86,141 @@ func (d *DB) BeginReadOnlyTransaction(ctx context.Context) (*DB, func(), error)
 	}, func() { tx.Rollback() }, nil
 }
 
-// PutResults writes the results for the given build ID to the database.
+// PutNewBuild looks for builds with the same platform, timestamp, branch,
+// compiler and user as arg and writes arg as a new build, unless such
+// builds exist and skipDuplicates is true. It returns the new build ID, or
+// 0 if it was skipped, and the IDs of the existing builds.
+//
+// Both steps run in one serializable transaction, so that two reports for
+// the same build that arrive at the same time cannot both be added. One of
+// them fails instead.
+func (d *DB) PutNewBuild(ctx context.Context, arg PutBuildParams, skipDuplicates bool) (int64, []int64, error) {
+	tx, err := d.BeginTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	q := d.WithTx(tx)
+	dups, err := q.FindBuilds(ctx, FindBuildsParams{
+		Platform:  arg.Platform,
+		BuildTs:   arg.BuildTs,
+		Branch:    arg.Branch,
+		Compiler:  arg.Compiler,
+		BuildUser: arg.BuildUser,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(dups) > 0 && skipDuplicates {
+		return 0, dups, nil
+	}
+	id, err := q.PutBuild(ctx, arg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, dups, tx.Commit()
+}
+
+// PutResults writes the results for the given build ID to the database,
+// replacing any existing ones. The root causes listed in FailedDeps are
+// linked to the results with these names.
 func (d *DB) PutResults(ctx context.Context, results []PkgResult, buildID int64) error {
+	w, err := d.NewResultWriter(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	index := make(map[string]int, len(results))
+	for i, r := range results {
+		if err := w.Write(ctx, r); err != nil {
+			return err
+		}
+		index[r.PkgName] = i
+	}
+	for i, r := range results {
+		seen := make(map[int]bool)
+		for _, name := range strings.Fields(r.FailedDeps) {
+			f, ok := index[name]
+			if !ok || f == i || seen[f] {
+				continue
+			}
+			seen[f] = true
+			if err := w.FailedDep(ctx, i, f); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Commit(ctx)
+}
+
+// DeleteBuild removes the build with the given ID together with all its
+// results and ingestion records. Packages that are no longer referenced by
+// any result are removed as well. The regressions of the next build from
+// the same builder are recomputed against its new predecessor. It returns
+// sql.ErrNoRows if there is no such build.
+func (d *DB) DeleteBuild(ctx context.Context, buildID int64) error {
+	index, err := d.hasSearchIndex(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := d.BeginTransaction(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := d.WithTx(tx)
+	next, err := q.GetNextBuild(ctx, buildID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := q.DeleteIngestJobsForBuild(ctx, buildID); err != nil {
+		return err
+	}
+	if err := q.DeleteFetchRetry(ctx, buildID); err != nil {
+		return err
+	}
+	if err := q.DeleteReplacedBuilds(ctx, buildID); err != nil {
+		return err
+	}
+	if err := deleteResults(ctx, q, buildID); err != nil {
+		return err
+	}
+	if err := q.DeleteCategoryStatsForBuild(ctx, buildID); err != nil {
+		return err
+	}
+	n, err := q.DeleteBuild(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := removeUnusedPkgs(ctx, q, index); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "Deleted build %v", buildID)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.updateRegressions(ctx, next.BuildID)
+	return nil
+}
+
+// DeleteResults removes the results of the build with the given ID, but
+// keeps the build record with its summary and category statistics.
+// Packages that are no longer referenced by any result are removed as
+// well. As for DeleteBuild, the regressions of the next build are
+// recomputed, because a build without results is not compared with.
+func (d *DB) DeleteResults(ctx context.Context, buildID int64) error {
+	index, err := d.hasSearchIndex(ctx)
+	if err != nil {
+		return err
+	}
 	tx, err := d.BeginTransaction(ctx, nil)
 	if err != nil {
 		return err
@@ -96,6 +228,43 @@ func (d *DB) PutResults(ctx context.Context, results []PkgResult, buildID int64)
 	defer tx.Rollback()
 
 	q := d.WithTx(tx)
+	next, err := q.GetNextBuild(ctx, buildID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := deleteResults(ctx, q, buildID); err != nil {
+		return err
+	}
+	if err := removeUnusedPkgs(ctx, q, index); err != nil {
+		return err
+	}
+
+	log.Infof(ctx, "Deleted results of build %v", buildID)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.updateRegressions(ctx, next.BuildID)
+	return nil
+}
+
+// deleteResults removes the results of the given build, the links
+// between them and its regressions. If some of them were the latest
+// results for the builder, the ones from the previous builds take their
+// place.
+func deleteResults(ctx context.Context, q *Queries, buildID int64) error {
+	latest, err := q.DeleteLatestResultsForBuild(ctx, buildID)
+	if err != nil {
+		return err
+	}
+	if err := q.DeleteDependenciesForBuild(ctx, buildID); err != nil {
+		return err
+	}
+	if err := q.DeleteFailedDependenciesForBuild(ctx, buildID); err != nil {
+		return err
+	}
+	if err := q.DeleteRegressionsForBuild(ctx, buildID); err != nil {
+		return err
+	}
 	err = q.DeleteAllForBuild(ctx, sql.NullInt64{
 		Int64: buildID,
 		Valid: true,
@@ -103,46 +272,10 @@ func (d *DB) PutResults(ctx context.Context, results []PkgResult, buildID int64)
 	if err != nil {
 		return err
 	}
-
-	l := len(results)
-	for i, result := range results {
-		if i%1000 == 0 || i == l {
-			log.Debugf(ctx, "Inserting record %v/%v ...", i, len(results))
-		}
-		params := PutPkgParams{
-			Category: result.Category,
-			Dir:      result.Dir,
-		}
-		err := q.PutPkg(ctx, params)
-		if err != nil {
-			return err
-		}
-		pkgID, err := q.GetPkgID(ctx, GetPkgIDParams(params))
-		if err != nil {
-			return err
-		}
-
-		err = q.PutResult(ctx, PutResultParams{
-			BuildID: sql.NullInt64{
-				Int64: buildID,
-				Valid: true,
-			},
-			PkgID: sql.NullInt64{
-				Int64: pkgID,
-				Valid: true,
-			},
-			PkgName:     result.PkgName,
-			BuildStatus: result.BuildStatus,
-			Breaks:      result.Breaks,
-			FailedDeps:  result.FailedDeps,
-		})
-		if err != nil {
-			return err
-		}
+	if latest == 0 {
+		return nil
 	}
-
-	log.Infof(ctx, "Successfully added results for build %v", buildID)
-	return tx.Commit()
+	return q.RefillLatestResults(ctx, buildID)
 }
 
 func (d *DB) LatestBuilds(ctx context.Context, filter bool) ([]Build, error) {
@@ -152,10 +285,17 @@ func (d *DB) LatestBuilds(ctx context.Context, filter bool) ([]Build, error) {
 	return d.getLatestBuilds(ctx)
 }
 
-// GetAllPkgsMatching returns all packages (category/dir) that contain
-// substr as a substring match.
-func (d *DB) GetAllPkgsMatching(ctx context.Context, substr string) ([]string, error) {
-	return d.getAllPkgsMatching(ctx, "%"+substr+"%")
+// LatestPkgResults returns the latest result for the given category and
+// dir from each builder.
+func (d *DB) LatestPkgResults(ctx context.Context, category, dir string) ([]GetLatestPkgResultsRow, error) {
+	pkgID, err := d.GetPkgID(ctx, GetPkgIDParams{
+		Category: category,
+		Dir:      dir,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.GetLatestPkgResults(ctx, pkgID)
 }
 
 // GetAllPkgResults returns all results for the given category and dir.
@@ -180,21 +320,3 @@ func (d *DB) GetAllPkgResults(ctx context.Context, category, dir string) ([]GetA
 		Valid: true,
 	})
 }
-
-// GetPkgsBrokenBy returns all packages that were broken by the given
-// result ID.
-func (d *DB) GetPkgsBrokenBy(ctx context.Context, resultID int64) ([]getPkgsBrokenByRow, error) {
-	tx, err := d.db.(*sql.DB).BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
-
-	q := d.Queries.WithTx(tx)
-
-	res, err := q.GetSingleResult(ctx, resultID)
-	if err != nil {
-		return nil, err
-	}
-	return q.getPkgsBrokenBy(ctx, fmt.Sprintf("%%%s%%", res.PkgName))
-}
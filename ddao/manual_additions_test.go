@@ -1,6 +1,130 @@
 package ddao
 
-import "testing"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// postgresDSN is the connection string of a PostgreSQL database for
+// testing. If it is empty, the tests only run against SQLite.
+var postgresDSN = os.Getenv("BULKTRACKER_TEST_POSTGRES")
+
+// openSQLite returns a new, empty SQLite database.
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := Open("sqlite3", filepath.Join(t.TempDir(), "bulktracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// openPostgres returns a connection to the test PostgreSQL database that
+// uses a new, empty schema. The schema is dropped at the end of the test.
+func openPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	if postgresDSN == "" {
+		t.Skip("BULKTRACKER_TEST_POSTGRES is not set")
+	}
+	dsn := postgresDSN
+	if kv, err := pq.ParseURL(dsn); err == nil {
+		dsn = kv
+	}
+	admin, err := Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("bulktracker_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	db, err := Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// forEachDriver runs f as a subtest for each supported database driver,
+// with a new, empty database.
+func forEachDriver(t *testing.T, f func(t *testing.T, db *sql.DB)) {
+	t.Run("sqlite3", func(t *testing.T) {
+		f(t, openSQLite(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		f(t, openPostgres(t))
+	})
+}
+
+// forEachDB runs f as a subtest for each supported database driver, with a
+// new database with the current schema.
+func forEachDB(t *testing.T, f func(t *testing.T, db *DB)) {
+	forEachDriver(t, func(t *testing.T, db *sql.DB) {
+		if err := Migrate(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		f(t, &DB{Queries: *New(db)})
+	})
+}
+
+// addBuild writes a build with the given results and returns its ID.
+func addBuild(t testing.TB, db *DB, platform string, results ...PkgResult) int64 {
+	t.Helper()
+	return addBuildAt(t, db, platform, time.Now(), results...)
+}
+
+// addBuildAt is like addBuild, with the given build timestamp.
+func addBuildAt(t testing.TB, db *DB, platform string, ts time.Time, results ...PkgResult) int64 {
+	t.Helper()
+	ctx := context.Background()
+
+	buildID, err := db.PutBuild(ctx, PutBuildParams{
+		Platform:  platform,
+		BuildTs:   ts,
+		Branch:    "HEAD",
+		Compiler:  "gcc",
+		BuildUser: "builder",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutResults(ctx, results, buildID); err != nil {
+		t.Fatal(err)
+	}
+	return buildID
+}
+
+func pkgResult(category, dir, pkgName string, status int64) PkgResult {
+	return PkgResult{
+		Pkg: Pkg{
+			Category: category,
+			Dir:      dir,
+		},
+		Result: Result{
+			PkgName:     pkgName,
+			BuildStatus: status,
+		},
+	}
+}
 
 func TestBaseURL(t *testing.T) {
 	testCases := []struct {
@@ -29,3 +153,212 @@ func TestBaseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteBuild(t *testing.T) {
+	forEachDB(t, testDeleteBuild)
+}
+
+func testDeleteBuild(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	keep := addBuild(t, db, "Linux", pkgResult("devel/", "libtool", "libtool-2.4", 0))
+	del := addBuild(t, db, "NetBSD",
+		pkgResult("devel/", "libtool", "libtool-2.4", 0),
+		pkgResult("lang/", "go", "go-1.20", 2))
+	err := db.PutFetchRetry(ctx, PutFetchRetryParams{
+		BuildID:  del,
+		Url:      "http://localhost/report.xz",
+		Attempts: 1,
+		NextTs:   time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteBuild(ctx, del); err != nil {
+		t.Fatalf("DeleteBuild(%d): %v", del, err)
+	}
+	if _, err := db.GetBuild(ctx, del); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetBuild(%d) after delete: got err %v, want ErrNoRows", del, err)
+	}
+	if _, err := db.GetBuild(ctx, keep); err != nil {
+		t.Errorf("GetBuild(%d): %v", keep, err)
+	}
+
+	// lang/go was only referenced by the deleted build.
+	if _, err := db.GetPkgID(ctx, GetPkgIDParams{Category: "lang/", Dir: "go"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("lang/go still exists after delete (err = %v)", err)
+	}
+	if _, err := db.GetFetchRetry(ctx, del); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("retry state still exists after delete (err = %v)", err)
+	}
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].BuildID != keep {
+		t.Errorf("got results %+v, want a single one for build %d", results, keep)
+	}
+
+	if err := db.DeleteBuild(ctx, del); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second DeleteBuild(%d): got err %v, want ErrNoRows", del, err)
+	}
+}
+
+func TestResultReasons(t *testing.T) {
+	forEachDB(t, testResultReasons)
+}
+
+func testResultReasons(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	r := pkgResult("devel/", "libtool", "libtool-2.4", 1)
+	r.FailReason = `"libtool-2.4 is marked as broken:" Does\ not\ build.`
+	r.SkipReason = `"libtool-2.4 is not available for Linux"`
+	addBuild(t, db, "Linux", r)
+
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if got := results[0]; got.FailReason != r.FailReason || got.SkipReason != r.SkipReason {
+		t.Errorf("GetAllPkgResults: got reasons %q, %q; want %q, %q", got.FailReason, got.SkipReason, r.FailReason, r.SkipReason)
+	}
+
+	single, err := db.GetSingleResult(ctx, results[0].ResultID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.FailReason != r.FailReason || single.SkipReason != r.SkipReason {
+		t.Errorf("GetSingleResult: got reasons %q, %q; want %q, %q", single.FailReason, single.SkipReason, r.FailReason, r.SkipReason)
+	}
+}
+
+func TestResultMetadata(t *testing.T) {
+	forEachDB(t, testResultMetadata)
+}
+
+func testResultMetadata(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	r := pkgResult("devel/", "libtool", "libtool-2.4", 0)
+	r.Maintainer = "pkgsrc-users@NetBSD.org"
+	r.Categories = "devel"
+	r.PkgDepth = 2
+	r.MultiVersion = "PYTHON_VERSION_REQD=27"
+	r.Restricted = "Redistribution not permitted"
+	r.NoBinOnFtp = "Redistribution not permitted"
+	r.BootstrapPkg = true
+	addBuild(t, db, "Linux", r)
+
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	got, err := db.GetSingleResult(ctx, results[0].ResultID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := GetSingleResultRow{
+		Maintainer:   r.Maintainer,
+		Categories:   r.Categories,
+		PkgDepth:     r.PkgDepth,
+		MultiVersion: r.MultiVersion,
+		Restricted:   r.Restricted,
+		NoBinOnFtp:   r.NoBinOnFtp,
+		BootstrapPkg: r.BootstrapPkg,
+	}
+	if got.Maintainer != want.Maintainer || got.Categories != want.Categories ||
+		got.PkgDepth != want.PkgDepth || got.MultiVersion != want.MultiVersion ||
+		got.Restricted != want.Restricted || got.NoBinOnFtp != want.NoBinOnFtp ||
+		got.BootstrapPkg != want.BootstrapPkg {
+		t.Errorf("GetSingleResult: got %+v, want metadata of %+v", got, want)
+	}
+}
+
+// buildIDs returns the IDs of the given builds.
+func buildIDs(builds []Build) []int64 {
+	var ids []int64
+	for _, b := range builds {
+		ids = append(ids, b.BuildID)
+	}
+	return ids
+}
+
+func TestExpiry(t *testing.T) {
+	forEachDB(t, testExpiry)
+}
+
+func testExpiry(t *testing.T, db *DB) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	day := 24 * time.Hour
+
+	put := func(platform string, age time.Duration) int64 {
+		t.Helper()
+		id, err := db.PutBuild(ctx, PutBuildParams{
+			Platform:  platform,
+			BuildTs:   now.Add(-age),
+			Branch:    "HEAD",
+			Compiler:  "gcc",
+			BuildUser: "builder",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutResults(ctx, []PkgResult{pkgResult("devel/", "libtool", "libtool-2.4", 0)}, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	oldest := put("NetBSD", 3*day)
+	old := put("NetBSD", 2*day)
+	put("NetBSD", day)
+	linux := put("Linux", 3*day)
+
+	for _, tc := range []struct {
+		keep int64
+		want []int64
+	}{
+		{3, nil},
+		{2, []int64{oldest}},
+		{1, []int64{oldest, old}},
+	} {
+		builds, err := db.GetExpiredBuilds(ctx, tc.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buildIDs(builds); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("GetExpiredBuilds(%d) = %v, want %v", tc.keep, got, tc.want)
+		}
+	}
+
+	cutoff := now.Add(-36 * time.Hour)
+	builds, err := db.GetBuildsWithResultsBefore(ctx, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buildIDs(builds), []int64{oldest, linux, old}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetBuildsWithResultsBefore() = %v, want %v", got, want)
+	}
+
+	if err := db.DeleteResults(ctx, old); err != nil {
+		t.Fatalf("DeleteResults(%d): %v", old, err)
+	}
+	if _, err := db.GetBuild(ctx, old); err != nil {
+		t.Errorf("GetBuild(%d) after DeleteResults: %v", old, err)
+	}
+	builds, err = db.GetBuildsWithResultsBefore(ctx, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buildIDs(builds), []int64{oldest, linux}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetBuildsWithResultsBefore() after DeleteResults = %v, want %v", got, want)
+	}
+}
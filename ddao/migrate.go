@@ -0,0 +1,205 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// The schema migrations, named NNNN_description.sql, where NNNN is the
+// version. They are applied in order, and each one only once. A migration
+// must never be changed once it has been released; add a new one instead.
+//
+// There is one directory per SQL dialect. Both must contain the same
+// migrations, so that the schema versions match.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+// migrationDir returns the directory containing the migrations for db.
+func migrationDir(db *sql.DB) string {
+	if isPostgres(db) {
+		return "migrations/postgres"
+	}
+	return "migrations/sqlite"
+}
+
+// ErrSchemaTooNew is returned if the database schema is newer than the
+// latest migration known to this binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of BulkTracker")
+
+// ErrSchemaTooOld is returned by CheckSchema if there are migrations that
+// have not been applied yet.
+var ErrSchemaTooOld = errors.New("database schema is out of date")
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	applied_ts timestamp NOT NULL
+)`
+
+// A migration is a change to the database schema.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations returns the embedded migrations in dir, sorted by version.
+func migrations(dir string) ([]migration, error) {
+	entries, err := migrationFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ms []migration
+	for _, e := range entries {
+		name := e.Name()
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q: name must start with the version", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q: %w", name, err)
+		}
+		b, err := migrationFS.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version, name, string(b)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	for i, m := range ms {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %q: want version %d", m.name, i+1)
+		}
+	}
+	return ms, nil
+}
+
+// schemaMigrationsExists returns true if db has the schema_migrations
+// table.
+func schemaMigrationsExists(ctx context.Context, db *sql.DB) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	if isPostgres(db) {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, query).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SchemaVersion returns the schema version of db, which is zero for a
+// database that has never been migrated, and the latest version known to
+// this binary. It does not change db, so it works with a read-only role.
+func SchemaVersion(ctx context.Context, db *sql.DB) (current, latest int, err error) {
+	ms, err := migrations(migrationDir(db))
+	if err != nil {
+		return 0, 0, err
+	}
+	exists, err := schemaMigrationsExists(ctx, db)
+	if err != nil || !exists {
+		return 0, len(ms), err
+	}
+	row := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err := row.Scan(&current); err != nil {
+		return 0, 0, err
+	}
+	return current, len(ms), nil
+}
+
+// CheckSchema returns ErrSchemaTooOld or ErrSchemaTooNew if the schema
+// version of db does not match this binary. Like Migrate, it warns if the
+// package search cannot use the full-text index.
+func CheckSchema(ctx context.Context, db *sql.DB) error {
+	current, latest, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current < latest:
+		return fmt.Errorf("%w: version %d, want %d", ErrSchemaTooOld, current, latest)
+	case current > latest:
+		return fmt.Errorf("%w: version %d, want %d", ErrSchemaTooNew, current, latest)
+	}
+	warnNoFTS5(ctx, db)
+	return nil
+}
+
+// Migrate applies all pending migrations to db, each in its own
+// transaction, and brings the package search index up to date. It returns
+// ErrSchemaTooNew without changing anything if db has a newer schema than
+// this binary.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return err
+	}
+	current, latest, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("%w: version %d, want %d", ErrSchemaTooNew, current, latest)
+	}
+	ms, err := migrations(migrationDir(db))
+	if err != nil {
+		return err
+	}
+	for _, m := range ms[current:] {
+		if err := applyMigration(ctx, db, m); err != nil {
+			return fmt.Errorf("migration %q: %w", m.name, err)
+		}
+		log.Infof(ctx, "Applied schema migration %q", m.name)
+	}
+	warnNoFTS5(ctx, db)
+	if err := syncSearch(ctx, db); err != nil {
+		return fmt.Errorf("search index: %w", err)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, applied_ts) VALUES (?, ?)", m.version, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
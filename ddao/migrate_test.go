@@ -0,0 +1,170 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rerunBackfill runs the INSERT statement of the given migration again,
+// which fills a table that the migration added from the existing data.
+func rerunBackfill(t *testing.T, db *DB, version int) {
+	t.Helper()
+	ms, err := migrations(migrationDir(db.db.(*sql.DB)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ms[version-1]
+	i := strings.Index(m.sql, "INSERT INTO")
+	if i == -1 {
+		t.Fatalf("%s has no INSERT statement", m.name)
+	}
+	if _, err := db.db.ExecContext(context.Background(), m.sql[i:]); err != nil {
+		t.Fatalf("%s: %v", m.name, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	forEachDriver(t, testMigrate)
+}
+
+func testMigrate(t *testing.T, db *sql.DB) {
+	ctx := context.Background()
+
+	if err := CheckSchema(ctx, db); !errors.Is(err, ErrSchemaTooOld) {
+		t.Errorf("CheckSchema on empty database: got err %v, want ErrSchemaTooOld", err)
+	}
+	// Checking the schema does not write to the database.
+	if exists, err := schemaMigrationsExists(ctx, db); err != nil || exists {
+		t.Errorf("after CheckSchema: schemaMigrationsExists() = %v, %v; want false", exists, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Migrate(ctx, db); err != nil {
+			t.Fatalf("Migrate #%d: %v", i+1, err)
+		}
+	}
+	current, latest, err := SchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != latest || latest == 0 {
+		t.Errorf("SchemaVersion() = %d, %d; want equal and non-zero", current, latest)
+	}
+	if err := CheckSchema(ctx, db); err != nil {
+		t.Errorf("CheckSchema: %v", err)
+	}
+}
+
+func TestCheckSchemaReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "bulktracker.db")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := CheckSchema(ctx, db); !errors.Is(err, ErrSchemaTooOld) {
+		t.Errorf("CheckSchema on read-only database: got err %v, want ErrSchemaTooOld", err)
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	db := openSQLite(t)
+	ctx := context.Background()
+
+	// A database created from the schema before migrations existed.
+	ms, err := migrations("migrations/sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ms[0].sql); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO results (pkg_name, build_status, failed_deps, breaks)
+VALUES ('libtool-2.4', 0, '', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	var maintainer string
+	if err := db.QueryRow("SELECT maintainer FROM results WHERE pkg_name = 'libtool-2.4'").Scan(&maintainer); err != nil {
+		t.Fatalf("reading migrated result: %v", err)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	forEachDriver(t, testMigrateTooNew)
+}
+
+func testMigrateTooNew(t *testing.T, db *sql.DB) {
+	ctx := context.Background()
+
+	if err := Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	_, latest, err := SchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_migrations (version, applied_ts) VALUES (?, CURRENT_TIMESTAMP)", latest+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("Migrate: got err %v, want ErrSchemaTooNew", err)
+	}
+	if err := CheckSchema(ctx, db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("CheckSchema: got err %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestMigrationsMatch(t *testing.T) {
+	sqlite, err := migrations("migrations/sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := migrations("migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("got %d SQLite and %d PostgreSQL migrations, want the same number", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].name != postgres[i].name {
+			t.Errorf("migration %d: got %q for SQLite and %q for PostgreSQL", i+1, sqlite[i].name, postgres[i].name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+CREATE TABLE builds (
+    build_id BIGSERIAL PRIMARY KEY,
+    platform text NOT NULL,
+    build_ts timestamp with time zone NOT NULL,
+    branch text NOT NULL,
+    compiler text NOT NULL,
+    build_user text NOT NULL,
+    report_url text NOT NULL,
+
+    num_ok BIGINT NOT NULL,
+    num_prefailed BIGINT NOT NULL,
+    num_failed BIGINT NOT NULL,
+    num_indirect_failed BIGINT NOT NULL,
+    num_indirect_prefailed BIGINT NOT NULL
+);
+
+CREATE TABLE pkgs (
+    pkg_id BIGSERIAL PRIMARY KEY,
+    category text NOT NULL,
+    dir text NOT NULL,
+    UNIQUE (category, dir)
+);
+
+CREATE VIEW pkgpaths (
+    pkgpath
+) AS SELECT (category || dir) AS pkgpath FROM pkgs;
+
+-- Result IDs are usually assigned by the ResultWriter.
+CREATE TABLE results (
+    result_id BIGSERIAL PRIMARY KEY,
+    build_id BIGINT REFERENCES builds,
+    pkg_id BIGINT REFERENCES pkgs,
+    pkg_name text NOT NULL,
+    build_status BIGINT NOT NULL,
+    failed_deps text NOT NULL,
+    breaks BIGINT NOT NULL
+);
+
+CREATE INDEX results_build_id ON results (build_id);
+CREATE INDEX results_pkg_id ON results (pkg_id);
@@ -0,0 +1,27 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+ALTER TABLE results ADD COLUMN maintainer text NOT NULL DEFAULT '';
+ALTER TABLE results ADD COLUMN categories text NOT NULL DEFAULT '';
+ALTER TABLE results ADD COLUMN pkg_depth BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE results ADD COLUMN multi_version text NOT NULL DEFAULT '';
+ALTER TABLE results ADD COLUMN restricted text NOT NULL DEFAULT '';
+ALTER TABLE results ADD COLUMN no_bin_on_ftp text NOT NULL DEFAULT '';
+ALTER TABLE results ADD COLUMN bootstrap_pkg BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,46 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- failed_dependencies links an indirect-failed result to the failed results
+-- in the same build that are its root cause.
+CREATE TABLE failed_dependencies (
+    build_id BIGINT NOT NULL REFERENCES builds,
+    result_id BIGINT NOT NULL REFERENCES results,
+    failed_result_id BIGINT NOT NULL REFERENCES results,
+    PRIMARY KEY (build_id, result_id, failed_result_id)
+);
+
+CREATE INDEX failed_dependencies_failed_result_id
+ON failed_dependencies (failed_result_id);
+
+-- Existing results only have the names of the root causes in failed_deps.
+-- Each name is matched as a whole word, with the LIKE wildcards in package
+-- names escaped.
+INSERT INTO failed_dependencies (build_id, result_id, failed_result_id)
+SELECT DISTINCT r.build_id, r.result_id, f.result_id
+FROM results r
+JOIN results f ON (
+	f.build_id = r.build_id AND
+	f.result_id != r.result_id AND
+	' ' || r.failed_deps || ' ' LIKE
+		'% ' || REPLACE(REPLACE(REPLACE(f.pkg_name, '\', '\\'), '%', '\%'), '_', '\_') || ' %'
+		ESCAPE '\'
+)
+WHERE r.failed_deps != '';
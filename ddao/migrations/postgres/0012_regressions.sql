@@ -0,0 +1,51 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- regressions records the packages that failed in a build but not in the
+-- previous build from the same builder, that is with the same platform,
+-- branch, compiler and user. prev_build_id is kept even when that build
+-- is deleted later.
+CREATE TABLE regressions (
+    build_id BIGINT NOT NULL REFERENCES builds,
+    result_id BIGINT NOT NULL REFERENCES results,
+    prev_build_id BIGINT NOT NULL,
+    prev_build_status BIGINT NOT NULL,
+    PRIMARY KEY (build_id, result_id)
+);
+
+INSERT INTO regressions
+(build_id, result_id, prev_build_id, prev_build_status)
+SELECT r.build_id, r.result_id, o.build_id, o.build_status
+FROM (
+	SELECT
+		build_id,
+		LAG(build_id) OVER (
+			PARTITION BY platform, branch, compiler, build_user
+			ORDER BY build_ts, build_id
+		) AS prev_build_id
+	FROM builds
+) b
+JOIN results r ON (r.build_id = b.build_id)
+JOIN results o ON (
+	o.build_id = b.prev_build_id AND
+	o.pkg_id = r.pkg_id AND
+	o.multi_version = r.multi_version
+)
+WHERE r.build_status IN (2, 3) AND o.build_status NOT IN (2, 3);
@@ -18,6 +18,9 @@
  * of said person's immediate fault when using the work as intended.
  */
 
+-- The schema from before migrations were introduced. The statements are
+-- idempotent, so that such databases can be upgraded.
+
 CREATE TABLE IF NOT EXISTS builds (
     build_id INTEGER PRIMARY KEY ASC,
     platform text NOT NULL,
@@ -31,7 +34,7 @@ CREATE TABLE IF NOT EXISTS builds (
     num_prefailed INTEGER NOT NULL,
     num_failed INTEGER NOT NULL,
     num_indirect_failed INTEGER NOT NULL,
-    num_indirect_prefailed INTEGER NOT NULL    
+    num_indirect_prefailed INTEGER NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS pkgs (
@@ -53,4 +56,4 @@ CREATE TABLE IF NOT EXISTS results (
     build_status INTEGER NOT NULL,
     failed_deps text NOT NULL,
     breaks INTEGER NOT NULL
-);
\ No newline at end of file
+);
@@ -0,0 +1,31 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+CREATE TABLE IF NOT EXISTS ingest_jobs (
+    job_id INTEGER PRIMARY KEY ASC,
+    build_id INTEGER NOT NULL REFERENCES builds,
+    url text NOT NULL,
+    phase INTEGER NOT NULL,
+    pkgs_written INTEGER NOT NULL,
+    pkgs_total INTEGER NOT NULL,
+    last_error text NOT NULL,
+    start_ts timestamp NOT NULL,
+    update_ts timestamp NOT NULL
+);
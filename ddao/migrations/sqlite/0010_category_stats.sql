@@ -0,0 +1,48 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- category_stats holds the number of packages with each build status per
+-- category of a build. It is written together with the results.
+CREATE TABLE IF NOT EXISTS category_stats (
+    build_id INTEGER NOT NULL REFERENCES builds,
+    category text NOT NULL,
+    num_ok INTEGER NOT NULL,
+    num_prefailed INTEGER NOT NULL,
+    num_failed INTEGER NOT NULL,
+    num_indirect_failed INTEGER NOT NULL,
+    num_indirect_prefailed INTEGER NOT NULL,
+    PRIMARY KEY (build_id, category)
+);
+
+INSERT INTO category_stats
+(build_id, category, num_ok, num_prefailed, num_failed, num_indirect_failed,
+	num_indirect_prefailed)
+SELECT
+	r.build_id,
+	p.category,
+	SUM(CASE WHEN r.build_status = 0 THEN 1 ELSE 0 END),
+	SUM(CASE WHEN r.build_status = 1 THEN 1 ELSE 0 END),
+	SUM(CASE WHEN r.build_status = 2 THEN 1 ELSE 0 END),
+	SUM(CASE WHEN r.build_status = 3 THEN 1 ELSE 0 END),
+	SUM(CASE WHEN r.build_status = 4 THEN 1 ELSE 0 END)
+FROM results r
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE r.build_id IS NOT NULL
+GROUP BY r.build_id, p.category;
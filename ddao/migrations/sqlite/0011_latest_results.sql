@@ -0,0 +1,68 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- latest_results points to the most recent result of each package for each
+-- builder, that is for each platform, branch, compiler and user. It is
+-- kept up to date whenever results are written or deleted.
+CREATE TABLE IF NOT EXISTS latest_results (
+    pkg_id INTEGER NOT NULL REFERENCES pkgs,
+    platform text NOT NULL,
+    branch text NOT NULL,
+    compiler text NOT NULL,
+    build_user text NOT NULL,
+    build_id INTEGER NOT NULL REFERENCES builds,
+    result_id INTEGER NOT NULL REFERENCES results,
+    build_ts timestamp NOT NULL,
+    PRIMARY KEY (pkg_id, platform, branch, compiler, build_user)
+);
+
+CREATE INDEX IF NOT EXISTS latest_results_build_id
+ON latest_results (build_id);
+
+INSERT INTO latest_results
+(pkg_id, platform, branch, compiler, build_user, build_id, result_id, build_ts)
+SELECT
+	ranked.pkg_id,
+	ranked.platform,
+	ranked.branch,
+	ranked.compiler,
+	ranked.build_user,
+	ranked.build_id,
+	ranked.result_id,
+	ranked.build_ts
+FROM (
+	SELECT
+		r.pkg_id,
+		b.platform,
+		b.branch,
+		b.compiler,
+		b.build_user,
+		b.build_id,
+		r.result_id,
+		b.build_ts,
+		ROW_NUMBER() OVER (
+			PARTITION BY r.pkg_id, b.platform, b.branch, b.compiler, b.build_user
+			ORDER BY b.build_ts DESC, b.build_id DESC, r.result_id DESC
+		) AS n
+	FROM results r
+	JOIN builds b ON (r.build_id = b.build_id)
+	WHERE r.pkg_id IS NOT NULL
+) ranked
+WHERE ranked.n = 1;
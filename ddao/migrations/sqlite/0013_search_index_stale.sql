@@ -0,0 +1,28 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- search_index_stale has a row if search_docs has been changed without
+-- updating the pkg_search full-text index, which happens in binaries built
+-- without FTS5. Migrate then rebuilds the index.
+CREATE TABLE IF NOT EXISTS search_index_stale (
+    id INTEGER PRIMARY KEY CHECK (id = 1)
+);
+
+INSERT INTO search_index_stale (id) VALUES (1);
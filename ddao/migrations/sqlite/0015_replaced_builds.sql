@@ -0,0 +1,28 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+-- replaced_builds lists the duplicate builds that a build replaces. They
+-- are deleted once the report of the new build has been ingested, which
+-- may only happen on a later retry.
+CREATE TABLE IF NOT EXISTS replaced_builds (
+    build_id INTEGER NOT NULL REFERENCES builds,
+    replaced_build_id INTEGER NOT NULL REFERENCES builds,
+    PRIMARY KEY (build_id, replaced_build_id)
+);
@@ -24,6 +24,61 @@ type Build struct {
 	NumIndirectPrefailed int64
 }
 
+type CategoryStat struct {
+	BuildID              int64
+	Category             string
+	NumOk                int64
+	NumPrefailed         int64
+	NumFailed            int64
+	NumIndirectFailed    int64
+	NumIndirectPrefailed int64
+}
+
+type Dependency struct {
+	BuildID     int64
+	ResultID    int64
+	DepResultID int64
+}
+
+type FailedDependency struct {
+	BuildID        int64
+	ResultID       int64
+	FailedResultID int64
+}
+
+type FetchRetry struct {
+	BuildID   int64
+	Url       string
+	Attempts  int64
+	NextTs    time.Time
+	LastError string
+	GaveUp    bool
+}
+
+type IngestJob struct {
+	JobID       int64
+	BuildID     int64
+	Url         string
+	Phase       int64
+	PkgsWritten int64
+	PkgsTotal   int64
+	LastError   string
+	Message     string
+	StartTs     time.Time
+	UpdateTs    time.Time
+}
+
+type LatestResult struct {
+	PkgID     int64
+	Platform  string
+	Branch    string
+	Compiler  string
+	BuildUser string
+	BuildID   int64
+	ResultID  int64
+	BuildTs   time.Time
+}
+
 type Pkg struct {
 	PkgID    int64
 	Category string
@@ -34,12 +89,45 @@ type Pkgpath struct {
 	Pkgpath string
 }
 
+type Regression struct {
+	BuildID         int64
+	ResultID        int64
+	PrevBuildID     int64
+	PrevBuildStatus int64
+}
+
+type ReplacedBuild struct {
+	BuildID         int64
+	ReplacedBuildID int64
+}
+
 type Result struct {
-	ResultID    int64
-	BuildID     sql.NullInt64
-	PkgID       sql.NullInt64
-	PkgName     string
-	BuildStatus int64
-	FailedDeps  string
-	Breaks      int64
+	ResultID     int64
+	BuildID      sql.NullInt64
+	PkgID        sql.NullInt64
+	PkgName      string
+	BuildStatus  int64
+	FailedDeps   string
+	Breaks       int64
+	FailReason   string
+	SkipReason   string
+	Maintainer   string
+	Categories   string
+	PkgDepth     int64
+	MultiVersion string
+	Restricted   string
+	NoBinOnFtp   string
+	BootstrapPkg bool
+}
+
+type SearchDoc struct {
+	PkgID      int64
+	Pkgpath    string
+	Pkgbase    string
+	Maintainer string
+	FailReason string
+}
+
+type SearchIndexStale struct {
+	ID int64
 }
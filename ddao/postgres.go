@@ -0,0 +1,179 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	// Open supports SQLite without the caller importing the driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The queries are written in the common subset of the SQLite and PostgreSQL
+// dialects, except for the "?" placeholders. The PostgreSQL connections
+// returned by Open rewrite these into the "$1" form before passing a query
+// to the driver, so that the code generated by sqlc works unchanged.
+
+// Open opens the database with the given driver, which is either "sqlite3"
+// or "postgres". For SQLite, dataSource is the path to the database file;
+// for PostgreSQL, it is a connection string as understood by lib/pq.
+func Open(driverName, dataSource string) (*sql.DB, error) {
+	switch driverName {
+	case "sqlite3":
+		return sql.Open("sqlite3", dataSource+"?_fk=true")
+	case "postgres":
+		c, err := pq.NewConnector(dataSource)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(postgresConnector{c}), nil
+	}
+	return nil, fmt.Errorf("unsupported database driver %q", driverName)
+}
+
+// isPostgres reports whether db has been opened by Open with the "postgres"
+// driver.
+func isPostgres(db *sql.DB) bool {
+	_, ok := db.Driver().(postgresDriver)
+	return ok
+}
+
+// rebind replaces the "?" and "?NNN" placeholders in query with "$1", "$2"
+// and so on. String literals, quoted identifiers and comments are left
+// alone.
+func rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch c {
+		case '\'', '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end == -1 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+			continue
+		case '-':
+			if !strings.HasPrefix(query[i:], "--") {
+				break
+			}
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				b.WriteString(query[i:])
+				return b.String()
+			}
+			b.WriteString(query[i : i+end+1])
+			i += end
+			continue
+		case '?':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			b.WriteByte('$')
+			if j > i+1 {
+				// Numbered parameter.
+				b.WriteString(query[i+1 : j])
+			} else {
+				n++
+				fmt.Fprint(&b, n)
+			}
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// postgresDriver wraps the lib/pq driver to rewrite queries with rebind.
+type postgresDriver struct{}
+
+func (postgresDriver) Open(name string) (driver.Conn, error) {
+	c, err := pq.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return postgresConn{c}, nil
+}
+
+type postgresConnector struct {
+	*pq.Connector
+}
+
+func (c postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return postgresConn{conn}, nil
+}
+
+func (postgresConnector) Driver() driver.Driver {
+	return postgresDriver{}
+}
+
+// postgresConn is a lib/pq connection that rewrites the placeholders of all
+// queries. The optional interfaces are forwarded to the wrapped connection.
+type postgresConn struct {
+	driver.Conn
+}
+
+func (c postgresConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query))
+}
+
+func (c postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, rebind(query))
+}
+
+func (c postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, rebind(query), args)
+}
+
+func (c postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, rebind(query), args)
+}
+
+func (c postgresConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c postgresConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c postgresConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c postgresConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
@@ -0,0 +1,54 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	testCases := []struct {
+		query, want string
+	}{
+		{
+			"SELECT * FROM builds WHERE build_id = ?",
+			"SELECT * FROM builds WHERE build_id = $1",
+		}, {
+			"INSERT INTO pkgs (category, dir) VALUES (?, ?), (?, ?)",
+			"INSERT INTO pkgs (category, dir) VALUES ($1, $2), ($3, $4)",
+		}, {
+			"SELECT pkgpath FROM pkgpaths WHERE LOWER(pkgpath) LIKE LOWER(?1)",
+			"SELECT pkgpath FROM pkgpaths WHERE LOWER(pkgpath) LIKE LOWER($1)",
+		}, {
+			"-- name: GetBuild? :one\nSELECT '?', \"a?\" FROM builds WHERE build_id = ?",
+			"-- name: GetBuild? :one\nSELECT '?', \"a?\" FROM builds WHERE build_id = $1",
+		}, {
+			"SELECT 'it''s?' WHERE a = ? -- why?",
+			"SELECT 'it''s?' WHERE a = $1 -- why?",
+		}, {
+			"SELECT 1 - ?",
+			"SELECT 1 - $1",
+		},
+	}
+	for _, tc := range testCases {
+		if got := rebind(tc.query); got != tc.want {
+			t.Errorf("rebind(%q) = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
@@ -11,6 +11,29 @@ import (
 	"time"
 )
 
+const countResultsForBuild = `-- name: CountResultsForBuild :one
+SELECT COUNT(*) FROM results
+WHERE build_id = ?
+`
+
+func (q *Queries) CountResultsForBuild(ctx context.Context, buildID sql.NullInt64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countResultsForBuild, buildID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countSearchDocs = `-- name: CountSearchDocs :one
+SELECT COUNT(*) FROM search_docs
+`
+
+func (q *Queries) CountSearchDocs(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countSearchDocs)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const deleteAllForBuild = `-- name: DeleteAllForBuild :exec
 DELETE from results
 WHERE build_id = ?
@@ -21,10 +44,179 @@ func (q *Queries) DeleteAllForBuild(ctx context.Context, buildID sql.NullInt64)
 	return err
 }
 
+const deleteBuild = `-- name: DeleteBuild :execrows
+DELETE FROM builds
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteBuild(ctx context.Context, buildID int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteBuild, buildID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteCategoryStatsForBuild = `-- name: DeleteCategoryStatsForBuild :exec
+DELETE FROM category_stats
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteCategoryStatsForBuild(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteCategoryStatsForBuild, buildID)
+	return err
+}
+
+const deleteDependenciesForBuild = `-- name: DeleteDependenciesForBuild :exec
+DELETE FROM dependencies
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteDependenciesForBuild(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteDependenciesForBuild, buildID)
+	return err
+}
+
+const deleteFailedDependenciesForBuild = `-- name: DeleteFailedDependenciesForBuild :exec
+DELETE FROM failed_dependencies
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteFailedDependenciesForBuild(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteFailedDependenciesForBuild, buildID)
+	return err
+}
+
+const deleteFetchRetry = `-- name: DeleteFetchRetry :exec
+DELETE FROM fetch_retries
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteFetchRetry(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteFetchRetry, buildID)
+	return err
+}
+
+const deleteIngestJobsForBuild = `-- name: DeleteIngestJobsForBuild :exec
+DELETE FROM ingest_jobs
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteIngestJobsForBuild(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteIngestJobsForBuild, buildID)
+	return err
+}
+
+const deleteLatestResultsForBuild = `-- name: DeleteLatestResultsForBuild :execrows
+DELETE FROM latest_results
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteLatestResultsForBuild(ctx context.Context, buildID int64) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteLatestResultsForBuild, buildID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteRegressionsForBuild = `-- name: DeleteRegressionsForBuild :exec
+DELETE FROM regressions
+WHERE build_id = ?
+`
+
+func (q *Queries) DeleteRegressionsForBuild(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteRegressionsForBuild, buildID)
+	return err
+}
+
+const deleteReplacedBuilds = `-- name: DeleteReplacedBuilds :exec
+
+DELETE FROM replaced_builds
+WHERE build_id = ?1 OR replaced_build_id = ?1
+`
+
+// DeleteReplacedBuilds removes the records in which the given build
+// replaces another one or is replaced itself.
+func (q *Queries) DeleteReplacedBuilds(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, deleteReplacedBuilds, buildID)
+	return err
+}
+
+const deleteUnusedPkgs = `-- name: DeleteUnusedPkgs :exec
+DELETE FROM pkgs
+WHERE pkg_id NOT IN (
+	SELECT DISTINCT pkg_id FROM results WHERE pkg_id IS NOT NULL
+)
+`
+
+func (q *Queries) DeleteUnusedPkgs(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteUnusedPkgs)
+	return err
+}
+
+const deleteUnusedSearchDocs = `-- name: DeleteUnusedSearchDocs :exec
+DELETE FROM search_docs
+WHERE pkg_id NOT IN (
+	SELECT DISTINCT pkg_id FROM results WHERE pkg_id IS NOT NULL
+)
+`
+
+func (q *Queries) DeleteUnusedSearchDocs(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteUnusedSearchDocs)
+	return err
+}
+
+const findBuilds = `-- name: FindBuilds :many
+
+SELECT build_id FROM builds
+WHERE platform = ? AND build_ts = ? AND branch = ? AND compiler = ? AND build_user = ?
+ORDER BY build_id
+`
+
+type FindBuildsParams struct {
+	Platform  string
+	BuildTs   time.Time
+	Branch    string
+	Compiler  string
+	BuildUser string
+}
+
+// FindBuilds returns the IDs of all builds with the same platform, timestamp,
+// branch, compiler and user.
+func (q *Queries) FindBuilds(ctx context.Context, arg FindBuildsParams) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, findBuilds,
+		arg.Platform,
+		arg.BuildTs,
+		arg.Branch,
+		arg.Compiler,
+		arg.BuildUser,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var build_id int64
+		if err := rows.Scan(&build_id); err != nil {
+			return nil, err
+		}
+		items = append(items, build_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getAllPkgResults = `-- name: GetAllPkgResults :many
-SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
+SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, r.fail_reason, r.skip_reason, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
 FROM results r, builds b
-WHERE r.build_id == b.build_id AND r.pkg_id == ?
+WHERE r.build_id = b.build_id AND r.pkg_id = ?
 ORDER BY b.build_ts DESC
 `
 
@@ -33,6 +225,8 @@ type GetAllPkgResultsRow struct {
 	PkgName     string
 	BuildStatus int64
 	Breaks      int64
+	FailReason  string
+	SkipReason  string
 	BuildID     int64
 	Platform    string
 	BuildTs     time.Time
@@ -55,6 +249,8 @@ func (q *Queries) GetAllPkgResults(ctx context.Context, pkgID sql.NullInt64) ([]
 			&i.PkgName,
 			&i.BuildStatus,
 			&i.Breaks,
+			&i.FailReason,
+			&i.SkipReason,
 			&i.BuildID,
 			&i.Platform,
 			&i.BuildTs,
@@ -75,6 +271,33 @@ func (q *Queries) GetAllPkgResults(ctx context.Context, pkgID sql.NullInt64) ([]
 	return items, nil
 }
 
+const getAllPkgs = `-- name: GetAllPkgs :many
+SELECT pkg_id, category, dir FROM pkgs
+`
+
+func (q *Queries) GetAllPkgs(ctx context.Context) ([]Pkg, error) {
+	rows, err := q.db.QueryContext(ctx, getAllPkgs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Pkg
+	for rows.Next() {
+		var i Pkg
+		if err := rows.Scan(&i.PkgID, &i.Category, &i.Dir); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getBuild = `-- name: GetBuild :one
 SELECT build_id, platform, build_ts, branch, compiler, build_user, report_url, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM builds
 WHERE build_id = ?
@@ -100,25 +323,46 @@ func (q *Queries) GetBuild(ctx context.Context, buildID int64) (Build, error) {
 	return i, err
 }
 
-const getCategories = `-- name: GetCategories :many
-SELECT DISTINCT category
-FROM pkgs
-ORDER BY category
+const getBuildsBetween = `-- name: GetBuildsBetween :many
+
+SELECT build_id, platform, build_ts, branch, compiler, build_user, report_url, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM builds
+WHERE build_ts >= ?1 AND build_ts < ?2
+ORDER BY build_ts, build_id
 `
 
-func (q *Queries) GetCategories(ctx context.Context) ([]string, error) {
-	rows, err := q.db.QueryContext(ctx, getCategories)
+type GetBuildsBetweenParams struct {
+	Since time.Time
+	Until time.Time
+}
+
+// GetBuildsBetween returns the builds from since up to, but not including,
+// until, oldest first.
+func (q *Queries) GetBuildsBetween(ctx context.Context, arg GetBuildsBetweenParams) ([]Build, error) {
+	rows, err := q.db.QueryContext(ctx, getBuildsBetween, arg.Since, arg.Until)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []Build
 	for rows.Next() {
-		var category string
-		if err := rows.Scan(&category); err != nil {
+		var i Build
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Platform,
+			&i.BuildTs,
+			&i.Branch,
+			&i.Compiler,
+			&i.BuildUser,
+			&i.ReportUrl,
+			&i.NumOk,
+			&i.NumPrefailed,
+			&i.NumFailed,
+			&i.NumIndirectFailed,
+			&i.NumIndirectPrefailed,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, category)
+		items = append(items, i)
 	}
 	if err := rows.Close(); err != nil {
 		return nil, err
@@ -129,22 +373,19 @@ func (q *Queries) GetCategories(ctx context.Context) ([]string, error) {
 	return items, nil
 }
 
-const getLatestBuildsPerPlatform = `-- name: GetLatestBuildsPerPlatform :many
+const getBuildsWithResultsBefore = `-- name: GetBuildsWithResultsBefore :many
 
 SELECT build_id, platform, build_ts, branch, compiler, build_user, report_url, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM builds
-WHERE build_id IN (
-	SELECT DISTINCT
-	MAX(build_id) OVER (PARTITION BY platform, branch, compiler, build_user)
-	FROM builds
-) 
-ORDER BY build_ts DESC
-LIMIT 1000
+WHERE build_ts < ?1 AND build_id IN (
+	SELECT DISTINCT build_id FROM results WHERE build_id IS NOT NULL
+)
+ORDER BY build_ts, build_id
 `
 
-// This relies on the fact that IDs are monotonically increasing, so a newer
-// build will have a higher ID. There is probably a cleaner way.
-func (q *Queries) GetLatestBuildsPerPlatform(ctx context.Context) ([]Build, error) {
-	rows, err := q.db.QueryContext(ctx, getLatestBuildsPerPlatform)
+// GetBuildsWithResultsBefore returns the builds older than cutoff that still
+// have results, oldest first.
+func (q *Queries) GetBuildsWithResultsBefore(ctx context.Context, cutoff time.Time) ([]Build, error) {
+	rows, err := q.db.QueryContext(ctx, getBuildsWithResultsBefore, cutoff)
 	if err != nil {
 		return nil, err
 	}
@@ -179,67 +420,25 @@ func (q *Queries) GetLatestBuildsPerPlatform(ctx context.Context) ([]Build, erro
 	return items, nil
 }
 
-const getPkgID = `-- name: GetPkgID :one
-SELECT pkg_id FROM pkgs
-WHERE category == ? and dir == ?
-`
-
-type GetPkgIDParams struct {
-	Category string
-	Dir      string
-}
-
-func (q *Queries) GetPkgID(ctx context.Context, arg GetPkgIDParams) (int64, error) {
-	row := q.db.QueryRowContext(ctx, getPkgID, arg.Category, arg.Dir)
-	var pkg_id int64
-	err := row.Scan(&pkg_id)
-	return pkg_id, err
-}
-
-const getPkgsBreakingMostOthers = `-- name: GetPkgsBreakingMostOthers :many
-SELECT
-	r.result_id,
-	(p.category || p.dir) AS pkg_path,
-	r.pkg_name,
-	r.build_status,
-	r.failed_deps,
-	r.breaks
-FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE r.build_id == ? AND r.build_status > 0
-ORDER BY r.breaks DESC
-LIMIT 100
+const getCategories = `-- name: GetCategories :many
+SELECT DISTINCT category
+FROM pkgs
+ORDER BY category
 `
 
-type GetPkgsBreakingMostOthersRow struct {
-	ResultID    int64
-	PkgPath     interface{}
-	PkgName     string
-	BuildStatus int64
-	FailedDeps  string
-	Breaks      int64
-}
-
-func (q *Queries) GetPkgsBreakingMostOthers(ctx context.Context, buildID sql.NullInt64) ([]GetPkgsBreakingMostOthersRow, error) {
-	rows, err := q.db.QueryContext(ctx, getPkgsBreakingMostOthers, buildID)
+func (q *Queries) GetCategories(ctx context.Context) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, getCategories)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []GetPkgsBreakingMostOthersRow
+	var items []string
 	for rows.Next() {
-		var i GetPkgsBreakingMostOthersRow
-		if err := rows.Scan(
-			&i.ResultID,
-			&i.PkgPath,
-			&i.PkgName,
-			&i.BuildStatus,
-			&i.FailedDeps,
-			&i.Breaks,
-		); err != nil {
+		var category string
+		if err := rows.Scan(&category); err != nil {
 			return nil, err
 		}
-		items = append(items, i)
+		items = append(items, category)
 	}
 	if err := rows.Close(); err != nil {
 		return nil, err
@@ -250,26 +449,33 @@ func (q *Queries) GetPkgsBreakingMostOthers(ctx context.Context, buildID sql.Nul
 	return items, nil
 }
 
-const getPkgsInCategory = `-- name: GetPkgsInCategory :many
-SELECT DISTINCT dir
-FROM pkgs
-WHERE category = ?
-ORDER BY dir
+const getCategoryStats = `-- name: GetCategoryStats :many
+SELECT build_id, category, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM category_stats
+WHERE build_id = ?
+ORDER BY category
 `
 
-func (q *Queries) GetPkgsInCategory(ctx context.Context, category string) ([]string, error) {
-	rows, err := q.db.QueryContext(ctx, getPkgsInCategory, category)
+func (q *Queries) GetCategoryStats(ctx context.Context, buildID int64) ([]CategoryStat, error) {
+	rows, err := q.db.QueryContext(ctx, getCategoryStats, buildID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []CategoryStat
 	for rows.Next() {
-		var dir string
-		if err := rows.Scan(&dir); err != nil {
+		var i CategoryStat
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Category,
+			&i.NumOk,
+			&i.NumPrefailed,
+			&i.NumFailed,
+			&i.NumIndirectFailed,
+			&i.NumIndirectPrefailed,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, dir)
+		items = append(items, i)
 	}
 	if err := rows.Close(); err != nil {
 		return nil, err
@@ -280,29 +486,1015 @@ func (q *Queries) GetPkgsInCategory(ctx context.Context, category string) ([]str
 	return items, nil
 }
 
-const getResultsInCategory = `-- name: GetResultsInCategory :many
-SELECT r.result_id, r.build_id, r.pkg_id, r.pkg_name, r.build_status, r.failed_deps, r.breaks, p.pkg_id, p.category, p.dir
+const getDependencies = `-- name: GetDependencies :many
+
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	dr.result_id AS dep_result_id,
+	(dp.category || dp.dir) AS dep_pkg_path,
+	dr.pkg_name AS dep_pkg_name,
+	dr.build_status AS dep_build_status
 FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE p.category == ? AND r.build_id == ?
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+JOIN dependencies d ON (d.result_id = r.result_id)
+JOIN results dr ON (d.dep_result_id = dr.result_id)
+JOIN pkgs dp ON (dr.pkg_id = dp.pkg_id)
+WHERE r.build_id = ? AND p.category = ? AND p.dir = ?
+ORDER BY r.pkg_name, dep_pkg_path
 `
 
-type GetResultsInCategoryParams struct {
-	Category string
+type GetDependenciesParams struct {
 	BuildID  sql.NullInt64
+	Category string
+	Dir      string
 }
 
-type GetResultsInCategoryRow struct {
-	ResultID    int64
-	BuildID     sql.NullInt64
-	PkgID       sql.NullInt64
+type GetDependenciesRow struct {
+	ResultID       int64
+	PkgPath        interface{}
+	PkgName        string
+	BuildStatus    int64
+	DepResultID    int64
+	DepPkgPath     interface{}
+	DepPkgName     string
+	DepBuildStatus int64
+}
+
+// GetDependencies returns the dependencies of the package with the given
+// pkgpath in a build.
+func (q *Queries) GetDependencies(ctx context.Context, arg GetDependenciesParams) ([]GetDependenciesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getDependencies, arg.BuildID, arg.Category, arg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetDependenciesRow
+	for rows.Next() {
+		var i GetDependenciesRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.PkgPath,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.DepResultID,
+			&i.DepPkgPath,
+			&i.DepPkgName,
+			&i.DepBuildStatus,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDependenciesForBuild = `-- name: GetDependenciesForBuild :many
+SELECT build_id, result_id, dep_result_id FROM dependencies
+WHERE build_id = ?
+`
+
+func (q *Queries) GetDependenciesForBuild(ctx context.Context, buildID int64) ([]Dependency, error) {
+	rows, err := q.db.QueryContext(ctx, getDependenciesForBuild, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Dependency
+	for rows.Next() {
+		var i Dependency
+		if err := rows.Scan(&i.BuildID, &i.ResultID, &i.DepResultID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getExpiredBuilds = `-- name: GetExpiredBuilds :many
+
+SELECT build_id, platform, build_ts, branch, compiler, build_user, report_url, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM builds
+WHERE build_id IN (
+	SELECT ranked.build_id FROM (
+		SELECT
+			build_id,
+			ROW_NUMBER() OVER (
+				PARTITION BY platform, branch, compiler, build_user
+				ORDER BY build_ts DESC, build_id DESC
+			) AS n
+		FROM builds
+	) ranked
+	WHERE ranked.n > ?1
+)
+ORDER BY build_ts, build_id
+`
+
+// GetExpiredBuilds returns the builds that are older than the latest keep
+// builds with the same platform, branch, compiler and user, oldest first.
+func (q *Queries) GetExpiredBuilds(ctx context.Context, keep int64) ([]Build, error) {
+	rows, err := q.db.QueryContext(ctx, getExpiredBuilds, keep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Build
+	for rows.Next() {
+		var i Build
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Platform,
+			&i.BuildTs,
+			&i.Branch,
+			&i.Compiler,
+			&i.BuildUser,
+			&i.ReportUrl,
+			&i.NumOk,
+			&i.NumPrefailed,
+			&i.NumFailed,
+			&i.NumIndirectFailed,
+			&i.NumIndirectPrefailed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getFailedDependencies = `-- name: GetFailedDependencies :many
+
+SELECT
+	r.result_id,
+	r.pkg_name,
+	r.build_status,
+	r.failed_deps,
+	r.breaks,
+	p.category,
+	p.dir
+FROM failed_dependencies f
+JOIN results r ON (f.failed_result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.result_id = ?
+ORDER BY r.pkg_name
+`
+
+type GetFailedDependenciesRow struct {
+	ResultID    int64
+	PkgName     string
+	BuildStatus int64
+	FailedDeps  string
+	Breaks      int64
+	Category    string
+	Dir         string
+}
+
+// GetFailedDependencies returns the failed packages that broke the given
+// result ID.
+func (q *Queries) GetFailedDependencies(ctx context.Context, resultID int64) ([]GetFailedDependenciesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getFailedDependencies, resultID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetFailedDependenciesRow
+	for rows.Next() {
+		var i GetFailedDependenciesRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.FailedDeps,
+			&i.Breaks,
+			&i.Category,
+			&i.Dir,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getFailedDependenciesForBuild = `-- name: GetFailedDependenciesForBuild :many
+SELECT build_id, result_id, failed_result_id FROM failed_dependencies
+WHERE build_id = ?
+`
+
+func (q *Queries) GetFailedDependenciesForBuild(ctx context.Context, buildID int64) ([]FailedDependency, error) {
+	rows, err := q.db.QueryContext(ctx, getFailedDependenciesForBuild, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FailedDependency
+	for rows.Next() {
+		var i FailedDependency
+		if err := rows.Scan(&i.BuildID, &i.ResultID, &i.FailedResultID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getFailedFetches = `-- name: GetFailedFetches :many
+SELECT f.build_id, b.platform, b.branch, b.build_ts, b.build_user, f.url, f.attempts, f.last_error
+FROM fetch_retries f
+JOIN builds b ON (f.build_id = b.build_id)
+WHERE f.gave_up
+ORDER BY b.build_ts DESC
+`
+
+type GetFailedFetchesRow struct {
+	BuildID   int64
+	Platform  string
+	Branch    string
+	BuildTs   time.Time
+	BuildUser string
+	Url       string
+	Attempts  int64
+	LastError string
+}
+
+func (q *Queries) GetFailedFetches(ctx context.Context) ([]GetFailedFetchesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getFailedFetches)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetFailedFetchesRow
+	for rows.Next() {
+		var i GetFailedFetchesRow
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Platform,
+			&i.Branch,
+			&i.BuildTs,
+			&i.BuildUser,
+			&i.Url,
+			&i.Attempts,
+			&i.LastError,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getFetchRetry = `-- name: GetFetchRetry :one
+SELECT build_id, url, attempts, next_ts, last_error, gave_up FROM fetch_retries
+WHERE build_id = ?
+`
+
+func (q *Queries) GetFetchRetry(ctx context.Context, buildID int64) (FetchRetry, error) {
+	row := q.db.QueryRowContext(ctx, getFetchRetry, buildID)
+	var i FetchRetry
+	err := row.Scan(
+		&i.BuildID,
+		&i.Url,
+		&i.Attempts,
+		&i.NextTs,
+		&i.LastError,
+		&i.GaveUp,
+	)
+	return i, err
+}
+
+const getIngestJobsForBuild = `-- name: GetIngestJobsForBuild :many
+SELECT job_id, build_id, url, phase, pkgs_written, pkgs_total, last_error, message, start_ts, update_ts FROM ingest_jobs
+WHERE build_id = ?
+ORDER BY job_id
+`
+
+func (q *Queries) GetIngestJobsForBuild(ctx context.Context, buildID int64) ([]IngestJob, error) {
+	rows, err := q.db.QueryContext(ctx, getIngestJobsForBuild, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []IngestJob
+	for rows.Next() {
+		var i IngestJob
+		if err := rows.Scan(
+			&i.JobID,
+			&i.BuildID,
+			&i.Url,
+			&i.Phase,
+			&i.PkgsWritten,
+			&i.PkgsTotal,
+			&i.LastError,
+			&i.Message,
+			&i.StartTs,
+			&i.UpdateTs,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLatestBuildsPerPlatform = `-- name: GetLatestBuildsPerPlatform :many
+
+SELECT build_id, platform, build_ts, branch, compiler, build_user, report_url, num_ok, num_prefailed, num_failed, num_indirect_failed, num_indirect_prefailed FROM builds
+WHERE build_id IN (
+	SELECT build_id FROM (
+		SELECT build_id, ROW_NUMBER() OVER (
+			PARTITION BY platform, branch, compiler, build_user
+			ORDER BY build_ts DESC, build_id DESC
+		) AS n
+		FROM builds
+	) latest
+	WHERE n = 1
+)
+ORDER BY build_ts DESC
+LIMIT 1000
+`
+
+// GetLatestBuildsPerPlatform returns the newest build of each platform, branch,
+// compiler and user, ordered like GetPreviousBuild.
+func (q *Queries) GetLatestBuildsPerPlatform(ctx context.Context) ([]Build, error) {
+	rows, err := q.db.QueryContext(ctx, getLatestBuildsPerPlatform)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Build
+	for rows.Next() {
+		var i Build
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Platform,
+			&i.BuildTs,
+			&i.Branch,
+			&i.Compiler,
+			&i.BuildUser,
+			&i.ReportUrl,
+			&i.NumOk,
+			&i.NumPrefailed,
+			&i.NumFailed,
+			&i.NumIndirectFailed,
+			&i.NumIndirectPrefailed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLatestPkgResults = `-- name: GetLatestPkgResults :many
+
+SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, r.fail_reason, r.skip_reason, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
+FROM latest_results l
+JOIN results r ON (l.result_id = r.result_id)
+JOIN builds b ON (l.build_id = b.build_id)
+WHERE l.pkg_id = ?
+ORDER BY b.build_ts DESC, b.build_id DESC
+`
+
+type GetLatestPkgResultsRow struct {
+	ResultID    int64
+	PkgName     string
+	BuildStatus int64
+	Breaks      int64
+	FailReason  string
+	SkipReason  string
+	BuildID     int64
+	Platform    string
+	BuildTs     time.Time
+	Branch      string
+	Compiler    string
+	BuildUser   string
+}
+
+// GetLatestPkgResults returns the latest result of the given package for
+// each builder, newest first.
+func (q *Queries) GetLatestPkgResults(ctx context.Context, pkgID int64) ([]GetLatestPkgResultsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getLatestPkgResults, pkgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetLatestPkgResultsRow
+	for rows.Next() {
+		var i GetLatestPkgResultsRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.Breaks,
+			&i.FailReason,
+			&i.SkipReason,
+			&i.BuildID,
+			&i.Platform,
+			&i.BuildTs,
+			&i.Branch,
+			&i.Compiler,
+			&i.BuildUser,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLatestRegressions = `-- name: GetLatestRegressions :many
+
+SELECT g.build_id, g.result_id, r.pkg_name
+FROM regressions g
+JOIN results r ON (g.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE g.build_id IN (
+	SELECT build_id FROM (
+		SELECT build_id, ROW_NUMBER() OVER (
+			PARTITION BY platform, branch, compiler, build_user
+			ORDER BY build_ts DESC, build_id DESC
+		) AS n
+		FROM builds
+	) latest
+	WHERE n = 1
+)
+ORDER BY g.build_id, p.category, p.dir
+`
+
+type GetLatestRegressionsRow struct {
+	BuildID  int64
+	ResultID int64
+	PkgName  string
+}
+
+// GetLatestRegressions returns the regressions of the builds listed by
+// GetLatestBuildsPerPlatform.
+func (q *Queries) GetLatestRegressions(ctx context.Context) ([]GetLatestRegressionsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getLatestRegressions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetLatestRegressionsRow
+	for rows.Next() {
+		var i GetLatestRegressionsRow
+		if err := rows.Scan(&i.BuildID, &i.ResultID, &i.PkgName); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMaxResultID = `-- name: GetMaxResultID :one
+SELECT CAST(COALESCE(MAX(result_id), 0) AS BIGINT) AS max_result_id
+FROM results
+`
+
+func (q *Queries) GetMaxResultID(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getMaxResultID)
+	var max_result_id int64
+	err := row.Scan(&max_result_id)
+	return max_result_id, err
+}
+
+const getNextBuild = `-- name: GetNextBuild :one
+
+SELECT b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user, b.report_url, b.num_ok, b.num_prefailed, b.num_failed, b.num_indirect_failed, b.num_indirect_prefailed FROM builds b
+JOIN builds d ON (
+	b.platform = d.platform AND b.branch = d.branch AND
+	b.compiler = d.compiler AND b.build_user = d.build_user
+)
+WHERE d.build_id = ? AND (
+	b.build_ts > d.build_ts OR (b.build_ts = d.build_ts AND b.build_id > d.build_id)
+) AND EXISTS (SELECT 1 FROM results r WHERE r.build_id = b.build_id)
+ORDER BY b.build_ts, b.build_id
+LIMIT 1
+`
+
+// GetNextBuild returns the build after the given one with the same platform,
+// branch, compiler and user, skipping builds without results like
+// GetPreviousBuild.
+func (q *Queries) GetNextBuild(ctx context.Context, buildID int64) (Build, error) {
+	row := q.db.QueryRowContext(ctx, getNextBuild, buildID)
+	var i Build
+	err := row.Scan(
+		&i.BuildID,
+		&i.Platform,
+		&i.BuildTs,
+		&i.Branch,
+		&i.Compiler,
+		&i.BuildUser,
+		&i.ReportUrl,
+		&i.NumOk,
+		&i.NumPrefailed,
+		&i.NumFailed,
+		&i.NumIndirectFailed,
+		&i.NumIndirectPrefailed,
+	)
+	return i, err
+}
+
+const getPendingFetchRetries = `-- name: GetPendingFetchRetries :many
+SELECT build_id, url, attempts, next_ts, last_error, gave_up FROM fetch_retries
+WHERE NOT gave_up
+ORDER BY next_ts
+`
+
+func (q *Queries) GetPendingFetchRetries(ctx context.Context) ([]FetchRetry, error) {
+	rows, err := q.db.QueryContext(ctx, getPendingFetchRetries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []FetchRetry
+	for rows.Next() {
+		var i FetchRetry
+		if err := rows.Scan(
+			&i.BuildID,
+			&i.Url,
+			&i.Attempts,
+			&i.NextTs,
+			&i.LastError,
+			&i.GaveUp,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPkgID = `-- name: GetPkgID :one
+SELECT pkg_id FROM pkgs
+WHERE category = ? and dir = ?
+`
+
+type GetPkgIDParams struct {
+	Category string
+	Dir      string
+}
+
+func (q *Queries) GetPkgID(ctx context.Context, arg GetPkgIDParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getPkgID, arg.Category, arg.Dir)
+	var pkg_id int64
+	err := row.Scan(&pkg_id)
+	return pkg_id, err
+}
+
+const getPkgsBreakingMostOthers = `-- name: GetPkgsBreakingMostOthers :many
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	r.failed_deps,
+	COUNT(*) AS breaks
+FROM failed_dependencies f
+JOIN results r ON (f.failed_result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.build_id = ?
+GROUP BY r.result_id, p.pkg_id
+ORDER BY breaks DESC
+LIMIT 100
+`
+
+type GetPkgsBreakingMostOthersRow struct {
+	ResultID    int64
+	PkgPath     interface{}
+	PkgName     string
+	BuildStatus int64
+	FailedDeps  string
+	Breaks      int64
+}
+
+func (q *Queries) GetPkgsBreakingMostOthers(ctx context.Context, buildID int64) ([]GetPkgsBreakingMostOthersRow, error) {
+	rows, err := q.db.QueryContext(ctx, getPkgsBreakingMostOthers, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPkgsBreakingMostOthersRow
+	for rows.Next() {
+		var i GetPkgsBreakingMostOthersRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.PkgPath,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.FailedDeps,
+			&i.Breaks,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPkgsBrokenBy = `-- name: GetPkgsBrokenBy :many
+
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	r.failed_deps,
+	r.breaks
+FROM failed_dependencies f
+JOIN results r ON (f.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.failed_result_id = ?
+`
+
+type GetPkgsBrokenByRow struct {
+	ResultID    int64
+	PkgPath     interface{}
 	PkgName     string
 	BuildStatus int64
 	FailedDeps  string
 	Breaks      int64
-	PkgID_2     int64
-	Category    string
-	Dir         string
+}
+
+// GetPkgsBrokenBy returns all packages that were broken by the given
+// result ID.
+func (q *Queries) GetPkgsBrokenBy(ctx context.Context, failedResultID int64) ([]GetPkgsBrokenByRow, error) {
+	rows, err := q.db.QueryContext(ctx, getPkgsBrokenBy, failedResultID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPkgsBrokenByRow
+	for rows.Next() {
+		var i GetPkgsBrokenByRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.PkgPath,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.FailedDeps,
+			&i.Breaks,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPkgsInCategory = `-- name: GetPkgsInCategory :many
+SELECT DISTINCT dir
+FROM pkgs
+WHERE category = ?
+ORDER BY dir
+`
+
+func (q *Queries) GetPkgsInCategory(ctx context.Context, category string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, getPkgsInCategory, category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var dir string
+		if err := rows.Scan(&dir); err != nil {
+			return nil, err
+		}
+		items = append(items, dir)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPreviousBuild = `-- name: GetPreviousBuild :one
+
+SELECT b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user, b.report_url, b.num_ok, b.num_prefailed, b.num_failed, b.num_indirect_failed, b.num_indirect_prefailed FROM builds b
+JOIN builds d ON (
+	b.platform = d.platform AND b.branch = d.branch AND
+	b.compiler = d.compiler AND b.build_user = d.build_user
+)
+WHERE d.build_id = ? AND (
+	b.build_ts < d.build_ts OR (b.build_ts = d.build_ts AND b.build_id < d.build_id)
+) AND EXISTS (SELECT 1 FROM results r WHERE r.build_id = b.build_id)
+ORDER BY b.build_ts DESC, b.build_id DESC
+LIMIT 1
+`
+
+// GetPreviousBuild returns the build before the given one with the same
+// platform, branch, compiler and user. Builds whose results have been
+// deleted are skipped, as there is nothing to compare with.
+func (q *Queries) GetPreviousBuild(ctx context.Context, buildID int64) (Build, error) {
+	row := q.db.QueryRowContext(ctx, getPreviousBuild, buildID)
+	var i Build
+	err := row.Scan(
+		&i.BuildID,
+		&i.Platform,
+		&i.BuildTs,
+		&i.Branch,
+		&i.Compiler,
+		&i.BuildUser,
+		&i.ReportUrl,
+		&i.NumOk,
+		&i.NumPrefailed,
+		&i.NumFailed,
+		&i.NumIndirectFailed,
+		&i.NumIndirectPrefailed,
+	)
+	return i, err
+}
+
+const getRegressions = `-- name: GetRegressions :many
+
+SELECT g.result_id, p.category, p.dir, r.pkg_name, r.build_status, g.prev_build_id, g.prev_build_status
+FROM regressions g
+JOIN results r ON (g.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE g.build_id = ?
+ORDER BY p.category, p.dir
+`
+
+type GetRegressionsRow struct {
+	ResultID        int64
+	Category        string
+	Dir             string
+	PkgName         string
+	BuildStatus     int64
+	PrevBuildID     int64
+	PrevBuildStatus int64
+}
+
+// GetRegressions returns the packages that failed in the given build but
+// not in the previous one from the same builder.
+func (q *Queries) GetRegressions(ctx context.Context, buildID int64) ([]GetRegressionsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getRegressions, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetRegressionsRow
+	for rows.Next() {
+		var i GetRegressionsRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.Category,
+			&i.Dir,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.PrevBuildID,
+			&i.PrevBuildStatus,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getReplacedBuilds = `-- name: GetReplacedBuilds :many
+SELECT replaced_build_id FROM replaced_builds
+WHERE build_id = ?
+ORDER BY replaced_build_id
+`
+
+func (q *Queries) GetReplacedBuilds(ctx context.Context, buildID int64) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, getReplacedBuilds, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var replaced_build_id int64
+		if err := rows.Scan(&replaced_build_id); err != nil {
+			return nil, err
+		}
+		items = append(items, replaced_build_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getResultStatuses = `-- name: GetResultStatuses :many
+SELECT r.result_id, p.category, p.dir, r.multi_version, r.pkg_name, r.build_status
+FROM results r
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE r.build_id = ?
+ORDER BY p.category, p.dir, r.multi_version
+`
+
+type GetResultStatusesRow struct {
+	ResultID     int64
+	Category     string
+	Dir          string
+	MultiVersion string
+	PkgName      string
+	BuildStatus  int64
+}
+
+func (q *Queries) GetResultStatuses(ctx context.Context, buildID sql.NullInt64) ([]GetResultStatusesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getResultStatuses, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetResultStatusesRow
+	for rows.Next() {
+		var i GetResultStatusesRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.Category,
+			&i.Dir,
+			&i.MultiVersion,
+			&i.PkgName,
+			&i.BuildStatus,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getResultsForBuild = `-- name: GetResultsForBuild :many
+SELECT result_id, build_id, pkg_id, pkg_name, build_status, failed_deps, breaks, fail_reason, skip_reason, maintainer, categories, pkg_depth, multi_version, restricted, no_bin_on_ftp, bootstrap_pkg FROM results
+WHERE build_id = ?
+ORDER BY result_id
+`
+
+func (q *Queries) GetResultsForBuild(ctx context.Context, buildID sql.NullInt64) ([]Result, error) {
+	rows, err := q.db.QueryContext(ctx, getResultsForBuild, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Result
+	for rows.Next() {
+		var i Result
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.BuildID,
+			&i.PkgID,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.FailedDeps,
+			&i.Breaks,
+			&i.FailReason,
+			&i.SkipReason,
+			&i.Maintainer,
+			&i.Categories,
+			&i.PkgDepth,
+			&i.MultiVersion,
+			&i.Restricted,
+			&i.NoBinOnFtp,
+			&i.BootstrapPkg,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getResultsInCategory = `-- name: GetResultsInCategory :many
+SELECT r.result_id, r.build_id, r.pkg_id, r.pkg_name, r.build_status, r.failed_deps, r.breaks, r.fail_reason, r.skip_reason, r.maintainer, r.categories, r.pkg_depth, r.multi_version, r.restricted, r.no_bin_on_ftp, r.bootstrap_pkg, p.pkg_id, p.category, p.dir
+FROM results r
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE p.category = ? AND r.build_id = ?
+`
+
+type GetResultsInCategoryParams struct {
+	Category string
+	BuildID  sql.NullInt64
+}
+
+type GetResultsInCategoryRow struct {
+	ResultID     int64
+	BuildID      sql.NullInt64
+	PkgID        sql.NullInt64
+	PkgName      string
+	BuildStatus  int64
+	FailedDeps   string
+	Breaks       int64
+	FailReason   string
+	SkipReason   string
+	Maintainer   string
+	Categories   string
+	PkgDepth     int64
+	MultiVersion string
+	Restricted   string
+	NoBinOnFtp   string
+	BootstrapPkg bool
+	PkgID_2      int64
+	Category     string
+	Dir          string
 }
 
 func (q *Queries) GetResultsInCategory(ctx context.Context, arg GetResultsInCategoryParams) ([]GetResultsInCategoryRow, error) {
@@ -313,18 +1505,98 @@ func (q *Queries) GetResultsInCategory(ctx context.Context, arg GetResultsInCate
 	defer rows.Close()
 	var items []GetResultsInCategoryRow
 	for rows.Next() {
-		var i GetResultsInCategoryRow
+		var i GetResultsInCategoryRow
+		if err := rows.Scan(
+			&i.ResultID,
+			&i.BuildID,
+			&i.PkgID,
+			&i.PkgName,
+			&i.BuildStatus,
+			&i.FailedDeps,
+			&i.Breaks,
+			&i.FailReason,
+			&i.SkipReason,
+			&i.Maintainer,
+			&i.Categories,
+			&i.PkgDepth,
+			&i.MultiVersion,
+			&i.Restricted,
+			&i.NoBinOnFtp,
+			&i.BootstrapPkg,
+			&i.PkgID_2,
+			&i.Category,
+			&i.Dir,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getReverseDependencies = `-- name: GetReverseDependencies :many
+
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	dr.result_id AS dep_result_id,
+	(dp.category || dp.dir) AS dep_pkg_path,
+	dr.pkg_name AS dep_pkg_name,
+	dr.build_status AS dep_build_status
+FROM results dr
+JOIN pkgs dp ON (dr.pkg_id = dp.pkg_id)
+JOIN dependencies d ON (d.dep_result_id = dr.result_id)
+JOIN results r ON (d.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE dr.build_id = ? AND dp.category = ? AND dp.dir = ?
+ORDER BY dr.pkg_name, pkg_path
+`
+
+type GetReverseDependenciesParams struct {
+	BuildID  sql.NullInt64
+	Category string
+	Dir      string
+}
+
+type GetReverseDependenciesRow struct {
+	ResultID       int64
+	PkgPath        interface{}
+	PkgName        string
+	BuildStatus    int64
+	DepResultID    int64
+	DepPkgPath     interface{}
+	DepPkgName     string
+	DepBuildStatus int64
+}
+
+// GetReverseDependencies returns the packages depending on the package with
+// the given pkgpath in a build.
+func (q *Queries) GetReverseDependencies(ctx context.Context, arg GetReverseDependenciesParams) ([]GetReverseDependenciesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getReverseDependencies, arg.BuildID, arg.Category, arg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetReverseDependenciesRow
+	for rows.Next() {
+		var i GetReverseDependenciesRow
 		if err := rows.Scan(
 			&i.ResultID,
-			&i.BuildID,
-			&i.PkgID,
+			&i.PkgPath,
 			&i.PkgName,
 			&i.BuildStatus,
-			&i.FailedDeps,
-			&i.Breaks,
-			&i.PkgID_2,
-			&i.Category,
-			&i.Dir,
+			&i.DepResultID,
+			&i.DepPkgPath,
+			&i.DepPkgName,
+			&i.DepBuildStatus,
 		); err != nil {
 			return nil, err
 		}
@@ -346,6 +1618,15 @@ SELECT
 	r.build_status,
 	r.failed_deps,
 	r.breaks,
+	r.fail_reason,
+	r.skip_reason,
+	r.maintainer,
+	r.categories,
+	r.pkg_depth,
+	r.multi_version,
+	r.restricted,
+	r.no_bin_on_ftp,
+	r.bootstrap_pkg,
 	p.category,
 	p.dir,
 	b.build_id,
@@ -356,24 +1637,33 @@ SELECT
 	b.build_user,
 	b.report_url
 FROM results r, builds b, pkgs p
-WHERE r.build_id == b.build_id AND r.pkg_id == p.pkg_id AND r.result_id == ?
+WHERE r.build_id = b.build_id AND r.pkg_id = p.pkg_id AND r.result_id = ?
 `
 
 type GetSingleResultRow struct {
-	ResultID    int64
-	PkgName     string
-	BuildStatus int64
-	FailedDeps  string
-	Breaks      int64
-	Category    string
-	Dir         string
-	BuildID     int64
-	Platform    string
-	BuildTs     time.Time
-	Branch      string
-	Compiler    string
-	BuildUser   string
-	ReportUrl   string
+	ResultID     int64
+	PkgName      string
+	BuildStatus  int64
+	FailedDeps   string
+	Breaks       int64
+	FailReason   string
+	SkipReason   string
+	Maintainer   string
+	Categories   string
+	PkgDepth     int64
+	MultiVersion string
+	Restricted   string
+	NoBinOnFtp   string
+	BootstrapPkg bool
+	Category     string
+	Dir          string
+	BuildID      int64
+	Platform     string
+	BuildTs      time.Time
+	Branch       string
+	Compiler     string
+	BuildUser    string
+	ReportUrl    string
 }
 
 func (q *Queries) GetSingleResult(ctx context.Context, resultID int64) (GetSingleResultRow, error) {
@@ -385,6 +1675,15 @@ func (q *Queries) GetSingleResult(ctx context.Context, resultID int64) (GetSingl
 		&i.BuildStatus,
 		&i.FailedDeps,
 		&i.Breaks,
+		&i.FailReason,
+		&i.SkipReason,
+		&i.Maintainer,
+		&i.Categories,
+		&i.PkgDepth,
+		&i.MultiVersion,
+		&i.Restricted,
+		&i.NoBinOnFtp,
+		&i.BootstrapPkg,
 		&i.Category,
 		&i.Dir,
 		&i.BuildID,
@@ -398,49 +1697,6 @@ func (q *Queries) GetSingleResult(ctx context.Context, resultID int64) (GetSingl
 	return i, err
 }
 
-const getSingleResultByPkgName = `-- name: GetSingleResultByPkgName :one
-SELECT
-	r.result_id,
-	r.pkg_name,
-	r.build_status,
-	r.failed_deps,
-	r.breaks,
-	p.category,
-	p.dir
-FROM results r, pkgs p
-WHERE r.build_id == ? AND r.pkg_id == p.pkg_id AND r.pkg_name == ?
-`
-
-type GetSingleResultByPkgNameParams struct {
-	BuildID sql.NullInt64
-	PkgName string
-}
-
-type GetSingleResultByPkgNameRow struct {
-	ResultID    int64
-	PkgName     string
-	BuildStatus int64
-	FailedDeps  string
-	Breaks      int64
-	Category    string
-	Dir         string
-}
-
-func (q *Queries) GetSingleResultByPkgName(ctx context.Context, arg GetSingleResultByPkgNameParams) (GetSingleResultByPkgNameRow, error) {
-	row := q.db.QueryRowContext(ctx, getSingleResultByPkgName, arg.BuildID, arg.PkgName)
-	var i GetSingleResultByPkgNameRow
-	err := row.Scan(
-		&i.ResultID,
-		&i.PkgName,
-		&i.BuildStatus,
-		&i.FailedDeps,
-		&i.Breaks,
-		&i.Category,
-		&i.Dir,
-	)
-	return i, err
-}
-
 const putBuild = `-- name: PutBuild :one
 
 INSERT INTO builds
@@ -484,10 +1740,137 @@ func (q *Queries) PutBuild(ctx context.Context, arg PutBuildParams) (int64, erro
 	return build_id, err
 }
 
+const putCategoryStat = `-- name: PutCategoryStat :exec
+INSERT INTO category_stats
+(build_id, category, num_ok, num_prefailed, num_failed, num_indirect_failed,
+	num_indirect_prefailed)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`
+
+type PutCategoryStatParams struct {
+	BuildID              int64
+	Category             string
+	NumOk                int64
+	NumPrefailed         int64
+	NumFailed            int64
+	NumIndirectFailed    int64
+	NumIndirectPrefailed int64
+}
+
+func (q *Queries) PutCategoryStat(ctx context.Context, arg PutCategoryStatParams) error {
+	_, err := q.db.ExecContext(ctx, putCategoryStat,
+		arg.BuildID,
+		arg.Category,
+		arg.NumOk,
+		arg.NumPrefailed,
+		arg.NumFailed,
+		arg.NumIndirectFailed,
+		arg.NumIndirectPrefailed,
+	)
+	return err
+}
+
+const putFetchRetry = `-- name: PutFetchRetry :exec
+INSERT INTO fetch_retries
+(build_id, url, attempts, next_ts, last_error, gave_up)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (build_id) DO UPDATE SET
+	url = excluded.url,
+	attempts = excluded.attempts,
+	next_ts = excluded.next_ts,
+	last_error = excluded.last_error,
+	gave_up = excluded.gave_up
+`
+
+type PutFetchRetryParams struct {
+	BuildID   int64
+	Url       string
+	Attempts  int64
+	NextTs    time.Time
+	LastError string
+	GaveUp    bool
+}
+
+func (q *Queries) PutFetchRetry(ctx context.Context, arg PutFetchRetryParams) error {
+	_, err := q.db.ExecContext(ctx, putFetchRetry,
+		arg.BuildID,
+		arg.Url,
+		arg.Attempts,
+		arg.NextTs,
+		arg.LastError,
+		arg.GaveUp,
+	)
+	return err
+}
+
+const putIngestJob = `-- name: PutIngestJob :one
+INSERT INTO ingest_jobs
+(build_id, url, phase, pkgs_written, pkgs_total, last_error, message, start_ts, update_ts)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING job_id
+`
+
+type PutIngestJobParams struct {
+	BuildID     int64
+	Url         string
+	Phase       int64
+	PkgsWritten int64
+	PkgsTotal   int64
+	LastError   string
+	Message     string
+	StartTs     time.Time
+	UpdateTs    time.Time
+}
+
+func (q *Queries) PutIngestJob(ctx context.Context, arg PutIngestJobParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, putIngestJob,
+		arg.BuildID,
+		arg.Url,
+		arg.Phase,
+		arg.PkgsWritten,
+		arg.PkgsTotal,
+		arg.LastError,
+		arg.Message,
+		arg.StartTs,
+		arg.UpdateTs,
+	)
+	var job_id int64
+	err := row.Scan(&job_id)
+	return job_id, err
+}
+
+const putLatestResults = `-- name: PutLatestResults :exec
+
+INSERT INTO latest_results
+(pkg_id, platform, branch, compiler, build_user, build_id, result_id, build_ts)
+SELECT r.pkg_id, b.platform, b.branch, b.compiler, b.build_user, b.build_id, MAX(r.result_id), b.build_ts
+FROM results r
+JOIN builds b ON (r.build_id = b.build_id)
+WHERE r.build_id = ?1 AND r.pkg_id IS NOT NULL
+GROUP BY r.pkg_id, b.platform, b.branch, b.compiler, b.build_user, b.build_id, b.build_ts
+ON CONFLICT (pkg_id, platform, branch, compiler, build_user) DO UPDATE SET
+	build_id = excluded.build_id,
+	result_id = excluded.result_id,
+	build_ts = excluded.build_ts
+WHERE excluded.build_ts > latest_results.build_ts OR (
+	excluded.build_ts = latest_results.build_ts AND excluded.build_id >= latest_results.build_id
+)
+`
+
+// PutLatestResults makes the results of the given build the latest ones for
+// its builder, unless there are results from a newer build. Of several
+// results for the same package, e.g. for different Python versions, the
+// last one is used, as an upsert may only change each row once.
+func (q *Queries) PutLatestResults(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, putLatestResults, buildID)
+	return err
+}
+
 const putPkg = `-- name: PutPkg :exec
-INSERT OR IGNORE INTO pkgs
+INSERT INTO pkgs
 (category, dir)
 VALUES (?, ?)
+ON CONFLICT DO NOTHING
 `
 
 type PutPkgParams struct {
@@ -500,19 +1883,68 @@ func (q *Queries) PutPkg(ctx context.Context, arg PutPkgParams) error {
 	return err
 }
 
+const putRegression = `-- name: PutRegression :exec
+INSERT INTO regressions (build_id, result_id, prev_build_id, prev_build_status)
+VALUES (?, ?, ?, ?)
+`
+
+type PutRegressionParams struct {
+	BuildID         int64
+	ResultID        int64
+	PrevBuildID     int64
+	PrevBuildStatus int64
+}
+
+func (q *Queries) PutRegression(ctx context.Context, arg PutRegressionParams) error {
+	_, err := q.db.ExecContext(ctx, putRegression,
+		arg.BuildID,
+		arg.ResultID,
+		arg.PrevBuildID,
+		arg.PrevBuildStatus,
+	)
+	return err
+}
+
+const putReplacedBuild = `-- name: PutReplacedBuild :exec
+INSERT INTO replaced_builds
+(build_id, replaced_build_id)
+VALUES (?, ?)
+ON CONFLICT DO NOTHING
+`
+
+type PutReplacedBuildParams struct {
+	BuildID         int64
+	ReplacedBuildID int64
+}
+
+func (q *Queries) PutReplacedBuild(ctx context.Context, arg PutReplacedBuildParams) error {
+	_, err := q.db.ExecContext(ctx, putReplacedBuild, arg.BuildID, arg.ReplacedBuildID)
+	return err
+}
+
 const putResult = `-- name: PutResult :exec
 INSERT INTO results
-(build_id, pkg_id, pkg_name, build_status, breaks, failed_deps)
-VALUES (?, ?, ?, ?, ?, ?)
+(build_id, pkg_id, pkg_name, build_status, breaks, failed_deps, fail_reason, skip_reason,
+	maintainer, categories, pkg_depth, multi_version, restricted, no_bin_on_ftp, bootstrap_pkg)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
 type PutResultParams struct {
-	BuildID     sql.NullInt64
-	PkgID       sql.NullInt64
-	PkgName     string
-	BuildStatus int64
-	Breaks      int64
-	FailedDeps  string
+	BuildID      sql.NullInt64
+	PkgID        sql.NullInt64
+	PkgName      string
+	BuildStatus  int64
+	Breaks       int64
+	FailedDeps   string
+	FailReason   string
+	SkipReason   string
+	Maintainer   string
+	Categories   string
+	PkgDepth     int64
+	MultiVersion string
+	Restricted   string
+	NoBinOnFtp   string
+	BootstrapPkg bool
 }
 
 func (q *Queries) PutResult(ctx context.Context, arg PutResultParams) error {
@@ -523,38 +1955,163 @@ func (q *Queries) PutResult(ctx context.Context, arg PutResultParams) error {
 		arg.BuildStatus,
 		arg.Breaks,
 		arg.FailedDeps,
+		arg.FailReason,
+		arg.SkipReason,
+		arg.Maintainer,
+		arg.Categories,
+		arg.PkgDepth,
+		arg.MultiVersion,
+		arg.Restricted,
+		arg.NoBinOnFtp,
+		arg.BootstrapPkg,
 	)
 	return err
 }
 
-const getAllPkgsMatching = `-- name: getAllPkgsMatching :many
-SELECT pkgpath
-FROM pkgpaths
-WHERE pkgpath LIKE ?1
-ORDER BY pkgpath
+const putSearchDoc = `-- name: PutSearchDoc :exec
+INSERT INTO search_docs (pkg_id, pkgpath, pkgbase, maintainer, fail_reason)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (pkg_id) DO UPDATE SET
+	pkgpath = excluded.pkgpath,
+	pkgbase = excluded.pkgbase,
+	maintainer = excluded.maintainer,
+	fail_reason = excluded.fail_reason
 `
 
-func (q *Queries) getAllPkgsMatching(ctx context.Context, name string) ([]string, error) {
-	rows, err := q.db.QueryContext(ctx, getAllPkgsMatching, name)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var items []string
-	for rows.Next() {
-		var pkgpath string
-		if err := rows.Scan(&pkgpath); err != nil {
-			return nil, err
-		}
-		items = append(items, pkgpath)
-	}
-	if err := rows.Close(); err != nil {
-		return nil, err
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-	return items, nil
+type PutSearchDocParams struct {
+	PkgID      int64
+	Pkgpath    string
+	Pkgbase    string
+	Maintainer string
+	FailReason string
+}
+
+func (q *Queries) PutSearchDoc(ctx context.Context, arg PutSearchDocParams) error {
+	_, err := q.db.ExecContext(ctx, putSearchDoc,
+		arg.PkgID,
+		arg.Pkgpath,
+		arg.Pkgbase,
+		arg.Maintainer,
+		arg.FailReason,
+	)
+	return err
+}
+
+const refillLatestResults = `-- name: RefillLatestResults :exec
+
+INSERT INTO latest_results
+(pkg_id, platform, branch, compiler, build_user, build_id, result_id, build_ts)
+SELECT
+	ranked.pkg_id,
+	ranked.platform,
+	ranked.branch,
+	ranked.compiler,
+	ranked.build_user,
+	ranked.build_id,
+	ranked.result_id,
+	ranked.build_ts
+FROM (
+	SELECT
+		r.pkg_id,
+		b.platform,
+		b.branch,
+		b.compiler,
+		b.build_user,
+		b.build_id,
+		r.result_id,
+		b.build_ts,
+		ROW_NUMBER() OVER (
+			PARTITION BY r.pkg_id
+			ORDER BY b.build_ts DESC, b.build_id DESC, r.result_id DESC
+		) AS n
+	FROM builds d
+	JOIN builds b ON (
+		b.platform = d.platform AND b.branch = d.branch AND
+		b.compiler = d.compiler AND b.build_user = d.build_user
+	)
+	JOIN results r ON (r.build_id = b.build_id)
+	WHERE d.build_id = ?1 AND r.pkg_id IS NOT NULL AND NOT EXISTS (
+		SELECT 1 FROM latest_results l
+		WHERE l.pkg_id = r.pkg_id AND l.platform = b.platform AND
+			l.branch = b.branch AND l.compiler = b.compiler AND
+			l.build_user = b.build_user
+	)
+) ranked
+WHERE ranked.n = 1
+`
+
+// RefillLatestResults adds the latest results for the builder of the given
+// build, for the packages that have none. This is needed after deleting
+// results that were the latest ones.
+func (q *Queries) RefillLatestResults(ctx context.Context, buildID int64) error {
+	_, err := q.db.ExecContext(ctx, refillLatestResults, buildID)
+	return err
+}
+
+const updateIngestJob = `-- name: UpdateIngestJob :exec
+UPDATE ingest_jobs
+SET phase = ?, pkgs_written = ?, pkgs_total = ?, last_error = ?, message = ?, update_ts = ?
+WHERE job_id = ?
+`
+
+type UpdateIngestJobParams struct {
+	Phase       int64
+	PkgsWritten int64
+	PkgsTotal   int64
+	LastError   string
+	Message     string
+	UpdateTs    time.Time
+	JobID       int64
+}
+
+func (q *Queries) UpdateIngestJob(ctx context.Context, arg UpdateIngestJobParams) error {
+	_, err := q.db.ExecContext(ctx, updateIngestJob,
+		arg.Phase,
+		arg.PkgsWritten,
+		arg.PkgsTotal,
+		arg.LastError,
+		arg.Message,
+		arg.UpdateTs,
+		arg.JobID,
+	)
+	return err
+}
+
+const updateResultDeps = `-- name: UpdateResultDeps :exec
+UPDATE results
+SET failed_deps = ?, breaks = ?
+WHERE result_id = ?
+`
+
+type UpdateResultDepsParams struct {
+	FailedDeps string
+	Breaks     int64
+	ResultID   int64
+}
+
+func (q *Queries) UpdateResultDeps(ctx context.Context, arg UpdateResultDepsParams) error {
+	_, err := q.db.ExecContext(ctx, updateResultDeps, arg.FailedDeps, arg.Breaks, arg.ResultID)
+	return err
+}
+
+const clearSearchIndexStale = `-- name: clearSearchIndexStale :exec
+DELETE FROM search_index_stale
+`
+
+func (q *Queries) clearSearchIndexStale(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, clearSearchIndexStale)
+	return err
+}
+
+const countSearchIndexStale = `-- name: countSearchIndexStale :one
+SELECT COUNT(*) FROM search_index_stale
+`
+
+func (q *Queries) countSearchIndexStale(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countSearchIndexStale)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
 }
 
 const getLatestBuilds = `-- name: getLatestBuilds :many
@@ -599,44 +2156,154 @@ func (q *Queries) getLatestBuilds(ctx context.Context) ([]Build, error) {
 	return items, nil
 }
 
-const getPkgsBrokenBy = `-- name: getPkgsBrokenBy :many
-SELECT
-	r.result_id,
-	(p.category || p.dir) AS pkg_path,
-	r.pkg_name,
-	r.build_status,
-	r.failed_deps,
-	r.breaks
-FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE r.failed_deps LIKE ?
+const getNewestPkgsForBuild = `-- name: getNewestPkgsForBuild :many
+
+SELECT l.pkg_id FROM latest_results l
+WHERE l.build_id = ? AND NOT EXISTS (
+	SELECT 1 FROM latest_results o
+	WHERE o.pkg_id = l.pkg_id AND (
+		o.build_ts > l.build_ts OR (o.build_ts = l.build_ts AND o.build_id > l.build_id)
+	)
+)
 `
 
-type getPkgsBrokenByRow struct {
-	ResultID    int64
-	PkgPath     interface{}
-	PkgName     string
-	BuildStatus int64
-	FailedDeps  string
-	Breaks      int64
+// getNewestPkgsForBuild returns the packages for which the given build has
+// the newest result from any builder, by build timestamp.
+func (q *Queries) getNewestPkgsForBuild(ctx context.Context, buildID int64) ([]int64, error) {
+	rows, err := q.db.QueryContext(ctx, getNewestPkgsForBuild, buildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var pkg_id int64
+		if err := rows.Scan(&pkg_id); err != nil {
+			return nil, err
+		}
+		items = append(items, pkg_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSearchDocSources = `-- name: getSearchDocSources :many
+
+SELECT p.pkg_id, p.category, p.dir, r.pkg_name, r.maintainer, r.fail_reason
+FROM latest_results l
+JOIN pkgs p ON (l.pkg_id = p.pkg_id)
+JOIN results r ON (l.result_id = r.result_id)
+WHERE NOT EXISTS (
+	SELECT 1 FROM latest_results o
+	WHERE o.pkg_id = l.pkg_id AND (
+		o.build_ts > l.build_ts OR (o.build_ts = l.build_ts AND o.build_id > l.build_id)
+	)
+)
+`
+
+type getSearchDocSourcesRow struct {
+	PkgID      int64
+	Category   string
+	Dir        string
+	PkgName    string
+	Maintainer string
+	FailReason string
 }
 
-func (q *Queries) getPkgsBrokenBy(ctx context.Context, failedDeps string) ([]getPkgsBrokenByRow, error) {
-	rows, err := q.db.QueryContext(ctx, getPkgsBrokenBy, failedDeps)
+// getSearchDocSources returns the package path and the newest result of
+// every package from any builder, by build timestamp, which its search
+// document is made from.
+func (q *Queries) getSearchDocSources(ctx context.Context) ([]getSearchDocSourcesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getSearchDocSources)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []getPkgsBrokenByRow
+	var items []getSearchDocSourcesRow
 	for rows.Next() {
-		var i getPkgsBrokenByRow
+		var i getSearchDocSourcesRow
 		if err := rows.Scan(
-			&i.ResultID,
-			&i.PkgPath,
+			&i.PkgID,
+			&i.Category,
+			&i.Dir,
 			&i.PkgName,
-			&i.BuildStatus,
-			&i.FailedDeps,
-			&i.Breaks,
+			&i.Maintainer,
+			&i.FailReason,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markSearchIndexStale = `-- name: markSearchIndexStale :exec
+INSERT INTO search_index_stale (id) VALUES (1)
+ON CONFLICT DO NOTHING
+`
+
+func (q *Queries) markSearchIndexStale(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, markSearchIndexStale)
+	return err
+}
+
+const searchPkgsLike = `-- name: searchPkgsLike :many
+
+SELECT pkg_id, pkgpath, pkgbase, maintainer, fail_reason FROM search_docs
+WHERE LOWER(pkgpath) LIKE LOWER(?1)
+	OR LOWER(pkgbase) LIKE LOWER(?1)
+	OR LOWER(maintainer) LIKE LOWER(?1)
+	OR LOWER(fail_reason) LIKE LOWER(?1)
+ORDER BY
+	CASE
+		WHEN LOWER(pkgbase) = LOWER(?2) THEN 0
+		WHEN LOWER(pkgbase) LIKE LOWER(?3) THEN 1
+		ELSE 2
+	END,
+	pkgpath
+LIMIT ?4
+`
+
+type searchPkgsLikeParams struct {
+	Pattern    string
+	Term       string
+	Prefix     string
+	MaxResults int64
+}
+
+// searchPkgsLike is the package search without a full-text index. Packages
+// whose base name is term come first, then those where it starts with term.
+func (q *Queries) searchPkgsLike(ctx context.Context, arg searchPkgsLikeParams) ([]SearchDoc, error) {
+	rows, err := q.db.QueryContext(ctx, searchPkgsLike,
+		arg.Pattern,
+		arg.Term,
+		arg.Prefix,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchDoc
+	for rows.Next() {
+		var i SearchDoc
+		if err := rows.Scan(
+			&i.PkgID,
+			&i.Pkgpath,
+			&i.Pkgbase,
+			&i.Maintainer,
+			&i.FailReason,
 		); err != nil {
 			return nil, err
 		}
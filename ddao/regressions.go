@@ -0,0 +1,112 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// PutRegressions compares the given build with the previous build from the
+// same builder and records the newly failed packages as regressions,
+// replacing any earlier record for the build. It returns the number of
+// regressions. A build without a predecessor has none.
+//
+// If the build was imported out of order, it is now the predecessor of the
+// next build from the same builder, so the regressions of that build are
+// recomputed as well.
+func (d *DB) PutRegressions(ctx context.Context, buildID int64) (int, error) {
+	n, err := d.putRegressions(ctx, buildID)
+	if err != nil {
+		return 0, err
+	}
+	next, err := d.GetNextBuild(ctx, buildID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return n, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if _, err := d.putRegressions(ctx, next.BuildID); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// updateRegressions recomputes the regressions of the given build after
+// its predecessor has been deleted. The deletion has already been
+// committed, so a failure is only logged. A zero build ID is ignored.
+func (d *DB) updateRegressions(ctx context.Context, buildID int64) {
+	if buildID == 0 {
+		return
+	}
+	if _, err := d.putRegressions(ctx, buildID); err != nil {
+		log.Warningf(ctx, "Recomputing regressions for build %v: %v", buildID, err)
+	}
+}
+
+func (d *DB) putRegressions(ctx context.Context, buildID int64) (int, error) {
+	diff, err := d.DiffWithPrevious(ctx, buildID)
+	if errors.Is(err, sql.ErrNoRows) {
+		diff = &BuildDiff{}
+	} else if err != nil {
+		return 0, err
+	}
+
+	tx, err := d.BeginTransaction(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	q := d.WithTx(tx)
+	if err := q.DeleteRegressionsForBuild(ctx, buildID); err != nil {
+		return 0, err
+	}
+	for _, c := range diff.NewlyFailed {
+		err := q.PutRegression(ctx, PutRegressionParams{
+			BuildID:         buildID,
+			ResultID:        c.NewResultID,
+			PrevBuildID:     diff.From.BuildID,
+			PrevBuildStatus: c.OldBuildStatus,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(diff.NewlyFailed), tx.Commit()
+}
+
+// LatestRegressions returns the regressions of the builds listed by
+// LatestBuilds, keyed by build ID.
+func (d *DB) LatestRegressions(ctx context.Context) (map[int64][]GetLatestRegressionsRow, error) {
+	rows, err := d.GetLatestRegressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[int64][]GetLatestRegressionsRow)
+	for _, r := range rows {
+		m[r.BuildID] = append(m[r.BuildID], r)
+	}
+	return m, nil
+}
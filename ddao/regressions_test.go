@@ -0,0 +1,264 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func regressedPkgs(t *testing.T, db *DB, buildID int64) []string {
+	t.Helper()
+	rows, err := db.GetRegressions(context.Background(), buildID)
+	if err != nil {
+		t.Fatalf("GetRegressions(%d): %v", buildID, err)
+	}
+	var got []string
+	for _, r := range rows {
+		got = append(got, r.PkgName)
+	}
+	return got
+}
+
+func TestRegressions(t *testing.T) {
+	forEachDB(t, testRegressions)
+}
+
+func testRegressions(t *testing.T, db *DB) {
+	ctx := context.Background()
+	day := func(n int) time.Time {
+		return time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	b1 := addBuildAt(t, db, "NetBSD", day(10),
+		pkgResult("devel/", "foo", "foo-1.0", 0),
+		pkgResult("devel/", "bar", "bar-1.0", 1),
+		pkgResult("devel/", "baz", "baz-1.0", 2),
+	)
+	b2 := addBuildAt(t, db, "NetBSD", day(12),
+		pkgResult("devel/", "foo", "foo-1.1", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 3),
+		pkgResult("devel/", "baz", "baz-1.0", 3),
+		pkgResult("devel/", "new", "new-1.0", 2),
+	)
+
+	for _, id := range []int64{b1, b2} {
+		if _, err := db.PutRegressions(ctx, id); err != nil {
+			t.Fatalf("PutRegressions(%d): %v", id, err)
+		}
+	}
+	if got := regressedPkgs(t, db, b1); len(got) != 0 {
+		t.Errorf("build without predecessor: got regressions %q, want none", got)
+	}
+	want := []string{"bar-1.0", "foo-1.1"}
+	if diff := cmp.Diff(want, regressedPkgs(t, db, b2)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// Computing the regressions again replaces them.
+	n, err := db.PutRegressions(ctx, b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Errorf("PutRegressions(%d) = %d, want %d", b2, n, len(want))
+	}
+	if diff := cmp.Diff(want, regressedPkgs(t, db, b2)); diff != "" {
+		t.Errorf("after recomputing: diff (-want +got):\n%s", diff)
+	}
+
+	latest, err := db.LatestRegressions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(latest[b2]); got != len(want) {
+		t.Errorf("LatestRegressions: got %d for build %d, want %d", got, b2, len(want))
+	}
+
+	// The migration computes the same regressions for existing builds.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM regressions"); err != nil {
+		t.Fatal(err)
+	}
+	rerunBackfill(t, db, 12)
+	if diff := cmp.Diff(want, regressedPkgs(t, db, b2)); diff != "" {
+		t.Errorf("after migration: diff (-want +got):\n%s", diff)
+	}
+
+	// Without the previous build, there is nothing to compare with.
+	if err := db.DeleteBuild(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	if got := regressedPkgs(t, db, b2); len(got) != 0 {
+		t.Errorf("after deleting build %d: got regressions %q, want none", b1, got)
+	}
+
+	// Deleting the results removes the regressions.
+	if _, err := db.PutRegressions(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteResults(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	if got := regressedPkgs(t, db, b2); len(got) != 0 {
+		t.Errorf("after DeleteResults: got regressions %q, want none", got)
+	}
+}
+
+func TestRegressionsOutOfOrder(t *testing.T) {
+	forEachDB(t, testRegressionsOutOfOrder)
+}
+
+func testRegressionsOutOfOrder(t *testing.T, db *DB) {
+	ctx := context.Background()
+	day := func(n int) time.Time {
+		return time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	b1 := addBuildAt(t, db, "NetBSD", day(10),
+		pkgResult("devel/", "foo", "foo-1.0", 0),
+		pkgResult("devel/", "bar", "bar-1.0", 0),
+	)
+	b3 := addBuildAt(t, db, "NetBSD", day(14),
+		pkgResult("devel/", "foo", "foo-1.1", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 2),
+	)
+	for _, id := range []int64{b1, b3} {
+		if _, err := db.PutRegressions(ctx, id); err != nil {
+			t.Fatalf("PutRegressions(%d): %v", id, err)
+		}
+	}
+	if diff := cmp.Diff([]string{"bar-1.0", "foo-1.1"}, regressedPkgs(t, db, b3)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// A build imported later, but built in between, becomes the
+	// predecessor of b3.
+	b2 := addBuildAt(t, db, "NetBSD", day(12),
+		pkgResult("devel/", "foo", "foo-1.1", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 0),
+	)
+	if _, err := db.PutRegressions(ctx, b2); err != nil {
+		t.Fatalf("PutRegressions(%d): %v", b2, err)
+	}
+	if diff := cmp.Diff([]string{"foo-1.1"}, regressedPkgs(t, db, b2)); diff != "" {
+		t.Errorf("build %d: diff (-want +got):\n%s", b2, diff)
+	}
+	if diff := cmp.Diff([]string{"bar-1.0"}, regressedPkgs(t, db, b3)); diff != "" {
+		t.Errorf("build %d: diff (-want +got):\n%s", b3, diff)
+	}
+
+	// The newest build is b3, even though b2 has the higher ID.
+	builds, err := db.GetLatestBuildsPerPlatform(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != b3 {
+		t.Errorf("GetLatestBuildsPerPlatform: got %+v, want build %d", builds, b3)
+	}
+	latest, err := db.LatestRegressions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := latest[b2]; ok {
+		t.Errorf("LatestRegressions: got regressions for build %d, want only %d", b2, b3)
+	}
+	if got := len(latest[b3]); got != 1 {
+		t.Errorf("LatestRegressions: got %d for build %d, want 1", got, b3)
+	}
+}
+
+func TestRegressionsDelete(t *testing.T) {
+	forEachDB(t, testRegressionsDelete)
+}
+
+func testRegressionsDelete(t *testing.T, db *DB) {
+	ctx := context.Background()
+	day := func(n int) time.Time {
+		return time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC)
+	}
+
+	b1 := addBuildAt(t, db, "NetBSD", day(10),
+		pkgResult("devel/", "foo", "foo-1.0", 0),
+		pkgResult("devel/", "bar", "bar-1.0", 0),
+	)
+	b2 := addBuildAt(t, db, "NetBSD", day(12),
+		pkgResult("devel/", "foo", "foo-1.0", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 0),
+	)
+	b3 := addBuildAt(t, db, "NetBSD", day(14),
+		pkgResult("devel/", "foo", "foo-1.0", 2),
+		pkgResult("devel/", "bar", "bar-1.0", 2),
+	)
+	for _, id := range []int64{b1, b2, b3} {
+		if _, err := db.PutRegressions(ctx, id); err != nil {
+			t.Fatalf("PutRegressions(%d): %v", id, err)
+		}
+	}
+
+	// regressionsOf returns the regressed packages of b3 and checks that
+	// they were computed against the build prev.
+	regressionsOf := func(prev int64) []string {
+		t.Helper()
+		rows, err := db.GetRegressions(ctx, b3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range rows {
+			if r.PrevBuildID != prev {
+				t.Errorf("%s: compared with build %d, want %d", r.PkgName, r.PrevBuildID, prev)
+			}
+			got = append(got, r.PkgName)
+		}
+		return got
+	}
+	if diff := cmp.Diff([]string{"bar-1.0"}, regressionsOf(b2)); diff != "" {
+		t.Errorf("diff (-want +got):\n%s", diff)
+	}
+
+	// After deleting the build in the middle, b3 is compared with b1.
+	if err := db.DeleteBuild(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bar-1.0", "foo-1.0"}
+	if diff := cmp.Diff(want, regressionsOf(b1)); diff != "" {
+		t.Errorf("after deleting build %d: diff (-want +got):\n%s", b2, diff)
+	}
+	diff, err := db.DiffWithPrevious(ctx, b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(diff.NewlyFailed); diff.From.BuildID != b1 || got != len(want) {
+		t.Errorf("DiffWithPrevious(%d): %d newly failed since build %d, want %d since %d", b3, got, diff.From.BuildID, len(want), b1)
+	}
+
+	// A build whose results have been dropped is skipped, so b3 has
+	// nothing to compare with.
+	if err := db.DeleteResults(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	if got := regressionsOf(0); len(got) != 0 {
+		t.Errorf("after deleting the results of build %d: got regressions %q, want none", b1, got)
+	}
+}
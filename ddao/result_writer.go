@@ -0,0 +1,382 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// resultColumns is the number of parameters per result row.
+const resultColumns = 16
+
+// resultBatchSize is the number of rows per INSERT statement. This stays
+// below the default SQLite limit of 999 parameters per statement.
+const resultBatchSize = 62
+
+// insertResults returns an INSERT statement for n result rows.
+func insertResults(n int) string {
+	const row = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	return `INSERT INTO results
+(result_id, build_id, pkg_id, pkg_name, build_status, breaks, failed_deps,
+	fail_reason, skip_reason, maintainer, categories, pkg_depth, multi_version,
+	restricted, no_bin_on_ftp, bootstrap_pkg)
+VALUES ` + strings.Repeat(row+", ", n-1) + row
+}
+
+// edgeBatchSize is the number of rows per INSERT statement for the
+// tables linking two results, which have three parameters per row.
+const edgeBatchSize = 256
+
+// An edgeBatch buffers the rows of a table that links a result to another
+// result of the same build.
+type edgeBatch struct {
+	// table and column name the table and the column of the other
+	// result.
+	table, column string
+	insert        *sql.Stmt
+	pending       []interface{}
+}
+
+func newEdgeBatch(table, column string) *edgeBatch {
+	return &edgeBatch{
+		table:   table,
+		column:  column,
+		pending: make([]interface{}, 0, 3*edgeBatchSize),
+	}
+}
+
+// insertSQL returns an INSERT statement for n rows.
+func (e *edgeBatch) insertSQL(n int) string {
+	const row = "(?, ?, ?)"
+	return "INSERT INTO " + e.table + " (build_id, result_id, " + e.column + ") VALUES " +
+		strings.Repeat(row+", ", n-1) + row
+}
+
+func (e *edgeBatch) prepare(ctx context.Context, tx *sql.Tx) error {
+	var err error
+	e.insert, err = tx.PrepareContext(ctx, e.insertSQL(edgeBatchSize))
+	return err
+}
+
+// add adds a row, inserting a full batch if necessary.
+func (e *edgeBatch) add(ctx context.Context, buildID, resultID, otherID int64) error {
+	e.pending = append(e.pending, buildID, resultID, otherID)
+	if len(e.pending) < cap(e.pending) {
+		return nil
+	}
+	if _, err := e.insert.ExecContext(ctx, e.pending...); err != nil {
+		return err
+	}
+	e.pending = e.pending[:0]
+	return nil
+}
+
+// flush inserts the pending rows.
+func (e *edgeBatch) flush(ctx context.Context, tx *sql.Tx) error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, e.insertSQL(len(e.pending)/3), e.pending...); err != nil {
+		return err
+	}
+	e.pending = e.pending[:0]
+	return nil
+}
+
+type pkgKey struct {
+	category, dir string
+}
+
+// A ResultWriter writes the results for a single build within one
+// transaction. Results are inserted in batches using a prepared statement,
+// and package IDs are resolved through an in-memory cache.
+//
+// Result IDs are assigned sequentially while writing, so that the n-th
+// result can be updated later using Fixup. This is safe because the
+// transaction holds the database write lock from the start, or, on
+// PostgreSQL, an exclusive lock on the results table.
+type ResultWriter struct {
+	tx      *sql.Tx
+	q       *Queries
+	buildID int64
+	pkgIDs  map[pkgKey]int64
+	// firstID is the result ID of the first result written.
+	firstID int64
+	n       int
+	// pending holds the parameters of the rows not yet inserted.
+	pending    []interface{}
+	insert     *sql.Stmt
+	fixup      *sql.Stmt
+	deps       *edgeBatch
+	failedDeps *edgeBatch
+	// docs holds the search document of each package written, and index
+	// is true if pkg_search needs to be updated as well.
+	docs  map[int64]SearchDoc
+	index bool
+	// stats counts the results per category and build status.
+	stats map[string]*CategoryStat
+}
+
+// NewResultWriter starts a transaction for writing the results of the
+// given build. Existing results for the build are deleted. The caller must
+// call Commit to write the results, and Close in any case.
+func (d *DB) NewResultWriter(ctx context.Context, buildID int64) (*ResultWriter, error) {
+	index, err := d.hasSearchIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := d.BeginTransaction(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	w := &ResultWriter{
+		tx:         tx,
+		q:          d.WithTx(tx),
+		buildID:    buildID,
+		pkgIDs:     make(map[pkgKey]int64),
+		pending:    make([]interface{}, 0, resultColumns*resultBatchSize),
+		deps:       newEdgeBatch("dependencies", "dep_result_id"),
+		failedDeps: newEdgeBatch("failed_dependencies", "failed_result_id"),
+		docs:       make(map[int64]SearchDoc),
+		index:      index,
+		stats:      make(map[string]*CategoryStat),
+	}
+	if isPostgres(d.db.(*sql.DB)) {
+		// Unlike SQLite, PostgreSQL allows concurrent writers, which
+		// would assign the same result IDs.
+		if _, err := tx.ExecContext(ctx, "LOCK TABLE results IN EXCLUSIVE MODE"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := w.init(ctx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *ResultWriter) init(ctx context.Context) error {
+	// Deleting first also acquires the write lock.
+	if err := deleteResults(ctx, w.q, w.buildID); err != nil {
+		return err
+	}
+	if err := w.q.DeleteCategoryStatsForBuild(ctx, w.buildID); err != nil {
+		return err
+	}
+	maxID, err := w.q.GetMaxResultID(ctx)
+	if err != nil {
+		return err
+	}
+	w.firstID = maxID + 1
+
+	pkgs, err := w.q.GetAllPkgs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range pkgs {
+		w.pkgIDs[pkgKey{p.Category, p.Dir}] = p.PkgID
+	}
+
+	if w.insert, err = w.tx.PrepareContext(ctx, insertResults(resultBatchSize)); err != nil {
+		return err
+	}
+	if err := w.deps.prepare(ctx, w.tx); err != nil {
+		return err
+	}
+	if err := w.failedDeps.prepare(ctx, w.tx); err != nil {
+		return err
+	}
+	w.fixup, err = w.tx.PrepareContext(ctx, updateResultDeps)
+	return err
+}
+
+// pkgID returns the ID of the given package, creating it if necessary.
+func (w *ResultWriter) pkgID(ctx context.Context, category, dir string) (int64, error) {
+	key := pkgKey{category, dir}
+	if id, ok := w.pkgIDs[key]; ok {
+		return id, nil
+	}
+	params := PutPkgParams{
+		Category: category,
+		Dir:      dir,
+	}
+	if err := w.q.PutPkg(ctx, params); err != nil {
+		return 0, err
+	}
+	id, err := w.q.GetPkgID(ctx, GetPkgIDParams(params))
+	if err != nil {
+		return 0, err
+	}
+	w.pkgIDs[key] = id
+	return id, nil
+}
+
+// Write adds a result. It may be buffered until the next batch is full.
+func (w *ResultWriter) Write(ctx context.Context, r PkgResult) error {
+	pkgID, err := w.pkgID(ctx, r.Category, r.Dir)
+	if err != nil {
+		return err
+	}
+	w.pending = append(w.pending,
+		w.firstID+int64(w.n),
+		w.buildID,
+		pkgID,
+		r.PkgName,
+		r.BuildStatus,
+		r.Breaks,
+		r.FailedDeps,
+		r.FailReason,
+		r.SkipReason,
+		r.Maintainer,
+		r.Categories,
+		r.PkgDepth,
+		r.MultiVersion,
+		r.Restricted,
+		r.NoBinOnFtp,
+		r.BootstrapPkg,
+	)
+	w.docs[pkgID] = newSearchDoc(pkgID, r)
+	c := w.stats[r.Category]
+	if c == nil {
+		c = &CategoryStat{BuildID: w.buildID, Category: r.Category}
+		w.stats[r.Category] = c
+	}
+	c.add(r.BuildStatus)
+	w.n++
+	if len(w.pending) == cap(w.pending) {
+		if _, err := w.insert.ExecContext(ctx, w.pending...); err != nil {
+			return err
+		}
+		w.pending = w.pending[:0]
+		log.Debugf(ctx, "Inserted %v records ...", w.n)
+	}
+	return nil
+}
+
+// flush inserts the pending results.
+func (w *ResultWriter) flush(ctx context.Context) error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	if _, err := w.tx.ExecContext(ctx, insertResults(len(w.pending)/resultColumns), w.pending...); err != nil {
+		return err
+	}
+	w.pending = w.pending[:0]
+	return nil
+}
+
+// Fixup sets the FailedDeps and Breaks fields of the n-th result written,
+// counting from zero.
+func (w *ResultWriter) Fixup(ctx context.Context, n int, failedDeps string, breaks int64) error {
+	if err := w.flush(ctx); err != nil {
+		return err
+	}
+	_, err := w.fixup.ExecContext(ctx, failedDeps, breaks, w.firstID+int64(n))
+	return err
+}
+
+// Depend records that the n-th result written depends on the dep-th one,
+// counting from zero.
+func (w *ResultWriter) Depend(ctx context.Context, n, dep int) error {
+	// The results must exist before they can be referenced.
+	if err := w.flush(ctx); err != nil {
+		return err
+	}
+	return w.deps.add(ctx, w.buildID, w.firstID+int64(n), w.firstID+int64(dep))
+}
+
+// FailedDep records that the n-th result written failed because of the
+// failed-th one, counting from zero.
+func (w *ResultWriter) FailedDep(ctx context.Context, n, failed int) error {
+	if err := w.flush(ctx); err != nil {
+		return err
+	}
+	return w.failedDeps.add(ctx, w.buildID, w.firstID+int64(n), w.firstID+int64(failed))
+}
+
+// Written returns the number of results written so far.
+func (w *ResultWriter) Written() int {
+	return w.n
+}
+
+// Commit writes all pending results, the links between them and the
+// category statistics, updates the latest results for the builder and the
+// search documents of the packages, and commits the transaction.
+func (w *ResultWriter) Commit(ctx context.Context) error {
+	if err := w.flush(ctx); err != nil {
+		return err
+	}
+	if err := w.deps.flush(ctx, w.tx); err != nil {
+		return err
+	}
+	if err := w.failedDeps.flush(ctx, w.tx); err != nil {
+		return err
+	}
+	if err := putCategoryStats(ctx, w.q, w.stats); err != nil {
+		return err
+	}
+	if err := w.q.PutLatestResults(ctx, w.buildID); err != nil {
+		return err
+	}
+	docs, err := w.newestDocs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := putSearchDocs(ctx, w.tx, docs, w.index); err != nil {
+		return err
+	}
+	if err := w.tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof(ctx, "Successfully added %v results for build %v", w.n, w.buildID)
+	return nil
+}
+
+// newestDocs returns the search documents of the packages for which this
+// build has the newest result. A build that is older than others, e.g. one
+// imported from the history, does not replace their documents.
+func (w *ResultWriter) newestDocs(ctx context.Context) (map[int64]SearchDoc, error) {
+	ids, err := w.q.getNewestPkgsForBuild(ctx, w.buildID)
+	if err != nil {
+		return nil, err
+	}
+	docs := make(map[int64]SearchDoc, len(ids))
+	for _, id := range ids {
+		if doc, ok := w.docs[id]; ok {
+			docs[id] = doc
+		}
+	}
+	return docs, nil
+}
+
+// Close rolls back the transaction unless it has been committed.
+func (w *ResultWriter) Close() error {
+	err := w.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,355 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResultWriter(t *testing.T) {
+	forEachDB(t, testResultWriter)
+}
+
+func testResultWriter(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	// Results of another build must not be affected.
+	other := addBuild(t, db, "Linux", pkgResult("devel/", "libtool", "libtool-2.4", 0))
+	buildID := addBuild(t, db, "NetBSD")
+
+	// More than one batch, and a partial one at the end.
+	const total = 2*resultBatchSize + 10
+	w, err := db.NewResultWriter(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 0; i < total; i++ {
+		r := pkgResult("devel/", fmt.Sprintf("pkg%03d", i), fmt.Sprintf("pkg%03d-1.0", i), 0)
+		if err := w.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Fixup(ctx, 0, "", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Fixup(ctx, total-1, "pkg000-1.0", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Written(); got != total {
+		t.Errorf("Written() = %d, want %d", got, total)
+	}
+
+	rows, err := db.GetResultsInCategory(ctx, GetResultsInCategoryParams{
+		Category: "devel/",
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != total {
+		t.Fatalf("got %d results, want %d", len(rows), total)
+	}
+	for _, r := range rows {
+		switch r.PkgName {
+		case "pkg000-1.0":
+			if r.Breaks != 3 {
+				t.Errorf("%s: got Breaks %d, want 3", r.PkgName, r.Breaks)
+			}
+		case fmt.Sprintf("pkg%03d-1.0", total-1):
+			if r.FailedDeps != "pkg000-1.0" {
+				t.Errorf("%s: got FailedDeps %q, want %q", r.PkgName, r.FailedDeps, "pkg000-1.0")
+			}
+		default:
+			if r.Breaks != 0 || r.FailedDeps != "" {
+				t.Errorf("unexpected fixup for %s: %+v", r.PkgName, r)
+			}
+		}
+	}
+
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].BuildID != other {
+		t.Errorf("got results %+v, want a single one for build %d", results, other)
+	}
+}
+
+func TestResultWriterRollback(t *testing.T) {
+	forEachDB(t, testResultWriterRollback)
+}
+
+func testResultWriterRollback(t *testing.T, db *DB) {
+	ctx := context.Background()
+	buildID := addBuild(t, db, "NetBSD", pkgResult("devel/", "libtool", "libtool-2.4", 0))
+
+	w, err := db.NewResultWriter(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, pkgResult("lang/", "go", "go-1.20", 0)); err != nil {
+		t.Fatal(err)
+	}
+	// Close without Commit keeps the old results.
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("got %d results after rollback, want 1", len(results))
+	}
+}
+
+func TestResultWriterDependencies(t *testing.T) {
+	forEachDB(t, testResultWriterDependencies)
+}
+
+func testResultWriterDependencies(t *testing.T, db *DB) {
+	ctx := context.Background()
+	buildID := addBuild(t, db, "NetBSD")
+
+	w, err := db.NewResultWriter(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, r := range []PkgResult{
+		pkgResult("devel/", "libtool", "libtool-2.4", 0),
+		pkgResult("lang/", "perl5", "perl-5.36", 2),
+		pkgResult("devel/", "p5-Test", "p5-Test-1.0", 3),
+		pkgResult("devel/", "gmake", "gmake-4.4", 0),
+	} {
+		if err := w.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// p5-Test and libtool depend on perl, p5-Test also on gmake.
+	for _, e := range [][2]int{{2, 1}, {2, 3}, {0, 1}} {
+		if err := w.Depend(ctx, e[0], e[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deps, err := db.GetDependencies(ctx, GetDependenciesParams{
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+		Category: "devel/",
+		Dir:      "p5-Test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range deps {
+		got = append(got, fmt.Sprintf("%s -> %s (%v)", d.PkgName, d.DepPkgName, d.DepPkgPath))
+	}
+	want := []string{"p5-Test-1.0 -> gmake-4.4 (devel/gmake)", "p5-Test-1.0 -> perl-5.36 (lang/perl5)"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetDependencies: got %q, want %q", got, want)
+	}
+
+	rdeps, err := db.GetReverseDependencies(ctx, GetReverseDependenciesParams{
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+		Category: "lang/",
+		Dir:      "perl5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, d := range rdeps {
+		got = append(got, fmt.Sprintf("%s (%v) -> %s", d.PkgName, d.PkgPath, d.DepPkgName))
+	}
+	want = []string{"libtool-2.4 (devel/libtool) -> perl-5.36", "p5-Test-1.0 (devel/p5-Test) -> perl-5.36"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("GetReverseDependencies: got %q, want %q", got, want)
+	}
+
+	// The dependencies must be removed along with the results.
+	if err := db.DeleteBuild(ctx, buildID); err != nil {
+		t.Fatalf("DeleteBuild: %v", err)
+	}
+}
+
+// resultIDs returns the result IDs of the given build, keyed by package name.
+func resultIDs(t *testing.T, db *DB, buildID int64, category string) map[string]int64 {
+	t.Helper()
+	rows, err := db.GetResultsInCategory(context.Background(), GetResultsInCategoryParams{
+		Category: category,
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]int64)
+	for _, r := range rows {
+		ids[r.PkgName] = r.ResultID
+	}
+	return ids
+}
+
+func TestResultWriterFailedDeps(t *testing.T) {
+	forEachDB(t, testResultWriterFailedDeps)
+}
+
+func testResultWriterFailedDeps(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	// writeBuild writes a build in which p5-foo is broken by perl-5.24 and
+	// p5-perl-5.24-bar by perl-5.24.0nb1.
+	writeBuild := func(platform string) int64 {
+		buildID := addBuild(t, db, platform)
+		w, err := db.NewResultWriter(ctx, buildID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		for _, r := range []PkgResult{
+			pkgResult("lang/", "perl524", "perl-5.24", 2),
+			pkgResult("lang/", "perl5", "perl-5.24.0nb1", 2),
+			pkgResult("lang/", "p5-foo", "p5-foo-1.0", 3),
+			pkgResult("lang/", "p5-perl-bar", "p5-perl-5.24-bar-1.0", 3),
+		} {
+			if err := w.Write(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.FailedDep(ctx, 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.FailedDep(ctx, 3, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return buildID
+	}
+	buildID := writeBuild("NetBSD")
+	other := writeBuild("Linux")
+	ids := resultIDs(t, db, buildID, "lang/")
+
+	broken, err := db.GetPkgsBrokenBy(ctx, ids["perl-5.24"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(broken) != 1 || broken[0].ResultID != ids["p5-foo-1.0"] {
+		t.Errorf("GetPkgsBrokenBy(perl-5.24): got %+v, want only p5-foo-1.0 of build %d", broken, buildID)
+	}
+
+	failed, err := db.GetFailedDependencies(ctx, ids["p5-perl-5.24-bar-1.0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].ResultID != ids["perl-5.24.0nb1"] {
+		t.Errorf("GetFailedDependencies(p5-perl-5.24-bar): got %+v, want only perl-5.24.0nb1", failed)
+	}
+
+	most, err := db.GetPkgsBreakingMostOthers(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(most) != 2 {
+		t.Fatalf("GetPkgsBreakingMostOthers: got %d results, want 2", len(most))
+	}
+	for _, m := range most {
+		if m.Breaks != 1 || (m.ResultID != ids["perl-5.24"] && m.ResultID != ids["perl-5.24.0nb1"]) {
+			t.Errorf("GetPkgsBreakingMostOthers: unexpected %+v", m)
+		}
+	}
+
+	if err := db.DeleteBuild(ctx, other); err != nil {
+		t.Fatalf("DeleteBuild: %v", err)
+	}
+}
+
+func TestPutResultsFailedDeps(t *testing.T) {
+	forEachDB(t, testPutResultsFailedDeps)
+}
+
+func testPutResultsFailedDeps(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	withFailedDeps := func(r PkgResult, failedDeps string) PkgResult {
+		r.FailedDeps = failedDeps
+		return r
+	}
+	buildID := addBuild(t, db, "NetBSD")
+	err := db.PutResults(ctx, []PkgResult{
+		pkgResult("lang/", "perl524", "perl-5.24", 2),
+		pkgResult("lang/", "perl5", "perl-5.24.0nb1", 2),
+		pkgResult("devel/", "py_foo", "py_foo-1.0", 2),
+		withFailedDeps(pkgResult("lang/", "p5-foo", "p5-foo-1.0", 3), "perl-5.24 py_foo-1.0"),
+		withFailedDeps(pkgResult("lang/", "p5-perl-bar", "p5-perl-5.24-bar-1.0", 3), "perl-5.24.0nb1"),
+	}, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := resultIDs(t, db, buildID, "lang/")
+
+	// check verifies the root causes of p5-foo and p5-perl-5.24-bar. The
+	// names must match as a whole.
+	check := func(when string) {
+		t.Helper()
+		failed, err := db.GetFailedDependencies(ctx, ids["p5-foo-1.0"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range failed {
+			names = append(names, f.PkgName)
+		}
+		sort.Strings(names)
+		if diff := cmp.Diff([]string{"perl-5.24", "py_foo-1.0"}, names); diff != "" {
+			t.Errorf("%s: root causes of p5-foo: diff (-want +got):\n%s", when, diff)
+		}
+		failed, err = db.GetFailedDependencies(ctx, ids["p5-perl-5.24-bar-1.0"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failed) != 1 || failed[0].ResultID != ids["perl-5.24.0nb1"] {
+			t.Errorf("%s: root causes of p5-perl-5.24-bar: got %+v, want only perl-5.24.0nb1", when, failed)
+		}
+	}
+	check("PutResults")
+
+	// The migration links the existing results in the same way.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM failed_dependencies"); err != nil {
+		t.Fatal(err)
+	}
+	rerunBackfill(t, db, 8)
+	check("after migration")
+}
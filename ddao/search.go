@@ -0,0 +1,299 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// The package search looks at the search document of each package in the
+// search_docs table. On SQLite, if the driver has been built with FTS5
+// (see haveFTS5), the documents are also indexed in the pkg_search
+// full-text table, which allows ranked and prefix matches. Otherwise,
+// searches fall back to a substring match on search_docs.
+//
+// pkg_search is a regular FTS5 table rather than an external-content one,
+// because binaries without FTS5 cannot update it. Instead, they mark it as
+// stale in search_index_stale, and Migrate rebuilds it to catch up with the
+// changes they made.
+
+const createSearchIndex = `CREATE VIRTUAL TABLE IF NOT EXISTS pkg_search USING fts5(
+	pkgpath, pkgbase, maintainer, fail_reason,
+	prefix = '2 3'
+)`
+
+const rebuildSearchIndex = `INSERT INTO pkg_search
+(rowid, pkgpath, pkgbase, maintainer, fail_reason)
+SELECT pkg_id, pkgpath, pkgbase, maintainer, fail_reason FROM search_docs`
+
+const deleteSearchIndexEntry = "DELETE FROM pkg_search WHERE rowid = ?"
+
+const insertSearchIndexEntry = `INSERT INTO pkg_search
+(rowid, pkgpath, pkgbase, maintainer, fail_reason)
+VALUES (?, ?, ?, ?, ?)`
+
+const deleteUnusedSearchIndexEntries = `DELETE FROM pkg_search
+WHERE rowid NOT IN (SELECT pkg_id FROM search_docs)`
+
+// searchIndexQuery returns the matching search documents, packages whose
+// base name is the search term first, then ordered by relevance. Matches
+// in the package path or name weigh more than those in the maintainer or
+// the failure reason.
+const searchIndexQuery = `SELECT d.pkg_id, d.pkgpath, d.pkgbase, d.maintainer, d.fail_reason
+FROM pkg_search JOIN search_docs d ON d.pkg_id = pkg_search.rowid
+WHERE pkg_search MATCH ?
+ORDER BY
+	CASE WHEN LOWER(d.pkgbase) = LOWER(?) THEN 0 ELSE 1 END,
+	bm25(pkg_search, 10.0, 10.0, 2.0, 1.0),
+	d.pkgpath
+LIMIT ?`
+
+// searchIndexExists returns true if db has the pkg_search full-text index
+// and this binary can use it.
+func searchIndexExists(ctx context.Context, db *sql.DB) (bool, error) {
+	if !haveFTS5 || isPostgres(db) {
+		return false, nil
+	}
+	var n int
+	row := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'pkg_search'")
+	if err := row.Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// hasSearchIndex is like searchIndexExists. Within a transaction, it
+// returns false.
+func (d *DB) hasSearchIndex(ctx context.Context) (bool, error) {
+	db, ok := d.db.(*sql.DB)
+	if !ok {
+		return false, nil
+	}
+	return searchIndexExists(ctx, db)
+}
+
+// pkgBase returns the name of a package without its version, e.g. "perl"
+// for "perl-5.36.0nb1".
+func pkgBase(pkgName string) string {
+	if i := strings.LastIndexByte(pkgName, '-'); i != -1 {
+		return pkgName[:i]
+	}
+	return pkgName
+}
+
+// newSearchDoc returns the search document for package pkgID with the
+// result r.
+func newSearchDoc(pkgID int64, r PkgResult) SearchDoc {
+	return SearchDoc{
+		PkgID:      pkgID,
+		Pkgpath:    r.Category + r.Dir,
+		Pkgbase:    pkgBase(r.PkgName),
+		Maintainer: r.Maintainer,
+		FailReason: r.FailReason,
+	}
+}
+
+// putSearchDocs writes the given search documents, replacing the existing
+// ones for the same packages. If index is true, pkg_search is updated as
+// well, otherwise it is marked as stale.
+func putSearchDocs(ctx context.Context, tx *sql.Tx, docs map[int64]SearchDoc, index bool) error {
+	q := New(tx)
+	for _, doc := range docs {
+		if err := q.PutSearchDoc(ctx, PutSearchDocParams(doc)); err != nil {
+			return err
+		}
+	}
+	if !index {
+		if len(docs) == 0 {
+			return nil
+		}
+		return q.markSearchIndexStale(ctx)
+	}
+	del, err := tx.PrepareContext(ctx, deleteSearchIndexEntry)
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	ins, err := tx.PrepareContext(ctx, insertSearchIndexEntry)
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+	for _, doc := range docs {
+		if _, err := del.ExecContext(ctx, doc.PkgID); err != nil {
+			return err
+		}
+		if _, err := ins.ExecContext(ctx, doc.PkgID, doc.Pkgpath, doc.Pkgbase, doc.Maintainer, doc.FailReason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnusedPkgs removes the packages that are no longer referenced by
+// any result, together with their search documents.
+func removeUnusedPkgs(ctx context.Context, q *Queries, index bool) error {
+	if err := q.DeleteUnusedSearchDocs(ctx); err != nil {
+		return err
+	}
+	if index {
+		if _, err := q.db.ExecContext(ctx, deleteUnusedSearchIndexEntries); err != nil {
+			return err
+		}
+	} else if err := q.markSearchIndexStale(ctx); err != nil {
+		return err
+	}
+	return q.DeleteUnusedPkgs(ctx)
+}
+
+// warnNoFTS5 logs a warning if db is an SQLite database and this binary
+// has been built without FTS5.
+func warnNoFTS5(ctx context.Context, db *sql.DB) {
+	if !haveFTS5 && !isPostgres(db) {
+		log.Warningf(ctx, "SQLite FTS5 support is not compiled in, the package search falls back to substring matches without ranking. Build with -tags sqlite_fts5 to enable it.")
+	}
+}
+
+// syncSearch fills search_docs from the latest results if it is empty,
+// which is the case right after it has been added to an existing database.
+// If FTS5 is available, it then creates pkg_search and rebuilds it from
+// search_docs, unless the index already exists and is up to date.
+func syncSearch(ctx context.Context, db *sql.DB) error {
+	exists, err := searchIndexExists(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := New(tx)
+	n, err := q.CountSearchDocs(ctx)
+	if err != nil {
+		return err
+	}
+	var added int
+	if n == 0 {
+		srcs, err := q.getSearchDocSources(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range srcs {
+			err := q.PutSearchDoc(ctx, PutSearchDocParams{
+				PkgID:      s.PkgID,
+				Pkgpath:    s.Category + s.Dir,
+				Pkgbase:    pkgBase(s.PkgName),
+				Maintainer: s.Maintainer,
+				FailReason: s.FailReason,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		added = len(srcs)
+		if added > 0 {
+			log.Infof(ctx, "Added search documents for %v packages", added)
+		}
+	}
+
+	if haveFTS5 && !isPostgres(db) {
+		stale, err := q.countSearchIndexStale(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists || stale > 0 || added > 0 {
+			for _, stmt := range []string{createSearchIndex, "DELETE FROM pkg_search", rebuildSearchIndex} {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			if err := q.clearSearchIndexStale(ctx); err != nil {
+				return err
+			}
+			log.Infof(ctx, "Rebuilt the package search index")
+		}
+	} else if added > 0 {
+		if err := q.markSearchIndexStale(ctx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// matchExpr returns an FTS5 query that matches the documents containing
+// all words in term, each as a prefix. It returns "" if term does not
+// contain any words.
+func matchExpr(term string) string {
+	words := strings.FieldsFunc(term, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = `"` + w + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// SearchPkgs returns up to limit packages whose path, base name, maintainer
+// or latest failure reason match term, best matches first. With the
+// full-text index, every word in term is matched as a prefix of a word in
+// the search document; otherwise, term must be a substring.
+func (d *DB) SearchPkgs(ctx context.Context, term string, limit int) ([]SearchDoc, error) {
+	term = strings.TrimSpace(term)
+	index, err := d.hasSearchIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !index {
+		return d.searchPkgsLike(ctx, searchPkgsLikeParams{
+			Pattern:    "%" + term + "%",
+			Term:       term,
+			Prefix:     term + "%",
+			MaxResults: int64(limit),
+		})
+	}
+
+	expr := matchExpr(term)
+	if expr == "" {
+		return nil, nil
+	}
+	rows, err := d.db.QueryContext(ctx, searchIndexQuery, expr, term, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var docs []SearchDoc
+	for rows.Next() {
+		var doc SearchDoc
+		if err := rows.Scan(&doc.PkgID, &doc.Pkgpath, &doc.Pkgbase, &doc.Maintainer, &doc.FailReason); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
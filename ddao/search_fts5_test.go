@@ -0,0 +1,129 @@
+//go:build sqlite_fts5 || fts5
+
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	db := &DB{Queries: *New(openSQLite(t))}
+	if err := Migrate(ctx, db.db.(*sql.DB)); err != nil {
+		t.Fatal(err)
+	}
+	index, err := db.hasSearchIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index {
+		t.Fatal("pkg_search does not exist after Migrate")
+	}
+
+	addBuild(t, db, "NetBSD",
+		pkgResult("devel/", "py-foo", "py311-foo-1.0", 0),
+		pkgResult("devel/", "foo", "foo-1.0", 0),
+		pkgResult("lang/", "python311", "python311-3.11.4", 0),
+	)
+	for _, tc := range []struct {
+		term string
+		want []string
+	}{
+		// Every word is a prefix.
+		{"py fo", []string{"devel/py-foo"}},
+		{"pyth", []string{"lang/python311"}},
+		{"foo", []string{"devel/foo", "devel/py-foo"}},
+	} {
+		docs, err := db.SearchPkgs(ctx, tc.term, 10)
+		if err != nil {
+			t.Fatalf("SearchPkgs(%q): %v", tc.term, err)
+		}
+		var got []string
+		for _, d := range docs {
+			got = append(got, d.Pkgpath)
+		}
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("SearchPkgs(%q) = %q, want %q", tc.term, got, tc.want)
+		}
+	}
+}
+
+func TestSearchIndexRebuild(t *testing.T) {
+	ctx := context.Background()
+	sqldb := openSQLite(t)
+	db := &DB{Queries: *New(sqldb)}
+	if err := Migrate(ctx, sqldb); err != nil {
+		t.Fatal(err)
+	}
+	addBuild(t, db, "NetBSD", pkgResult("devel/", "foo", "foo-1.0", 0))
+
+	// An entry without a search document only survives as long as the
+	// index is not rebuilt.
+	const sentinel = "INSERT INTO pkg_search (rowid, pkgpath, pkgbase, maintainer, fail_reason) VALUES (9999, 'x/sentinel', 'sentinel', '', '')"
+	hasSentinel := func() bool {
+		t.Helper()
+		var n int
+		if err := sqldb.QueryRowContext(ctx, "SELECT COUNT(*) FROM pkg_search WHERE rowid = 9999").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n > 0
+	}
+	if _, err := sqldb.ExecContext(ctx, sentinel); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, sqldb); err != nil {
+		t.Fatal(err)
+	}
+	if !hasSentinel() {
+		t.Error("Migrate rebuilt an up-to-date index")
+	}
+
+	// A binary without FTS5 changes a search document and marks the
+	// index as stale.
+	if _, err := sqldb.ExecContext(ctx, "UPDATE search_docs SET maintainer = 'joe@example.org'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.markSearchIndexStale(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, sqldb); err != nil {
+		t.Fatal(err)
+	}
+	if hasSentinel() {
+		t.Error("Migrate did not rebuild a stale index")
+	}
+	docs, err := db.SearchPkgs(ctx, "joe", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Errorf("SearchPkgs after rebuilding: got %v, want one result", docs)
+	}
+	if stale, err := db.countSearchIndexStale(ctx); err != nil || stale != 0 {
+		t.Errorf("countSearchIndexStale after rebuilding = %d, %v; want 0", stale, err)
+	}
+}
@@ -0,0 +1,206 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ddao
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPkgBase(t *testing.T) {
+	for _, tc := range []struct {
+		pkgName, want string
+	}{
+		{"perl-5.36.0nb1", "perl"},
+		{"py311-setuptools-68.0.0", "py311-setuptools"},
+		{"noversion", "noversion"},
+	} {
+		if got := pkgBase(tc.pkgName); got != tc.want {
+			t.Errorf("pkgBase(%q) = %q, want %q", tc.pkgName, got, tc.want)
+		}
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	for _, tc := range []struct {
+		term, want string
+	}{
+		{"foo", `"foo"*`},
+		{" devel/py-foo ", `"devel"* "py"* "foo"*`},
+		{`"*`, ""},
+	} {
+		if got := matchExpr(tc.term); got != tc.want {
+			t.Errorf("matchExpr(%q) = %q, want %q", tc.term, got, tc.want)
+		}
+	}
+}
+
+func TestSearchPkgs(t *testing.T) {
+	forEachDB(t, testSearchPkgs)
+}
+
+func testSearchPkgs(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	foo := pkgResult("devel/", "foo", "foo-1.0", 0)
+	foo.Maintainer = "alice@example.org"
+	fooUtils := pkgResult("devel/", "foo-utils", "foo-utils-2.0", 2)
+	fooUtils.FailReason = "build"
+	bar := pkgResult("www/", "bar", "bar-1.0", 2)
+	bar.Maintainer = "foo@example.org"
+	bar.FailReason = "configure"
+	addBuild(t, db, "NetBSD", foo, fooUtils, bar)
+
+	pkgpaths := func(term string) []string {
+		t.Helper()
+		docs, err := db.SearchPkgs(ctx, term, 10)
+		if err != nil {
+			t.Fatalf("SearchPkgs(%q): %v", term, err)
+		}
+		var paths []string
+		for _, d := range docs {
+			paths = append(paths, d.Pkgpath)
+		}
+		return paths
+	}
+
+	// An exact match on the package name comes first.
+	if got := pkgpaths("foo"); len(got) != 3 || got[0] != "devel/foo" {
+		t.Errorf(`SearchPkgs("foo") = %q, want devel/foo first of three`, got)
+	}
+	if got := pkgpaths("alice"); !cmp.Equal(got, []string{"devel/foo"}) {
+		t.Errorf(`SearchPkgs("alice") = %q, want [devel/foo]`, got)
+	}
+	if got := pkgpaths("configure"); !cmp.Equal(got, []string{"www/bar"}) {
+		t.Errorf(`SearchPkgs("configure") = %q, want [www/bar]`, got)
+	}
+	if got := pkgpaths("BAR"); !cmp.Equal(got, []string{"www/bar"}) {
+		t.Errorf(`SearchPkgs("BAR") = %q, want [www/bar]`, got)
+	}
+	if got := pkgpaths("nonexistent"); len(got) != 0 {
+		t.Errorf(`SearchPkgs("nonexistent") = %q, want none`, got)
+	}
+
+	// A newer result replaces the search document.
+	foo.Maintainer = "bob@example.org"
+	addBuild(t, db, "Linux", foo)
+	if got := pkgpaths("alice"); len(got) != 0 {
+		t.Errorf(`SearchPkgs("alice") after update = %q, want none`, got)
+	}
+	if got := pkgpaths("bob"); !cmp.Equal(got, []string{"devel/foo"}) {
+		t.Errorf(`SearchPkgs("bob") = %q, want [devel/foo]`, got)
+	}
+
+	// An older build, e.g. from a history import, does not.
+	foo.Maintainer = "carol@example.org"
+	addBuildAt(t, db, "SunOS", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), foo)
+	if got := pkgpaths("carol"); len(got) != 0 {
+		t.Errorf(`SearchPkgs("carol") after an old build = %q, want none`, got)
+	}
+	if got := pkgpaths("bob"); !cmp.Equal(got, []string{"devel/foo"}) {
+		t.Errorf(`SearchPkgs("bob") after an old build = %q, want [devel/foo]`, got)
+	}
+
+	// Neither when the search documents are filled again.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM search_docs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, db.db.(*sql.DB)); err != nil {
+		t.Fatal(err)
+	}
+	if got := pkgpaths("bob"); !cmp.Equal(got, []string{"devel/foo"}) {
+		t.Errorf(`SearchPkgs("bob") after Migrate = %q, want [devel/foo]`, got)
+	}
+}
+
+func TestSearchPkgsDeleted(t *testing.T) {
+	forEachDB(t, testSearchPkgsDeleted)
+}
+
+func testSearchPkgsDeleted(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	buildID := addBuild(t, db, "NetBSD", pkgResult("devel/", "foo", "foo-1.0", 0))
+	if err := db.DeleteBuild(ctx, buildID); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := db.SearchPkgs(ctx, "foo", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("SearchPkgs after DeleteBuild: got %v, want none", docs)
+	}
+}
+
+func TestSyncSearch(t *testing.T) {
+	forEachDB(t, testSyncSearch)
+}
+
+func testSyncSearch(t *testing.T, db *DB) {
+	ctx := context.Background()
+
+	r := pkgResult("devel/", "foo", "foo-1.0", 2)
+	r.FailReason = "checksum"
+	addBuild(t, db, "NetBSD", r)
+	// A database that existed before search_docs was added.
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM search_docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(ctx, db.db.(*sql.DB)); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := db.SearchPkgs(ctx, "checksum", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("SearchPkgs after Migrate: got %v, want one result", docs)
+	}
+	want := []SearchDoc{{
+		PkgID:      docs[0].PkgID,
+		Pkgpath:    "devel/foo",
+		Pkgbase:    "foo",
+		FailReason: "checksum",
+	}}
+	if diff := cmp.Diff(want, docs); diff != "" {
+		t.Errorf("SearchPkgs after Migrate: diff (-want +got):\n%s", diff)
+	}
+
+	// Writing results without the full-text index marks it as stale.
+	index, err := db.hasSearchIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBuild(t, db, "NetBSD", pkgResult("devel/", "bar", "bar-1.0", 0))
+	stale, err := db.countSearchIndexStale(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stale > 0; got == index {
+		t.Errorf("index exists: %v, got stale %v", index, got)
+	}
+}
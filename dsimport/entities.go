@@ -0,0 +1,179 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+// fields holds the properties of a Datastore entity by name.
+type fields map[string]interface{}
+
+func newFields(props datastore.PropertyList) fields {
+	f := make(fields, len(props))
+	for _, p := range props {
+		f[p.Name] = p.Value
+	}
+	return f
+}
+
+// value returns the value of the first of the given properties that is
+// present. Some fields were renamed over time, so several names may be
+// given.
+func (f fields) value(names ...string) (interface{}, string) {
+	for _, n := range names {
+		if v, ok := f[n]; ok {
+			return v, n
+		}
+	}
+	return nil, names[0]
+}
+
+func (f fields) str(names ...string) (string, error) {
+	v, name := f.value(names...)
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("property %s: got %T, want a string", name, v)
+}
+
+func (f fields) int(names ...string) (int64, error) {
+	v, name := f.value(names...)
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("property %s: got %T, want an integer", name, v)
+}
+
+func (f fields) time(names ...string) (time.Time, error) {
+	v, name := f.value(names...)
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("property %s: got %T, want a timestamp", name, v)
+}
+
+// strs returns a multi-valued string property.
+func (f fields) strs(names ...string) ([]string, error) {
+	v, name := f.value(names...)
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		s := make([]string, len(v))
+		for i := range v {
+			var ok bool
+			if s[i], ok = v[i].(string); !ok {
+				return nil, fmt.Errorf("property %s: got %T in list, want a string", name, v[i])
+			}
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("property %s: got %T, want a list of strings", name, v)
+}
+
+// An errList collects the first error of a sequence of conversions.
+type errList struct {
+	err error
+}
+
+func (e *errList) str(s string, err error) string {
+	if e.err == nil {
+		e.err = err
+	}
+	return s
+}
+
+func (e *errList) int(i int64, err error) int64 {
+	if e.err == nil {
+		e.err = err
+	}
+	return i
+}
+
+// buildFromEntity converts a "build" entity. The old field names (e.g.
+// Timestamp, User, NumOK) as well as the current ones are accepted.
+func buildFromEntity(props datastore.PropertyList) (ddao.PutBuildParams, error) {
+	f := newFields(props)
+	var e errList
+	b := ddao.PutBuildParams{
+		Platform:             e.str(f.str("Platform")),
+		Branch:               e.str(f.str("Branch")),
+		Compiler:             e.str(f.str("Compiler")),
+		BuildUser:            e.str(f.str("User", "BuildUser")),
+		ReportUrl:            e.str(f.str("ReportURL", "ReportUrl")),
+		NumOk:                e.int(f.int("NumOK", "NumOk")),
+		NumPrefailed:         e.int(f.int("NumPrefailed")),
+		NumFailed:            e.int(f.int("NumFailed")),
+		NumIndirectFailed:    e.int(f.int("NumIndirectFailed")),
+		NumIndirectPrefailed: e.int(f.int("NumIndirectPrefailed")),
+	}
+	if e.err != nil {
+		return b, e.err
+	}
+	ts, err := f.time("Timestamp", "BuildTs")
+	if err != nil {
+		return b, err
+	}
+	b.BuildTs = ts
+	return b, nil
+}
+
+// resultFromEntity converts a "pkg" entity.
+func resultFromEntity(props datastore.PropertyList) (ddao.PkgResult, error) {
+	f := newFields(props)
+	var (
+		r ddao.PkgResult
+		e errList
+	)
+	r.Category = e.str(f.str("Category"))
+	r.Dir = e.str(f.str("Dir"))
+	r.PkgName = e.str(f.str("PkgName"))
+	r.BuildStatus = e.int(f.int("BuildStatus"))
+	r.Breaks = e.int(f.int("Breaks"))
+	if e.err != nil {
+		return r, e.err
+	}
+	failedDeps, err := f.strs("FailedDeps")
+	if err != nil {
+		return r, err
+	}
+	r.FailedDeps = strings.Join(failedDeps, " ")
+	return r, nil
+}
@@ -0,0 +1,154 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+func TestBuildFromEntity(t *testing.T) {
+	ts := time.Date(2014, 5, 3, 12, 34, 0, 0, time.UTC)
+	want := ddao.PutBuildParams{
+		Platform:             "NetBSD 6.1 amd64",
+		BuildTs:              ts,
+		Branch:               "pkgsrc-2014Q1",
+		Compiler:             "gcc",
+		BuildUser:            "bulk@example.com",
+		ReportUrl:            "http://example.com/meta/report.bz2",
+		NumOk:                11000,
+		NumPrefailed:         100,
+		NumFailed:            50,
+		NumIndirectFailed:    200,
+		NumIndirectPrefailed: 20,
+	}
+	testCases := []struct {
+		name  string
+		props datastore.PropertyList
+	}{
+		{
+			"old names",
+			datastore.PropertyList{
+				{Name: "Platform", Value: "NetBSD 6.1 amd64"},
+				{Name: "Timestamp", Value: ts},
+				{Name: "Branch", Value: "pkgsrc-2014Q1"},
+				{Name: "Compiler", Value: "gcc"},
+				{Name: "User", Value: "bulk@example.com"},
+				{Name: "ReportURL", Value: "http://example.com/meta/report.bz2"},
+				{Name: "NumOK", Value: int64(11000)},
+				{Name: "NumPrefailed", Value: int64(100)},
+				{Name: "NumFailed", Value: int64(50)},
+				{Name: "NumIndirectFailed", Value: int64(200)},
+				{Name: "NumIndirectPrefailed", Value: int64(20)},
+			},
+		}, {
+			"current names",
+			datastore.PropertyList{
+				{Name: "Platform", Value: "NetBSD 6.1 amd64"},
+				{Name: "BuildTs", Value: ts},
+				{Name: "Branch", Value: "pkgsrc-2014Q1"},
+				{Name: "Compiler", Value: "gcc"},
+				{Name: "BuildUser", Value: "bulk@example.com"},
+				{Name: "ReportUrl", Value: "http://example.com/meta/report.bz2"},
+				{Name: "NumOk", Value: int64(11000)},
+				{Name: "NumPrefailed", Value: int64(100)},
+				{Name: "NumFailed", Value: int64(50)},
+				{Name: "NumIndirectFailed", Value: int64(200)},
+				{Name: "NumIndirectPrefailed", Value: int64(20)},
+				{Name: "Key", Value: "ignored"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := buildFromEntity(tc.props)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: unexpected diff (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestBuildFromEntityErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		props datastore.PropertyList
+	}{
+		{
+			"no timestamp",
+			datastore.PropertyList{
+				{Name: "Platform", Value: "NetBSD 6.1 amd64"},
+			},
+		}, {
+			"wrong type",
+			datastore.PropertyList{
+				{Name: "Timestamp", Value: time.Now()},
+				{Name: "NumOK", Value: "many"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		if _, err := buildFromEntity(tc.props); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestResultFromEntity(t *testing.T) {
+	props := datastore.PropertyList{
+		{Name: "Category", Value: "devel/"},
+		{Name: "Dir", Value: "libtool"},
+		{Name: "PkgName", Value: "libtool-2.4"},
+		{Name: "BuildStatus", Value: int64(3)},
+		{Name: "FailedDeps", Value: []interface{}{"gcc-4.8", "m4-1.4"}},
+		{Name: "Breaks", Value: int64(0)},
+	}
+	want := ddao.PkgResult{
+		Pkg: ddao.Pkg{
+			Category: "devel/",
+			Dir:      "libtool",
+		},
+		Result: ddao.Result{
+			PkgName:     "libtool-2.4",
+			BuildStatus: 3,
+			FailedDeps:  "gcc-4.8 m4-1.4",
+		},
+	}
+	got, err := resultFromEntity(props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+
+	props[4].Value = []interface{}{"gcc-4.8", int64(1)}
+	if _, err := resultFromEntity(props); err == nil {
+		t.Error("got no error for a FailedDeps list with an integer")
+	}
+}
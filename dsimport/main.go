@@ -0,0 +1,265 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+// dsimport copies the build history from Cloud Datastore, where BulkTracker
+// kept it before moving to SQL, into the BulkTracker database. It reads
+// the "build" entities and their "pkg" children.
+//
+// To read a Datastore export, start the Datastore emulator, set
+// DATASTORE_EMULATOR_HOST and pass the path of the export's
+// overall_export_metadata file with -export. The export is then loaded
+// into the emulator before importing.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/datastore"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+var (
+	project      = flag.String("project", "bulktracker", "The Cloud project ID of the Datastore.")
+	export       = flag.String("export", "", "If set, load this Datastore export (an overall_export_metadata file) into the emulator at $DATASTORE_EMULATOR_HOST first.")
+	dbDriver     = flag.String("db_driver", "sqlite3", "The database driver to use, either \"sqlite3\" or \"postgres\".")
+	dbPath       = flag.String("db_path", "BulkTracker.db", "The path to the SQLite database file, or the PostgreSQL connection string.")
+	dryRun       = flag.Bool("dry_run", false, "Only read the entities, do not write anything to the database.")
+	skipExisting = flag.Bool("skip_existing", true, "Skip builds that are already in the database.")
+	verbose      = flag.Bool("v", false, "Verbose logging.")
+)
+
+// summary counts the outcome for each build.
+type summary struct {
+	Imported, Skipped int
+	Results           int64
+	Failures          []failure
+}
+
+type failure struct {
+	Name string
+	Err  error
+}
+
+func (s *summary) fail(name string, err error) {
+	log.Printf("%s: %v", name, err)
+	s.Failures = append(s.Failures, failure{name, err})
+}
+
+func (s *summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d builds with %d results imported, %d skipped as already present, %d failed\n",
+		s.Imported, s.Results, s.Skipped, len(s.Failures))
+	for _, f := range s.Failures {
+		fmt.Fprintf(w, "\t%s: %v\n", f.Name, f.Err)
+	}
+}
+
+// loadExport imports the Datastore export with the given metadata file into
+// the emulator.
+func loadExport(ctx context.Context, metadata string) error {
+	host := os.Getenv("DATASTORE_EMULATOR_HOST")
+	if host == "" {
+		return errors.New("DATASTORE_EMULATOR_HOST is not set")
+	}
+	path, err := filepath.Abs(metadata)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"input_url": path})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("http://%s/v1/projects/%s:import", host, *project)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+type importer struct {
+	client  *datastore.Client
+	db      *ddao.DB
+	summary summary
+}
+
+// build imports the build with the given key and its results.
+func (im *importer) build(ctx context.Context, key *datastore.Key, props datastore.PropertyList) {
+	name := key.String()
+	b, err := buildFromEntity(props)
+	if err != nil {
+		im.summary.fail(name, err)
+		return
+	}
+	desc := fmt.Sprintf("%s (%s %s on %s by %s)", name, b.Branch, b.Platform, b.BuildTs.Format("2006-01-02"), b.BuildUser)
+
+	if *skipExisting && !*dryRun {
+		ids, err := im.db.FindBuilds(ctx, ddao.FindBuildsParams{
+			Platform:  b.Platform,
+			BuildTs:   b.BuildTs,
+			Branch:    b.Branch,
+			Compiler:  b.Compiler,
+			BuildUser: b.BuildUser,
+		})
+		if err != nil {
+			im.summary.fail(desc, err)
+			return
+		}
+		if len(ids) > 0 {
+			log.Printf("%s: already imported as build %v", desc, ids[0])
+			im.summary.Skipped++
+			return
+		}
+	}
+
+	results, err := im.results(ctx, key)
+	if err != nil {
+		im.summary.fail(desc, err)
+		return
+	}
+	if *dryRun {
+		log.Printf("%s: would import build with %d results", desc, len(results))
+		im.summary.Imported++
+		im.summary.Results += int64(len(results))
+		return
+	}
+
+	id, err := im.db.PutBuild(ctx, b)
+	if err != nil {
+		im.summary.fail(desc, err)
+		return
+	}
+	if err := im.db.PutResults(ctx, results, id); err != nil {
+		// Do not leave a build without its results behind.
+		if err := im.db.DeleteBuild(ctx, id); err != nil {
+			log.Printf("%s: deleting incomplete build %v: %v", desc, id, err)
+		}
+		im.summary.fail(desc, err)
+		return
+	}
+	if _, err := im.db.PutRegressions(ctx, id); err != nil {
+		log.Printf("%s: computing regressions for build %v: %v", desc, id, err)
+	}
+	log.Printf("%s: imported as build %v with %d results", desc, id, len(results))
+	im.summary.Imported++
+	im.summary.Results += int64(len(results))
+}
+
+// results returns the results of the build with the given key.
+func (im *importer) results(ctx context.Context, buildKey *datastore.Key) ([]ddao.PkgResult, error) {
+	var results []ddao.PkgResult
+	it := im.client.Run(ctx, datastore.NewQuery("pkg").Ancestor(buildKey))
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			return results, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := resultFromEntity(props)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		results = append(results, r)
+	}
+}
+
+func (im *importer) run(ctx context.Context) error {
+	it := im.client.Run(ctx, datastore.NewQuery("build"))
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		im.build(ctx, key, props)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if !*verbose {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	ctx := context.Background()
+
+	if *export != "" {
+		if err := loadExport(ctx, *export); err != nil {
+			log.Fatalf("failed to load export: %s", err)
+		}
+	}
+	client, err := datastore.NewClient(ctx, *project)
+	if err != nil {
+		log.Fatalf("failed to connect to Datastore: %s", err)
+	}
+	defer client.Close()
+
+	db, err := ddao.Open(*dbDriver, *dbPath)
+	if err != nil {
+		log.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close()
+	if err := ddao.CheckSchema(ctx, db); err != nil {
+		log.Fatalf("database schema: %s", err)
+	}
+	im := &importer{
+		client: client,
+		db:     &ddao.DB{Queries: *ddao.New(db)},
+	}
+
+	if err := im.run(ctx); err != nil {
+		im.summary.fail("query builds", err)
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing was written.")
+	}
+	im.summary.Print(os.Stdout)
+	if len(im.summary.Failures) > 0 {
+		os.Exit(1)
+	}
+}
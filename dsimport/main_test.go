@@ -0,0 +1,58 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoadExport(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/projects/bulktracker:import" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("DATASTORE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	if err := loadExport(context.Background(), "/exports/2020/2020.overall_export_metadata"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/exports/2020/2020.overall_export_metadata"; got["input_url"] != want {
+		t.Errorf("got input_url %q, want %q", got["input_url"], want)
+	}
+
+	*project = "other"
+	defer func() { *project = "bulktracker" }()
+	if err := loadExport(context.Background(), "/exports/x"); err == nil {
+		t.Error("got no error for an unknown project")
+	}
+}
@@ -1,5 +1,5 @@
 /*-
- * Copyright (c) 2020-2022
+ * Copyright (c) 2014-2023
  *	Benny Siegert <bsiegert@gmail.com>
  *
  * Provided that these terms and disclaimer and all copyright notices
@@ -18,91 +18,164 @@
  * of said person's immediate fault when using the work as intended.
  */
 
+// expireold applies retention policies to the BulkTracker database. It
+// deletes all but the latest builds for each platform, branch, compiler and
+// user, and drops the results of old builds while keeping their summary.
 package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"time"
 
-	"cloud.google.com/go/datastore"
-	"github.com/bsiegert/BulkTracker/bulk"
-	"google.golang.org/api/iterator"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/bsiegert/BulkTracker/ddao"
 )
 
 var (
-	numResults  = flag.Int("n", 1, "Number of results")
-	numParallel = flag.Int("parallel", 2, "Number of parallel datastore calls")
+	dbDriver    = flag.String("db_driver", "sqlite3", "The database driver to use, either \"sqlite3\" or \"postgres\".")
+	dbPath      = flag.String("db_path", "BulkTracker.db", "The path to the SQLite database file, or the PostgreSQL connection string.")
+	keepBuilds  = flag.Int("keep_builds", 0, "Keep the latest N builds for each platform, branch, compiler and user, and delete the older ones. If 0, no builds are deleted.")
+	resultsDays = flag.Int("results_days", 0, "Drop the results of builds older than this many days, keeping the build summary. If 0, no results are dropped.")
+	vacuum      = flag.Bool("vacuum", true, "Compact the database afterwards.")
+	dryRun      = flag.Bool("dry_run", false, "Only print what would be deleted, do not change the database.")
+	verbose     = flag.Bool("v", false, "Verbose logging.")
 )
 
-var ErrNoDetails = errors.New("no details")
+// A policy says which data to expire.
+type policy struct {
+	// KeepBuilds is the number of builds to keep for each platform,
+	// branch, compiler and user. If zero, all builds are kept.
+	KeepBuilds int
+	// ResultsBefore is the time before which builds lose their results.
+	// If zero, all results are kept.
+	ResultsBefore time.Time
+}
 
-func main() {
-	flag.Parse()
-	ctx := context.Background()
+// summary counts what has been expired.
+type summary struct {
+	BuildsDeleted, ResultsDropped int
+	// Results is the number of results deleted, either with their
+	// build or on their own.
+	Results int64
+}
 
-	client, err := datastore.NewClient(ctx, "bulktracker")
-	if err != nil {
-		log.Fatal(err)
-	}
-	// Oldest builds.
-	q := OldestBuilds()
-	iter := client.Run(ctx, q)
-
-	var build bulk.Build
-	keys := make([]*datastore.Key, 0, *numResults)
-
-	for i := 0; i < *numResults; {
-		key, err := iter.Next(&build)
-		if err == iterator.Done {
-			break
-		} else if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("%s (%v on %v)\n", key.Encode(), build.Platform, build.Date())
-		keys = append(keys, key)
+func (s *summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "%d builds deleted, results of %d builds dropped, %d results in total\n",
+		s.BuildsDeleted, s.ResultsDropped, s.Results)
+}
 
-		err = RemoveDetails(ctx, client, key)
-		if err == ErrNoDetails {
-			continue
+// describe returns a human-readable description of the build.
+func describe(b *ddao.Build) string {
+	return fmt.Sprintf("build %v (%s %s on %s by %s)", b.BuildID, b.Branch, b.Platform, b.Date(), b.BuildUser)
+}
+
+// numResults returns the number of results of the build, according to its
+// summary.
+func numResults(b *ddao.Build) int64 {
+	return b.NumOk + b.NumPrefailed + b.NumFailed + b.NumIndirectFailed + b.NumIndirectPrefailed
+}
+
+// expire applies the policy p to db and writes a line for each build
+// affected to w. If dryRun is set, the database is not changed.
+func expire(ctx context.Context, db *ddao.DB, p policy, dryRun bool, w io.Writer) (summary, error) {
+	var s summary
+	verb := func(done, todo string) string {
+		if dryRun {
+			return "would " + todo
 		}
+		return done
+	}
+
+	deleted := make(map[int64]bool)
+	if p.KeepBuilds > 0 {
+		builds, err := db.GetExpiredBuilds(ctx, int64(p.KeepBuilds))
 		if err != nil {
-			log.Fatal(err)
+			return s, err
+		}
+		for i := range builds {
+			b := &builds[i]
+			if !dryRun {
+				if err := db.DeleteBuild(ctx, b.BuildID); err != nil {
+					return s, fmt.Errorf("%s: %w", describe(b), err)
+				}
+			}
+			fmt.Fprintf(w, "%s %s\n", verb("deleted", "delete"), describe(b))
+			deleted[b.BuildID] = true
+			s.BuildsDeleted++
+			s.Results += numResults(b)
 		}
-		i++
 	}
 
-	fmt.Printf("Deleting %d builds\n", len(keys))
-	err = DeleteMulti(ctx, client, keys)
-	if err != nil {
-		log.Fatal(err)
+	if !p.ResultsBefore.IsZero() {
+		builds, err := db.GetBuildsWithResultsBefore(ctx, p.ResultsBefore)
+		if err != nil {
+			return s, err
+		}
+		for i := range builds {
+			b := &builds[i]
+			if deleted[b.BuildID] {
+				continue
+			}
+			if !dryRun {
+				if err := db.DeleteResults(ctx, b.BuildID); err != nil {
+					return s, fmt.Errorf("%s: %w", describe(b), err)
+				}
+			}
+			fmt.Fprintf(w, "%s %d results of %s\n", verb("dropped", "drop"), numResults(b), describe(b))
+			s.ResultsDropped++
+			s.Results += numResults(b)
+		}
 	}
-
-	client.Close()
+	return s, nil
 }
 
-func OldestBuilds() *datastore.Query {
-	return datastore.NewQuery("build").Order("Timestamp").Limit(1000)
-}
+func main() {
+	flag.Parse()
+	if !*verbose {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	ctx := context.Background()
+
+	var p policy
+	p.KeepBuilds = *keepBuilds
+	if *resultsDays > 0 {
+		p.ResultsBefore = time.Now().AddDate(0, 0, -*resultsDays)
+	}
+	if p.KeepBuilds == 0 && p.ResultsBefore.IsZero() {
+		fmt.Fprintln(os.Stderr, "Nothing to do, set -keep_builds and/or -results_days.")
+		flag.Usage()
+		os.Exit(2)
+	}
 
-func RemoveDetails(ctx context.Context, client *datastore.Client, buildKey *datastore.Key) error {
-	startTime := time.Now()
-	q := datastore.NewQuery("pkg").Ancestor(buildKey).KeysOnly()
-	keys, err := client.GetAll(ctx, q, nil)
+	db, err := ddao.Open(*dbDriver, *dbPath)
 	if err != nil {
-		return err
+		log.Fatalf("failed to open database: %s", err)
 	}
-	if len(keys) == 0 {
-		return ErrNoDetails
+	defer db.Close()
+	if err := ddao.CheckSchema(ctx, db); err != nil {
+		log.Fatalf("database schema: %s", err)
 	}
-	fmt.Printf("\tRemoving %v records (%s) ... ", len(keys), time.Since(startTime))
-	err = DeleteMulti(ctx, client, keys)
+	ddb := &ddao.DB{Queries: *ddao.New(db)}
+
+	s, err := expire(ctx, ddb, p, *dryRun, os.Stdout)
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing was deleted.")
+	} else if *vacuum && s.BuildsDeleted+s.ResultsDropped > 0 {
+		start := time.Now()
+		if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+			log.Fatalf("vacuum: %s", err)
+		}
+		fmt.Printf("Vacuumed the database in %s.\n", time.Since(start).Round(time.Millisecond))
 	}
-	fmt.Printf("done in %s.\n", time.Since(startTime))
-	return nil
+	s.Print(os.Stdout)
 }
@@ -0,0 +1,135 @@
+/*-
+ * Copyright (c) 2023
+ *	Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+func setup(t *testing.T) *ddao.DB {
+	t.Helper()
+	db, err := ddao.Open("sqlite3", filepath.Join(t.TempDir(), "bulktracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := ddao.Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return &ddao.DB{Queries: *ddao.New(db)}
+}
+
+func TestExpire(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	put := func(days int) int64 {
+		t.Helper()
+		id, err := db.PutBuild(ctx, ddao.PutBuildParams{
+			Platform:  "NetBSD",
+			BuildTs:   now.AddDate(0, 0, -days),
+			Branch:    "HEAD",
+			Compiler:  "gcc",
+			BuildUser: "builder",
+			NumOk:     1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := ddao.PkgResult{
+			Pkg:    ddao.Pkg{Category: "devel/", Dir: "libtool"},
+			Result: ddao.Result{PkgName: "libtool-2.4"},
+		}
+		if err := db.PutResults(ctx, []ddao.PkgResult{r}, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	deleted := put(60)
+	dropped := put(40)
+	kept := put(1)
+
+	p := policy{
+		KeepBuilds:    2,
+		ResultsBefore: now.AddDate(0, 0, -30),
+	}
+	want := summary{BuildsDeleted: 1, ResultsDropped: 1, Results: 2}
+
+	var out bytes.Buffer
+	s, err := expire(ctx, db, p, true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("dry run: got summary %+v, want %+v", s, want)
+	}
+	if !strings.Contains(out.String(), "would delete build") || !strings.Contains(out.String(), "would drop 1 results of build") {
+		t.Errorf("dry run: unexpected output %q", out.String())
+	}
+	for _, id := range []int64{deleted, dropped, kept} {
+		if _, err := db.GetBuild(ctx, id); err != nil {
+			t.Errorf("dry run: GetBuild(%d): %v", id, err)
+		}
+	}
+
+	out.Reset()
+	s, err = expire(ctx, db, p, false, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != want {
+		t.Errorf("got summary %+v, want %+v", s, want)
+	}
+	if _, err := db.GetBuild(ctx, deleted); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetBuild(%d): got err %v, want ErrNoRows", deleted, err)
+	}
+	for _, id := range []int64{dropped, kept} {
+		if _, err := db.GetBuild(ctx, id); err != nil {
+			t.Errorf("GetBuild(%d): %v", id, err)
+		}
+	}
+	results, err := db.GetAllPkgResults(ctx, "devel/", "libtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].BuildID != kept {
+		t.Errorf("got results %+v, want a single one for build %d", results, kept)
+	}
+
+	// Expiring again is a no-op.
+	s, err = expire(ctx, db, p, false, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != (summary{}) {
+		t.Errorf("second run: got summary %+v, want nothing expired", s)
+	}
+}
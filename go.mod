@@ -6,12 +6,13 @@ require (
 	cloud.google.com/go/datastore v1.11.0
 	github.com/TV4/logrus-stackdriver-formatter v0.1.0
 	github.com/google/go-cmp v0.5.9
+	github.com/klauspost/compress v1.16.7
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/prometheus/exporter-toolkit v0.10.0
 	github.com/sirupsen/logrus v1.9.3
 	github.com/smira/go-ftp-protocol v0.0.0-20140829150050-066b75c2b70d
 	github.com/ulikunitz/xz v0.5.11
-	golang.org/x/sync v0.2.0
 	google.golang.org/api v0.114.0
 )
 
@@ -30,6 +31,7 @@ require (
 	github.com/prometheus/procfs v0.10.1 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sync v0.2.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
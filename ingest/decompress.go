@@ -0,0 +1,124 @@
+/*-
+ * Copyright (c) 2014-2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// fileSuffix returns the "file type" suffix of the file name, possibly
+// containing a full URL.
+func fileSuffix(name string) string {
+	// Take basename, without removing trailing slashes.
+	name = name[strings.LastIndexByte(name, byte('/'))+1:]
+	s := strings.LastIndexByte(name, byte('.'))
+	if s == -1 {
+		return ""
+	}
+	return name[s+1:]
+}
+
+// Magic numbers of the supported compression formats, keyed by the usual
+// file suffix.
+var magics = []struct {
+	suffix string
+	magic  []byte
+}{
+	{"gz", []byte{0x1f, 0x8b}},
+	{"bz2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// lzmaHeaderLen is the length of the header of a legacy .lzma file.
+const lzmaHeaderLen = 13
+
+// sniffCompression returns the suffix for the compression format of a
+// stream starting with hdr, or "" if it is not recognized.
+func sniffCompression(hdr []byte) string {
+	for _, m := range magics {
+		if bytes.HasPrefix(hdr, m.magic) {
+			return m.suffix
+		}
+	}
+	// The legacy .lzma format has no magic number. Recognize the header
+	// written with the default properties (lc=3, lp=0, pb=2), followed by
+	// the dictionary size and the uncompressed size, which is either
+	// unknown (all ones) or below 2^40.
+	if len(hdr) >= lzmaHeaderLen && hdr[0] == 0x5d {
+		size := hdr[5:lzmaHeaderLen]
+		if bytes.Equal(size, bytes.Repeat([]byte{0xff}, 8)) || bytes.Equal(size[5:], []byte{0, 0, 0}) {
+			return "lzma"
+		}
+	}
+	return ""
+}
+
+// Decompress returns a reader for the uncompressed contents of r. The
+// compression format (bzip2, gzip, xz, lzma or zstd) is detected from the
+// first bytes of the data. If that fails, the suffix of name, which is a
+// file name or URL, is used. Data in an unknown format is returned as is.
+// The caller must close the returned reader; this does not close r.
+func Decompress(r io.Reader, name string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// Peek returns an error at EOF, which is not fatal here.
+	hdr, _ := br.Peek(lzmaHeaderLen)
+	format := sniffCompression(hdr)
+	if format == "" {
+		format = fileSuffix(name)
+	}
+
+	switch format {
+	case "bz2":
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case "gz":
+		return gzip.NewReader(br)
+	case "xz":
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case "lzma":
+		lr, err := lzma.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(lr), nil
+	case "zst", "zstd":
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	// Uncompressed, or unknown.
+	return io.NopCloser(br), nil
+}
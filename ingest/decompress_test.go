@@ -0,0 +1,141 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var fileSuffixTests = [][2]string{
+	{"foo", ""},
+	{"foo.gz", "gz"},
+	{"foo.bz2", "bz2"},
+	{"foo.", ""},
+	{"https://www.example.com/index.html", "html"},
+	{"https://www.example.com/", ""},
+}
+
+func TestFileSuffix(t *testing.T) {
+	for _, test := range fileSuffixTests {
+		if got, want := fileSuffix(test[0]), test[1]; got != want {
+			t.Errorf("fileSuffix(%q): got %q, want %q", test[0], got, want)
+		}
+	}
+}
+
+const sampleReport = "PKGNAME=foo-1.0\n"
+
+// sampleBzip2 is sampleReport compressed with bzip2(1), as the standard
+// library has no bzip2 compressor.
+var sampleBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x16, 0xc3,
+	0x88, 0x13, 0x00, 0x00, 0x06, 0x5f, 0x00, 0x00, 0x10, 0x00, 0x03, 0x60,
+	0x02, 0x22, 0x8b, 0x40, 0x00, 0x01, 0x00, 0xa0, 0x00, 0x31, 0x4c, 0x00,
+	0x01, 0x40, 0xf5, 0x06, 0x9f, 0xa4, 0x98, 0x94, 0x97, 0x00, 0x63, 0x19,
+	0x3f, 0x17, 0x72, 0x45, 0x38, 0x50, 0x90, 0x16, 0xc3, 0x88, 0x13,
+}
+
+// compress returns sampleReport compressed in the given format.
+func compress(t *testing.T, format string) []byte {
+	t.Helper()
+	if format == "bz2" {
+		return sampleBzip2
+	}
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "lzma":
+		w, err = lzma.NewWriter(&buf)
+	case "zst":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown format %q", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, sampleReport); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	for _, format := range []string{"gz", "bz2", "xz", "lzma", "zst"} {
+		data := compress(t, format)
+		if got := sniffCompression(data); got != format {
+			t.Errorf("sniffCompression(%s data) = %q", format, got)
+		}
+		// The name should not matter, even if it is wrong.
+		for _, name := range []string{"report", "http://example.com/report." + format, "report.txt", "report.gz"} {
+			r, err := Decompress(bytes.NewReader(data), name)
+			if err != nil {
+				t.Errorf("Decompress(%s data, %q): %v", format, name, err)
+				continue
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || string(got) != sampleReport {
+				t.Errorf("Decompress(%s data, %q): got %q, %v; want %q", format, name, got, err, sampleReport)
+			}
+		}
+	}
+}
+
+func TestDecompressUncompressed(t *testing.T) {
+	for _, data := range []string{sampleReport, "", "x"} {
+		r, err := Decompress(bytes.NewReader([]byte(data)), "report")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != data {
+			t.Errorf("Decompress(%q): got %q, %v", data, got, err)
+		}
+	}
+}
+
+func TestSniffLegacyLzma(t *testing.T) {
+	// Header written by xz --format=lzma, with the uncompressed size
+	// unknown.
+	hdr := []byte{0x5d, 0x00, 0x00, 0x80, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	if got := sniffCompression(hdr); got != "lzma" {
+		t.Errorf("sniffCompression(lzma header) = %q, want lzma", got)
+	}
+	if got := sniffCompression([]byte("]PKGNAME=foo-1.0\n")); got != "" {
+		t.Errorf("sniffCompression(text) = %q, want none", got)
+	}
+}
@@ -27,19 +27,19 @@ import (
 	"github.com/bsiegert/BulkTracker/ddao"
 	"github.com/bsiegert/BulkTracker/log"
 	ftp "github.com/smira/go-ftp-protocol/protocol"
-	"github.com/ulikunitz/xz"
 
-	"compress/bzip2"
-	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/mail"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Constants for the current status.
@@ -47,9 +47,12 @@ const (
 	Fetching = iota
 	Failed
 	Writing
-	// Done: when the Status no longer exists in the datastore.
+	Done
+	Skipped
 )
 
+// Status tracks the progress of a single report ingestion. It is persisted
+// in the ingest_jobs table.
 type Status struct {
 	URL     string
 	Current int // Current status; one of the constants above.
@@ -58,47 +61,67 @@ type Status struct {
 	PkgsWritten, PkgsTotal int
 	// If Current == Failed, the last error encountered.
 	LastErr error
+	// Message is an informational note, e.g. about duplicate handling.
+	Message string
 
-	// key      *datastore.Key `json:"-"`
-	// cacheKey string `json:"-"`
+	db      *ddao.DB
+	buildID int64
+	jobID   int64
+	start   time.Time
 }
 
 // NewStatus allocates a new Status for report ingestion. As a side effect,
 // it also deletes old records, if any.
-func NewStatus(ctx context.Context, buildID int64) *Status {
-	// s := &Status{
-	// 	key:      datastore.NewIncompleteKey(ctx, "status", build),
-	// 	cacheKey: "/json/status/" + build.String(),
-	// }
-
-	// // TODO delete from memcache.
-	// keys, err := datastore.NewQuery("status").Ancestor(build).KeysOnly().GetAll(ctx, nil)
-	// if err != nil {
-	// 	log.Warningf(ctx, "failed to query for old statuses: %s", err)
-	// 	return s
-	// }
-	// if len(keys) > 0 {
-	// 	log.Infof(ctx, "Deleting %d records", len(keys))
-	// 	dsbatch.DeleteMulti(ctx, keys)
-	// }
-	// return s
-	return &Status{}
+func NewStatus(ctx context.Context, db *ddao.DB, buildID int64) *Status {
+	s := &Status{
+		db:      db,
+		buildID: buildID,
+		start:   time.Now(),
+	}
+	if err := db.DeleteIngestJobsForBuild(ctx, buildID); err != nil {
+		log.Warningf(ctx, "failed to delete old statuses for build %v: %s", buildID, err)
+	}
+	return s
 }
 
-// Put writes s into the datastore and memcache.
+// Put writes s into the database.
 func (s *Status) Put(ctx context.Context) {
-	// datastore.Put(ctx, s.key, s)
-
-	// var buf bytes.Buffer
-	// json.NewEncoder(&buf).Encode(s)
-	// err := memcache.Set(ctx, &memcache.Item{
-	// 	Key:        s.cacheKey,
-	// 	Value:      buf.Bytes(),
-	// 	Expiration: 2 * time.Minute,
-	// })
-	// if err != nil {
-	// 	log.Warningf(ctx, "failed to write %q to cache: %s", s.cacheKey, err)
-	// }
+	var lastErr string
+	if s.LastErr != nil {
+		lastErr = s.LastErr.Error()
+	}
+	now := time.Now()
+	if s.jobID == 0 {
+		id, err := s.db.PutIngestJob(ctx, ddao.PutIngestJobParams{
+			BuildID:     s.buildID,
+			Url:         s.URL,
+			Phase:       int64(s.Current),
+			PkgsWritten: int64(s.PkgsWritten),
+			PkgsTotal:   int64(s.PkgsTotal),
+			LastError:   lastErr,
+			Message:     s.Message,
+			StartTs:     s.start,
+			UpdateTs:    now,
+		})
+		if err != nil {
+			log.Warningf(ctx, "failed to write status for build %v: %s", s.buildID, err)
+			return
+		}
+		s.jobID = id
+		return
+	}
+	err := s.db.UpdateIngestJob(ctx, ddao.UpdateIngestJobParams{
+		Phase:       int64(s.Current),
+		PkgsWritten: int64(s.PkgsWritten),
+		PkgsTotal:   int64(s.PkgsTotal),
+		LastError:   lastErr,
+		Message:     s.Message,
+		UpdateTs:    now,
+		JobID:       s.jobID,
+	})
+	if err != nil {
+		log.Warningf(ctx, "failed to update status for build %v: %s", s.buildID, err)
+	}
 }
 
 // UpdateProgress sets the # of packages written and calls Put.
@@ -107,11 +130,20 @@ func (s *Status) UpdateProgress(ctx context.Context, written int) {
 	s.Put(ctx)
 }
 
-// Done marks the ingestion as done by removing the Status entry.
+// Fail marks the ingestion as failed with the given error and calls Put.
+func (s *Status) Fail(ctx context.Context, err error) {
+	s.LastErr = err
+	s.Current = Failed
+	s.Put(ctx)
+}
+
+// Done marks the ingestion as done, unless it has failed before.
 func (s *Status) Done(ctx context.Context) {
-	// log.Infof(ctx, "%v", s.key)
-	// datastore.Delete(ctx, s.key)
-	// TODO delete from memcache.
+	if s.Current == Failed {
+		return
+	}
+	s.Current = Done
+	s.Put(ctx)
 }
 
 // All these names mean HEAD.
@@ -121,11 +153,58 @@ var headAliases = map[string]bool{
 	"upstream-trunk64": true,
 }
 
+// DuplicatePolicy determines what happens when a report comes in for a
+// build that is already in the database, e.g. because the mail was
+// delivered twice. It implements flag.Value.
+type DuplicatePolicy int
+
+// Constants for DuplicatePolicy.
+const (
+	// SkipDuplicates ignores the new report.
+	SkipDuplicates DuplicatePolicy = iota
+	// ReplaceDuplicates ingests the new report and then deletes the
+	// existing build. Until the new report has been ingested, which may
+	// only happen on a retry or reindex, the existing build is kept.
+	ReplaceDuplicates
+	// KeepDuplicates ingests the new report as a separate build.
+	KeepDuplicates
+)
+
+var duplicatePolicyNames = []string{
+	SkipDuplicates:    "skip",
+	ReplaceDuplicates: "replace",
+	KeepDuplicates:    "keep",
+}
+
+func (p DuplicatePolicy) String() string {
+	if p < 0 || int(p) >= len(duplicatePolicyNames) {
+		return fmt.Sprintf("DuplicatePolicy(%d)", int(p))
+	}
+	return duplicatePolicyNames[p]
+}
+
+// Set parses the name of a duplicate policy.
+func (p *DuplicatePolicy) Set(s string) error {
+	for i, name := range duplicatePolicyNames {
+		if s == name {
+			*p = DuplicatePolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown duplicate policy %q, want one of %s", s, strings.Join(duplicatePolicyNames, ", "))
+}
+
 // IncomingMailHandler provides an endpoint that is called (with a POST request)
 // when a new mail comes in. It tries to parse it as a bulk build report and
 // ingests it, if successful.
 type IncomingMailHandler struct {
 	DB *ddao.DB
+	// Duplicates selects how to handle reports for builds that already
+	// exist.
+	Duplicates DuplicatePolicy
+	// MaxFetchAttempts is the number of times fetching a report is tried
+	// before giving up. If zero, DefaultMaxFetchAttempts is used.
+	MaxFetchAttempts int
 }
 
 func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -136,11 +215,125 @@ func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(500)
 		return
 	}
-	fromAddr, err := msg.Header.AddressList("From")
+	if err := i.HandleMail(ctx, msg); err != nil {
+		log.Errorf(ctx, "%s", err)
+	}
+}
+
+// HandleMail parses msg as a bulk build report. If successful, it writes
+// the build record and then fetches and ingests the machine-readable report.
+// Mails that are not bulk build reports are ignored. Reports for builds
+// that already exist are handled according to i.Duplicates.
+func (i *IncomingMailHandler) HandleMail(ctx context.Context, msg *mail.Message) error {
+	build, err := BuildFromMail(ctx, msg)
+	if build == nil {
+		return err
+	}
+	id, status, err := i.putNewBuild(ctx, build)
+	if id == 0 {
+		return err
+	}
+	// Errors are recorded in the ingestion status, and the fetch is
+	// retried later.
+	i.fetchReport(ctx, status, id, build.ReportUrl)
+	return nil
+}
+
+// putNewBuild writes the build record, handling duplicates according to
+// i.Duplicates. It returns the new build ID and a Status for ingesting the
+// report, or an ID of 0 if the build was skipped. With ReplaceDuplicates,
+// it records the builds to delete once the report has been ingested; see
+// deleteReplaced.
+func (i *IncomingMailHandler) putNewBuild(ctx context.Context, build *bulk.Build) (int64, *Status, error) {
+	id, dups, err := i.DB.PutNewBuild(ctx, buildParams(build), i.Duplicates == SkipDuplicates)
 	if err != nil {
-		log.Warningf(ctx, "unable to parse From header: %s", err)
+		return 0, nil, err
+	}
+	if id == 0 {
+		log.Infof(ctx, "skipping duplicate report for build %v", dups[0])
+		status := &Status{
+			db:      i.DB,
+			buildID: dups[0],
+			start:   time.Now(),
+			URL:     build.ReportUrl,
+			Current: Skipped,
+			Message: "Duplicate report received and skipped.",
+		}
+		status.Put(ctx)
+		return 0, nil, nil
+	}
+	log.Infof(ctx, "wrote entry %v", id)
+
+	var note string
+	if len(dups) > 0 {
+		switch i.Duplicates {
+		case ReplaceDuplicates:
+			for _, old := range dups {
+				err := i.DB.PutReplacedBuild(ctx, ddao.PutReplacedBuildParams{
+					BuildID:         id,
+					ReplacedBuildID: old,
+				})
+				if err != nil {
+					log.Errorf(ctx, "recording that build %v replaces %v: %s", id, old, err)
+				}
+			}
+			note = fmt.Sprintf("Replaces duplicate build(s) %s once the report is ingested.", idList(dups))
+		case KeepDuplicates:
+			note = fmt.Sprintf("Duplicate of build(s) %s, kept both.", idList(dups))
+		}
+		log.Infof(ctx, "%s", note)
+	}
+	status := NewStatus(ctx, i.DB, id)
+	status.Message = note
+	return id, status, nil
+}
+
+// deleteReplaced deletes the duplicates that build id replaces. It is
+// called whenever the report for id has been ingested, which may be on a
+// later retry, so that the old data is kept until then.
+func (i *IncomingMailHandler) deleteReplaced(ctx context.Context, id int64) {
+	replaced, err := i.DB.GetReplacedBuilds(ctx, id)
+	if err != nil {
+		log.Errorf(ctx, "reading the builds replaced by %v: %s", id, err)
 		return
 	}
+	for _, old := range replaced {
+		if err := i.DB.DeleteBuild(ctx, old); err != nil {
+			log.Errorf(ctx, "replacing duplicate build %v with %v: %s", old, id, err)
+			continue
+		}
+		log.Infof(ctx, "replaced duplicate build %v with %v", old, id)
+	}
+}
+
+// FindDuplicates returns the IDs of existing builds with the same platform,
+// timestamp, branch, compiler and user as build.
+func (i *IncomingMailHandler) FindDuplicates(ctx context.Context, build *bulk.Build) ([]int64, error) {
+	return i.DB.FindBuilds(ctx, ddao.FindBuildsParams{
+		Platform:  build.Platform,
+		BuildTs:   build.BuildTs,
+		Branch:    build.Branch,
+		Compiler:  build.Compiler,
+		BuildUser: build.BuildUser,
+	})
+}
+
+// idList formats a list of build IDs as "1, 2, 3".
+func idList(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(s, ", ")
+}
+
+// BuildFromMail parses the summary of a bulk build report mail. It returns
+// nil if msg is not a bulk build report.
+func BuildFromMail(ctx context.Context, msg *mail.Message) (*bulk.Build, error) {
+	fromAddr, err := msg.Header.AddressList("From")
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse From header: %w", err)
+	}
 	from := &mail.Address{}
 	if len(fromAddr) > 0 {
 		from = fromAddr[0]
@@ -149,12 +342,14 @@ func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	if strings.Contains(from.Address, "majordomo") {
 		body, _ := ioutil.ReadAll(msg.Body)
 		log.Infof(ctx, "%s", body)
-		return
+		return nil, nil
 	}
 	body, err := ParseMultipartMail(msg)
 	if err != nil {
-		log.Errorf(ctx, "failed to read mail body: %s", err)
-		return
+		return nil, fmt.Errorf("failed to read mail body: %w", err)
+	}
+	if body == nil {
+		return nil, errors.New("no text/plain part in mail body")
 	}
 	fromName := from.Name
 	if fromName == "" {
@@ -163,7 +358,7 @@ func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	build, err := bulk.BuildFromReport(fromName, body)
 
 	if build == nil {
-		return
+		return nil, err
 	}
 
 	subj := msg.Header.Get("Subject")
@@ -177,8 +372,20 @@ func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		build.Branch = "HEAD"
 	}
 	log.Infof(ctx, "%#v, %s", build, err)
+	return build, nil
+}
+
+// PutBuild writes the build record to the database and returns its ID.
+func (i *IncomingMailHandler) PutBuild(ctx context.Context, build *bulk.Build) (int64, error) {
+	id, err := i.DB.PutBuild(ctx, buildParams(build))
+	log.Infof(ctx, "wrote entry %v: %v", id, err)
+	return id, err
+}
 
-	id, err := i.DB.PutBuild(ctx, ddao.PutBuildParams{
+// buildParams converts build into the parameters for writing it to the
+// database.
+func buildParams(build *bulk.Build) ddao.PutBuildParams {
+	return ddao.PutBuildParams{
 		Platform:             build.Platform,
 		BuildTs:              build.BuildTs,
 		Branch:               build.Branch,
@@ -190,92 +397,115 @@ func (i *IncomingMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		NumFailed:            build.NumFailed,
 		NumIndirectFailed:    build.NumIndirectFailed,
 		NumIndirectPrefailed: build.NumIndirectPrefailed,
-	})
-	log.Infof(ctx, "wrote entry %v: %v", id, err)
-	i.FetchReport(ctx, id, build.ReportUrl)
-}
-
-// fileSuffix returns the "file type" suffix of the file name, possibly
-// containing a full URL.
-func fileSuffix(name string) string {
-	// Take basename, without removing trailing slashes.
-	name = name[strings.LastIndexByte(name, byte('/'))+1:]
-	s := strings.LastIndexByte(name, byte('.'))
-	if s == -1 {
-		return ""
 	}
-	return name[s+1:]
 }
 
-// decompressingReader returns a Reader with the right type of decompression
-// wrapper.
-func decompressingReader(r io.Reader, url string) (io.Reader, error) {
-	switch fileSuffix(url) {
-	case "bz2":
-		return bzip2.NewReader(r), nil
-	case "gz":
-		return gzip.NewReader(r)
-	case "xz", "lzma":
-		return xz.NewReader(r)
-	}
-	// Uncompressed, or unknown.
-	return r, nil
-}
+// fetchTimeout limits the time for fetching a report, including reading
+// the response body, so that a builder that never answers does not hold up
+// the retries of other reports.
+const fetchTimeout = 10 * time.Minute
 
-// httpGet tries http.Get and falls back to using an App Engine urlfetch
-// transport if it fails.
+// httpGet fetches the given http, https or ftp URL. The request is canceled
+// when ctx is done or after fetchTimeout.
 func httpGet(ctx context.Context, url string) (*http.Response, error) {
 	transport := &http.Transport{}
 	transport.RegisterProtocol("ftp", &ftp.FTPRoundTripper{})
 	client := http.Client{
 		Transport: transport,
+		Timeout:   fetchTimeout,
 	}
-	return client.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
 }
 
 // FetchReport fetches the machine-readable build report, hands it off to the
-// parser and writes the result into the datastore.
-func (i *IncomingMailHandler) FetchReport(ctx context.Context, buildID int64, url string) {
-	status := NewStatus(ctx, buildID)
+// parser and writes the result into the database. Errors are logged and
+// recorded in the ingestion status, and also returned. If the report cannot
+// be fetched, retries are scheduled; see RetryFetches. Calling FetchReport
+// resets the number of previous attempts.
+func (i *IncomingMailHandler) FetchReport(ctx context.Context, buildID int64, url string) error {
+	if err := i.DB.DeleteFetchRetry(ctx, buildID); err != nil {
+		log.Warningf(ctx, "failed to reset retry state for build %v: %s", buildID, err)
+	}
+	return i.fetchReport(ctx, NewStatus(ctx, i.DB, buildID), buildID, url)
+}
+
+func (i *IncomingMailHandler) fetchReport(ctx context.Context, status *Status, buildID int64, url string) error {
 	status.URL = url
 	status.Current = Fetching
 	status.Put(ctx)
 	resp, err := httpGet(ctx, url)
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
 	if err != nil {
 		log.Warningf(ctx, "failed to fetch report at %q: %s", url, err)
-		status.LastErr = err
-		status.Current = Failed
-		status.Put(ctx)
-		return
+		status.Message = strings.TrimSpace(status.Message + " " + i.scheduleRetry(ctx, buildID, url, err))
+		status.Fail(ctx, err)
+		return err
 	}
 	defer resp.Body.Close()
-	r, err := decompressingReader(resp.Body, url)
-	if err != nil {
-		log.Errorf(ctx, "failed to uncompress report at %q: %s", url, err)
-		status.LastErr = err
-		status.Current = Failed
-		status.Put(ctx)
-		return
+	if err := i.DB.DeleteFetchRetry(ctx, buildID); err != nil {
+		log.Warningf(ctx, "failed to clear retry state for build %v: %s", buildID, err)
 	}
-	pkgs, err := bulk.PkgsFromReport(r)
+	return i.ingestReport(ctx, status, buildID, url, resp.Body)
+}
+
+// IngestReport reads the machine-readable build report for the given build
+// from r, hands it off to the parser and writes the result into the
+// database. name is the file name or URL of the report; see Decompress for
+// how it is used.
+func (i *IncomingMailHandler) IngestReport(ctx context.Context, buildID int64, name string, r io.Reader) error {
+	status := NewStatus(ctx, i.DB, buildID)
+	status.URL = name
+	return i.ingestReport(ctx, status, buildID, name, r)
+}
+
+func (i *IncomingMailHandler) ingestReport(ctx context.Context, status *Status, buildID int64, name string, r io.Reader) error {
+	dr, err := Decompress(r, name)
 	if err != nil {
-		log.Errorf(ctx, "failed to parse report at %q: %s", url, err)
-		status.LastErr = err
-		status.Current = Failed
-		status.Put(ctx)
-		return
+		log.Errorf(ctx, "failed to uncompress report at %q: %s", name, err)
+		status.Fail(ctx, err)
+		return err
 	}
+	defer dr.Close()
 
 	status.Current = Writing
-	status.PkgsTotal = len(pkgs)
-	// sort.Sort(bulk.PkgsByName(pkgs))
-	if err = i.DB.PutResults(ctx, pkgs, buildID); err != nil {
-		status.Current = Failed
-		status.LastErr = err
-		status.Put(ctx)
-		log.Warningf(ctx, "%s", err)
+	status.Put(ctx)
+	// The report is parsed and written in a single transaction, so
+	// progress only becomes visible once all results have been committed.
+	w, err := i.DB.NewResultWriter(ctx, buildID)
+	if err != nil {
+		log.Errorf(ctx, "failed to start writing results: %s", err)
+		status.Fail(ctx, err)
+		return err
+	}
+	defer w.Close()
+	n, err := bulk.StreamReport(ctx, dr, w)
+	if err == nil {
+		err = w.Commit(ctx)
+	}
+	if err != nil {
+		log.Errorf(ctx, "failed to ingest report at %q: %s", name, err)
+		status.Fail(ctx, err)
+		return err
+	}
+	// The results are in; a failure to replace duplicates or to compare
+	// them with the previous build does not fail the ingestion.
+	i.deleteReplaced(ctx, buildID)
+	if r, err := i.DB.PutRegressions(ctx, buildID); err != nil {
+		log.Warningf(ctx, "failed to compute regressions for build %v: %s", buildID, err)
+	} else if r > 0 {
+		log.Infof(ctx, "build %v has %d new failures", buildID, r)
 	}
+	status.PkgsTotal = n
+	status.UpdateProgress(ctx, n)
 	status.Done(ctx)
+	return nil
 }
 
 // ParseMultipartMail parses an email and returns a reader for the first
@@ -20,21 +20,429 @@
 
 package ingest
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
 
-var fileSuffixTests = [][2]string{
-	{"foo", ""},
-	{"foo.gz", "gz"},
-	{"foo.bz2", "bz2"},
-	{"foo.", ""},
-	{"https://www.example.com/index.html", "html"},
-	{"https://www.example.com/", ""},
+	"github.com/bsiegert/BulkTracker/ddao"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func setup(t testing.TB) *ddao.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "bulktracker.db")+"?_fk=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := ddao.Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return &ddao.DB{Queries: *ddao.New(db)}
+}
+
+func TestStatus(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	buildID, err := db.PutBuild(ctx, ddao.PutBuildParams{Platform: "Linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStatus(ctx, db, buildID)
+	s.URL = "http://localhost/report.xz"
+	s.Current = Writing
+	s.PkgsTotal = 10
+	s.Put(ctx)
+	s.UpdateProgress(ctx, 5)
+
+	jobs, err := db.GetIngestJobsForBuild(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+	if j := jobs[0]; j.Phase != Writing || j.PkgsWritten != 5 || j.PkgsTotal != 10 || j.Url != s.URL {
+		t.Errorf("unexpected job after UpdateProgress: %+v", j)
+	}
+
+	s.Current = Failed
+	s.LastErr = errors.New("disk full")
+	s.Put(ctx)
+	s.Done(ctx)
+
+	jobs, err = db.GetIngestJobsForBuild(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := jobs[0]; j.Phase != Failed || j.LastError != "disk full" {
+		t.Errorf("Done overwrote failed job: %+v", j)
+	}
+
+	// A new ingestion replaces the old records.
+	s = NewStatus(ctx, db, buildID)
+	s.Done(ctx)
+	jobs, err = db.GetIngestJobsForBuild(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Phase != Done {
+		t.Errorf("got %+v, want a single job in phase Done", jobs)
+	}
+}
+
+func TestFetchReportRegressions(t *testing.T) {
+	reports := map[string]string{
+		"/1/report.txt": "PKGNAME=foo-1.0\nBUILD_STATUS=OK\nPKG_LOCATION=devel/foo\n",
+		"/2/report.txt": "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, reports[r.URL.Path])
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	i := &IncomingMailHandler{DB: setup(t)}
+	var ids []int64
+	for n := 1; n <= 2; n++ {
+		buildID, err := i.DB.PutBuild(ctx, ddao.PutBuildParams{
+			Platform: "Linux",
+			BuildTs:  time.Date(2023, 6, n, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := i.FetchReport(ctx, buildID, fmt.Sprintf("%s/%d/report.txt", srv.URL, n)); err != nil {
+			t.Fatalf("FetchReport(%d): %v", buildID, err)
+		}
+		ids = append(ids, buildID)
+	}
+
+	regressions, err := i.DB.GetRegressions(ctx, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regressions) != 1 || regressions[0].PkgName != "foo-1.0" || regressions[0].PrevBuildID != ids[0] {
+		t.Errorf("got regressions %+v, want foo-1.0 from build %d", regressions, ids[0])
+	}
+}
+
+func TestHTTPGetCanceled(t *testing.T) {
+	// The server accepts the request but never answers.
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp, err := httpGet(ctx, srv.URL+"/report.txt")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("httpGet succeeded, want an error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDuplicatePolicySet(t *testing.T) {
+	for _, want := range []DuplicatePolicy{SkipDuplicates, ReplaceDuplicates, KeepDuplicates} {
+		var p DuplicatePolicy
+		if err := p.Set(want.String()); err != nil || p != want {
+			t.Errorf("Set(%q): got %v, %v; want %v", want.String(), p, err, want)
+		}
+	}
+	var p DuplicatePolicy
+	if err := p.Set("ignore"); err == nil {
+		t.Error(`Set("ignore") succeeded`)
+	}
+}
+
+func TestHandleMailDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n")
+	}))
+	defer srv.Close()
+
+	report, err := os.ReadFile("../testing/btinject/data/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = bytes.Replace(report, []byte("http://localhost:9876/report.xz"), []byte(srv.URL+"/report"), 1)
+
+	var tests = []struct {
+		policy DuplicatePolicy
+		// wantBuilds is the number of builds after ingesting the report
+		// twice.
+		wantBuilds int
+		// wantPhase is the phase of the last ingestion job.
+		wantPhase int64
+	}{
+		{SkipDuplicates, 1, Skipped},
+		{ReplaceDuplicates, 1, Done},
+		{KeepDuplicates, 2, Done},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			ctx := context.Background()
+			i := &IncomingMailHandler{
+				DB:         setup(t),
+				Duplicates: tc.policy,
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(report))
+			if err != nil {
+				t.Fatal(err)
+			}
+			build, err := BuildFromMail(ctx, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := 0; n < 2; n++ {
+				msg, err := mail.ReadMessage(bytes.NewReader(report))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := i.HandleMail(ctx, msg); err != nil {
+					t.Fatalf("HandleMail #%d: %v", n+1, err)
+				}
+			}
+
+			ids, err := i.FindDuplicates(ctx, build)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != tc.wantBuilds {
+				t.Fatalf("got %d builds, want %d", len(ids), tc.wantBuilds)
+			}
+			last := ids[0]
+			for _, id := range ids {
+				if id > last {
+					last = id
+				}
+			}
+			jobs, err := i.DB.GetIngestJobsForBuild(ctx, last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs) == 0 {
+				t.Fatalf("no ingestion jobs for build %v", last)
+			}
+			j := jobs[len(jobs)-1]
+			if j.Phase != tc.wantPhase {
+				t.Errorf("got phase %v, want %v", j.Phase, tc.wantPhase)
+			}
+			if j.Message == "" {
+				t.Error("duplicate handling was not recorded in the ingestion status")
+			}
+		})
+	}
 }
 
-func TestFileSuffix(t *testing.T) {
-	for _, test := range fileSuffixTests {
-		if got, want := fileSuffix(test[0]), test[1]; got != want {
-			t.Errorf("fileSuffix(%q): got %q, want %q", test[0], got, want)
+// reportMail returns the test report mail with the report URL replaced.
+func reportMail(t *testing.T, reportURL string) []byte {
+	t.Helper()
+	report, err := os.ReadFile("../testing/btinject/data/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Replace(report, []byte("http://localhost:9876/report.xz"), []byte(reportURL), 1)
+}
+
+func handleMail(t *testing.T, i *IncomingMailHandler, raw []byte) error {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i.HandleMail(context.Background(), msg)
+}
+
+func TestHandleMailReplaceFailure(t *testing.T) {
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches > 1 {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n")
+	}))
+	defer srv.Close()
+	raw := reportMail(t, srv.URL+"/report")
+
+	ctx := context.Background()
+	i := &IncomingMailHandler{
+		DB:               setup(t),
+		Duplicates:       ReplaceDuplicates,
+		MaxFetchAttempts: 1,
+	}
+	for n := 0; n < 2; n++ {
+		if err := handleMail(t, i, raw); err != nil {
+			t.Fatalf("HandleMail #%d: %v", n+1, err)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err := BuildFromMail(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := i.FindDuplicates(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first build is kept because the second report was not ingested.
+	if len(ids) != 2 {
+		t.Fatalf("got builds %v, want the old and the new one", ids)
+	}
+	results, err := i.DB.GetResultsForBuild(ctx, sql.NullInt64{Int64: ids[0], Valid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("got %d results for build %v, want 1", len(results), ids[0])
+	}
+}
+
+func TestHandleMailReplaceAfterRetry(t *testing.T) {
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if fetches == 2 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n")
+	}))
+	defer srv.Close()
+	raw := reportMail(t, srv.URL+"/report")
+
+	ctx := context.Background()
+	i := &IncomingMailHandler{
+		DB:         setup(t),
+		Duplicates: ReplaceDuplicates,
+	}
+	for n := 0; n < 2; n++ {
+		if err := handleMail(t, i, raw); err != nil {
+			t.Fatalf("HandleMail #%d: %v", n+1, err)
+		}
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err := BuildFromMail(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := i.FindDuplicates(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("after the failed fetch: got builds %v, want the old and the new one", ids)
+	}
+
+	// Once the retry has ingested the report, the old build is gone.
+	i.retryDueFetches(ctx, time.Now().Add(time.Hour))
+	got, err := i.FindDuplicates(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != ids[1] {
+		t.Fatalf("after the retry: got builds %v, want only %v", got, ids[1])
+	}
+	replaced, err := i.DB.GetReplacedBuilds(ctx, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 0 {
+		t.Errorf("GetReplacedBuilds(%v) = %v, want none", ids[1], replaced)
+	}
+}
+
+func TestHandleMailConcurrentDuplicates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n")
+	}))
+	defer srv.Close()
+	raw := reportMail(t, srv.URL+"/report")
+
+	ctx := context.Background()
+	i := &IncomingMailHandler{DB: setup(t)}
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A delivery that loses the race may fail; it must not add
+			// a second build.
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			i.HandleMail(ctx, msg)
+		}()
+	}
+	wg.Wait()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err := BuildFromMail(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := i.FindDuplicates(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("got builds %v after concurrent deliveries, want one", ids)
+	}
+}
+
+func BenchmarkIngestReport(b *testing.B) {
+	report, err := os.ReadFile("../testing/btinject/data/report.xz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	i := &IncomingMailHandler{DB: setup(b)}
+	buildID, err := i.DB.PutBuild(ctx, ddao.PutBuildParams{Platform: "Linux"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := i.IngestReport(ctx, buildID, "report.xz", bytes.NewReader(report)); err != nil {
+			b.Fatal(err)
 		}
 	}
 }
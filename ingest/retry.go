@@ -0,0 +1,133 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// DefaultMaxFetchAttempts is the default for
+// IncomingMailHandler.MaxFetchAttempts.
+const DefaultMaxFetchAttempts = 8
+
+// Delays between fetch attempts. The delay doubles after each failed
+// attempt, up to retryMaxDelay.
+const (
+	retryBaseDelay = 5 * time.Minute
+	retryMaxDelay  = 24 * time.Hour
+)
+
+// retryDelay returns the time to wait after the given number of failed
+// attempts.
+func retryDelay(attempts int64) time.Duration {
+	d := retryBaseDelay
+	for n := int64(1); n < attempts && d < retryMaxDelay; n++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d
+}
+
+func (i *IncomingMailHandler) maxFetchAttempts() int64 {
+	if i.MaxFetchAttempts > 0 {
+		return int64(i.MaxFetchAttempts)
+	}
+	return DefaultMaxFetchAttempts
+}
+
+// scheduleRetry records a failed attempt to fetch the report for the given
+// build and schedules the next one, unless the maximum number of attempts
+// has been reached. It returns a message for the ingestion status.
+func (i *IncomingMailHandler) scheduleRetry(ctx context.Context, buildID int64, url string, fetchErr error) string {
+	attempts := int64(1)
+	prev, err := i.DB.GetFetchRetry(ctx, buildID)
+	switch {
+	case err == nil:
+		attempts = prev.Attempts + 1
+	case !errors.Is(err, sql.ErrNoRows):
+		log.Warningf(ctx, "failed to read retry state for build %v: %s", buildID, err)
+	}
+
+	limit := i.maxFetchAttempts()
+	next := time.Now().Add(retryDelay(attempts))
+	err = i.DB.PutFetchRetry(ctx, ddao.PutFetchRetryParams{
+		BuildID:   buildID,
+		Url:       url,
+		Attempts:  attempts,
+		NextTs:    next,
+		LastError: fetchErr.Error(),
+		GaveUp:    attempts >= limit,
+	})
+	if err != nil {
+		log.Errorf(ctx, "failed to schedule retry for build %v: %s", buildID, err)
+		return ""
+	}
+	if attempts >= limit {
+		log.Warningf(ctx, "giving up on fetching report for build %v after %d attempts", buildID, attempts)
+		return fmt.Sprintf("Giving up after %d attempts.", attempts)
+	}
+	return fmt.Sprintf("Attempt %d of %d failed, retrying at %s.", attempts, limit, next.Format("2006-01-02 15:04"))
+}
+
+// RetryFetches retries failed report fetches when they are due, checking
+// every interval. The retry state is kept in the database, so pending
+// retries are picked up again after a restart. RetryFetches runs until ctx
+// is canceled.
+func (i *IncomingMailHandler) RetryFetches(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		i.retryDueFetches(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// retryDueFetches retries all fetches that are due at the given time.
+func (i *IncomingMailHandler) retryDueFetches(ctx context.Context, now time.Time) {
+	pending, err := i.DB.GetPendingFetchRetries(ctx)
+	if err != nil {
+		log.Errorf(ctx, "failed to read pending fetch retries: %s", err)
+		return
+	}
+	for _, r := range pending {
+		if r.NextTs.After(now) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Infof(ctx, "retrying fetch of report for build %v from %q (attempt %d)", r.BuildID, r.Url, r.Attempts+1)
+		i.fetchReport(ctx, NewStatus(ctx, i.DB, r.BuildID), r.BuildID, r.Url)
+	}
+}
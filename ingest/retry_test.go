@@ -0,0 +1,124 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+func TestRetryDelay(t *testing.T) {
+	var tests = []struct {
+		attempts int64
+		want     time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{4, 40 * time.Minute},
+		{10, 24 * time.Hour},
+		{100, 24 * time.Hour},
+	}
+	for _, tc := range tests {
+		if got := retryDelay(tc.attempts); got != tc.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	var up int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "PKGNAME=foo-1.0\nBUILD_STATUS=failed\nPKG_LOCATION=devel/foo\n")
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	i := &IncomingMailHandler{
+		DB:               setup(t),
+		MaxFetchAttempts: 2,
+	}
+	buildID, err := i.DB.PutBuild(ctx, ddao.PutBuildParams{Platform: "Linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/report"
+
+	if err := i.FetchReport(ctx, buildID, url); err == nil {
+		t.Fatal("FetchReport succeeded while the server is down")
+	}
+	retry, err := i.DB.GetFetchRetry(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Attempts != 1 || retry.GaveUp || retry.Url != url {
+		t.Errorf("unexpected retry state after first attempt: %+v", retry)
+	}
+
+	// Not due yet.
+	i.retryDueFetches(ctx, time.Now())
+	if retry, _ := i.DB.GetFetchRetry(ctx, buildID); retry.Attempts != 1 {
+		t.Errorf("retry was attempted before it was due: %+v", retry)
+	}
+
+	i.retryDueFetches(ctx, time.Now().Add(time.Hour))
+	failed, err := i.DB.GetFailedFetches(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].BuildID != buildID || failed[0].Attempts != 2 {
+		t.Fatalf("got failed fetches %+v, want build %v after 2 attempts", failed, buildID)
+	}
+	jobs, err := i.DB.GetIngestJobsForBuild(ctx, buildID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Phase != Failed || jobs[0].Message == "" {
+		t.Errorf("unexpected ingestion status: %+v", jobs)
+	}
+
+	// Permanently failed fetches are not retried automatically.
+	atomic.StoreInt32(&up, 1)
+	i.retryDueFetches(ctx, time.Now().Add(48*time.Hour))
+	if retry, _ := i.DB.GetFetchRetry(ctx, buildID); retry.Attempts != 2 {
+		t.Errorf("permanently failed fetch was retried: %+v", retry)
+	}
+
+	// A manual retry succeeds and clears the retry state.
+	if err := i.FetchReport(ctx, buildID, url); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.DB.GetFetchRetry(ctx, buildID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetFetchRetry after success: got %v, want sql.ErrNoRows", err)
+	}
+}
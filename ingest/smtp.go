@@ -0,0 +1,275 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// DefaultMaxMessageSize is the default for SMTPServer.MaxMessageSize.
+const DefaultMaxMessageSize = 10 << 20
+
+// smtpTimeout is the time a client has for sending each command.
+const smtpTimeout = 5 * time.Minute
+
+// SMTPServer is a minimal SMTP server for receiving bulk build reports
+// without a separate MTA. Every accepted message is passed to Deliver.
+type SMTPServer struct {
+	// Addr is the host:port to listen on.
+	Addr string
+	// Hostname is used in the greeting. If empty, os.Hostname is used.
+	Hostname string
+	// Recipients is the list of addresses to accept mail for. If empty,
+	// mail for any recipient is accepted.
+	Recipients []string
+	// MaxMessageSize is the maximum size of a message in bytes. If zero,
+	// DefaultMaxMessageSize is used.
+	MaxMessageSize int64
+	// Deliver is called in a new goroutine for each accepted message.
+	Deliver func(ctx context.Context, msg *mail.Message) error
+}
+
+// ListenAndServe listens on s.Addr and serves SMTP connections until an
+// error occurs.
+func (s *SMTPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts SMTP connections on l until an error occurs. It always
+// returns a non-nil error and closes l.
+func (s *SMTPServer) Serve(l net.Listener) error {
+	defer l.Close()
+	ctx := context.Background()
+	log.Infof(ctx, "Accepting mail via SMTP on %v", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *SMTPServer) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if h, err := os.Hostname(); err == nil {
+		return h
+	}
+	return "localhost"
+}
+
+func (s *SMTPServer) maxMessageSize() int64 {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// acceptsRecipient returns true if mail for addr should be accepted.
+func (s *SMTPServer) acceptsRecipient(addr string) bool {
+	if len(s.Recipients) == 0 {
+		return true
+	}
+	for _, r := range s.Recipients {
+		if strings.EqualFold(r, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathArg extracts the address from the argument of MAIL FROM or RCPT TO,
+// e.g. "TO:<builds@example.com> NOTIFY=NEVER". It returns false if arg
+// does not start with the given prefix.
+func pathArg(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		addr, _, _ := strings.Cut(arg, " ")
+		return addr, addr != ""
+	}
+	end := strings.IndexByte(arg, '>')
+	if end == -1 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+// smtpSession holds the state of a single SMTP transaction.
+type smtpSession struct {
+	helo       bool
+	from       string
+	haveFrom   bool
+	recipients []string
+}
+
+func (s *SMTPServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	remote := conn.RemoteAddr()
+	host := s.hostname()
+
+	reply := func(format string, args ...interface{}) bool {
+		conn.SetWriteDeadline(time.Now().Add(smtpTimeout))
+		return tc.PrintfLine(format, args...) == nil
+	}
+
+	if !reply("220 %s ESMTP BulkTracker", host) {
+		return
+	}
+	var sess smtpSession
+	for {
+		conn.SetReadDeadline(time.Now().Add(smtpTimeout))
+		line, err := tc.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Warningf(ctx, "smtp %v: %s", remote, err)
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		var ok bool
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess = smtpSession{helo: true}
+			ok = reply("250 %s", host)
+		case "EHLO":
+			sess = smtpSession{helo: true}
+			ok = reply("250-%s", host) &&
+				reply("250-8BITMIME") &&
+				reply("250 SIZE %d", s.maxMessageSize())
+		case "MAIL":
+			from, valid := pathArg(arg, "FROM:")
+			switch {
+			case !sess.helo:
+				ok = reply("503 5.5.1 Send HELO/EHLO first")
+			case sess.haveFrom:
+				ok = reply("503 5.5.1 Sender already specified")
+			case !valid:
+				ok = reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+			default:
+				sess.from, sess.haveFrom = from, true
+				ok = reply("250 2.1.0 Ok")
+			}
+		case "RCPT":
+			to, valid := pathArg(arg, "TO:")
+			switch {
+			case !sess.haveFrom:
+				ok = reply("503 5.5.1 Need MAIL before RCPT")
+			case !valid || to == "":
+				ok = reply("501 5.5.4 Syntax: RCPT TO:<address>")
+			case !s.acceptsRecipient(to):
+				log.Infof(ctx, "smtp %v: rejecting mail for %q", remote, to)
+				ok = reply("550 5.1.1 No such user here")
+			default:
+				sess.recipients = append(sess.recipients, to)
+				ok = reply("250 2.1.5 Ok")
+			}
+		case "DATA":
+			if len(sess.recipients) == 0 {
+				ok = reply("503 5.5.1 Need RCPT before DATA")
+				break
+			}
+			if !reply("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			ok = s.receive(ctx, conn, tc, reply, &sess)
+			sess = smtpSession{helo: true}
+		case "RSET":
+			sess = smtpSession{helo: sess.helo}
+			ok = reply("250 2.0.0 Ok")
+		case "NOOP":
+			ok = reply("250 2.0.0 Ok")
+		case "VRFY":
+			ok = reply("252 2.5.2 Cannot VRFY user")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			ok = reply("502 5.5.2 Command not recognized")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// receive reads the message data after a DATA command, replies to the
+// client and hands the message to s.Deliver. It returns false if the
+// connection should be closed.
+func (s *SMTPServer) receive(ctx context.Context, conn net.Conn, tc *textproto.Conn, reply func(string, ...interface{}) bool, sess *smtpSession) bool {
+	limit := s.maxMessageSize()
+	conn.SetReadDeadline(time.Now().Add(smtpTimeout))
+	dr := tc.DotReader()
+	data, err := io.ReadAll(io.LimitReader(dr, limit+1))
+	if err != nil {
+		log.Warningf(ctx, "smtp %v: reading message: %s", conn.RemoteAddr(), err)
+		return false
+	}
+	if int64(len(data)) > limit {
+		// Discard the rest of the message.
+		if _, err := io.Copy(io.Discard, dr); err != nil {
+			return false
+		}
+		return reply("552 5.3.4 Message too big")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		log.Warningf(ctx, "smtp %v: failed to read mail message: %s", conn.RemoteAddr(), err)
+		return reply("554 5.6.0 Malformed message")
+	}
+	log.Infof(ctx, "smtp %v: accepted mail from %q for %v", conn.RemoteAddr(), sess.from, sess.recipients)
+
+	// Fetching the report may take a long time, so do not keep the
+	// client waiting.
+	go func() {
+		if err := s.Deliver(ctx, msg); err != nil {
+			log.Errorf(ctx, "smtp: %s", err)
+		}
+	}()
+	return reply("250 2.0.0 Ok: queued")
+}
@@ -0,0 +1,131 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bsiegert/BulkTracker/bulk"
+)
+
+func startSMTPServer(t *testing.T, s *SMTPServer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestSMTPServer(t *testing.T) {
+	report, err := os.ReadFile("../testing/btinject/data/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan *mail.Message, 1)
+	addr := startSMTPServer(t, &SMTPServer{
+		Hostname:   "bulktracker.example.com",
+		Recipients: []string{"builds@bulktracker.example.com"},
+		Deliver: func(ctx context.Context, msg *mail.Message) error {
+			msgs <- msg
+			return nil
+		},
+	})
+
+	err = smtp.SendMail(addr, nil, "pkgsrc@joyent.com", []string{"nobody@bulktracker.example.com"}, report)
+	if err == nil {
+		t.Error("SendMail to unknown recipient succeeded")
+	}
+
+	err = smtp.SendMail(addr, nil, "pkgsrc@joyent.com", []string{"Builds@bulktracker.example.com"}, report)
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	select {
+	case msg := <-msgs:
+		want := "pkgsrc-linux-trunk-x86_64 CentOS 6.8/x86_64 2016-12-25 00:05"
+		if got := msg.Header.Get("Subject"); got != want {
+			t.Errorf("got subject %q, want %q", got, want)
+		}
+		body, err := ParseMultipartMail(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		build, err := bulk.BuildFromReport("joyent", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if build.Platform != "CentOS 6.8/x86_64" {
+			t.Errorf("got platform %q, want %q", build.Platform, "CentOS 6.8/x86_64")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestSMTPServerMessageTooBig(t *testing.T) {
+	addr := startSMTPServer(t, &SMTPServer{
+		MaxMessageSize: 100,
+		Deliver: func(ctx context.Context, msg *mail.Message) error {
+			t.Error("unexpected delivery of oversized message")
+			return nil
+		},
+	})
+
+	body := make([]byte, 1000)
+	for i := range body {
+		body[i] = 'x'
+	}
+	msg := append([]byte("Subject: big\r\n\r\n"), body...)
+	if err := smtp.SendMail(addr, nil, "a@example.com", []string{"b@example.com"}, msg); err == nil {
+		t.Error("SendMail of oversized message succeeded")
+	}
+}
+
+func TestPathArg(t *testing.T) {
+	var tests = []struct {
+		arg, prefix string
+		want        string
+		wantOK      bool
+	}{
+		{"FROM:<a@example.com>", "FROM:", "a@example.com", true},
+		{"from: <a@example.com> BODY=8BITMIME", "FROM:", "a@example.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:b@example.com", "TO:", "b@example.com", true},
+		{"TO:<b@example.com", "TO:", "", false},
+		{"FROM:<a@example.com>", "TO:", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := pathArg(tc.arg, tc.prefix)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("pathArg(%q, %q) = %q, %v; want %q, %v", tc.arg, tc.prefix, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bsiegert/BulkTracker/auth"
+	"github.com/bsiegert/BulkTracker/bulk"
+	"github.com/bsiegert/BulkTracker/log"
+)
+
+// DefaultMaxUploadSize is the default for UploadHandler.MaxUploadSize.
+const DefaultMaxUploadSize = 256 << 20
+
+// UploadHandler accepts bulk build reports that are uploaded directly by
+// the builder, instead of fetching the report from the builder's host.
+//
+// The request is a POST with a multipart/form-data body containing these
+// fields:
+//
+//	summary: the text of the report mail, as sent to pkgsrc-bulk
+//	branch:  the pkgsrc branch, e.g. "HEAD" or "2023Q4" (optional,
+//	         default HEAD)
+//	report:  the machine-readable report as a file, optionally compressed
+//	         with bzip2, gzip, xz, lzma or zstd
+//
+// Requests are authenticated with a per-builder token, which is passed in
+// an "Authorization: Bearer <token>" header. The builder name associated
+// with the token is used as the build user.
+type UploadHandler struct {
+	Ingest *IncomingMailHandler
+	Tokens auth.Tokens
+	// MaxUploadSize is the maximum size of the request body in bytes. If
+	// zero, DefaultMaxUploadSize is used.
+	MaxUploadSize int64
+}
+
+func (u *UploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	builder, ok := u.Tokens.Builder(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="BulkTracker"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := u.MaxUploadSize
+	if limit <= 0 {
+		limit = DefaultMaxUploadSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, fmt.Sprintf("invalid form: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	build, err := bulk.BuildFromReport(builder, strings.NewReader(r.FormValue("summary")))
+	if err != nil || build == nil {
+		http.Error(w, "summary is not a bulk build report", http.StatusBadRequest)
+		return
+	}
+	build.Branch = r.FormValue("branch")
+	if build.Branch == "" || headAliases[build.Branch] {
+		build.Branch = "HEAD"
+	}
+	report, header, err := r.FormFile("report")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("report: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer report.Close()
+	log.Infof(ctx, "upload from %s: %#v", builder, build)
+
+	id, status, err := u.Ingest.putNewBuild(ctx, build)
+	if err != nil {
+		log.Errorf(ctx, "upload from %s: %s", builder, err)
+		http.Error(w, "failed to write build", http.StatusInternalServerError)
+		return
+	}
+	if id == 0 {
+		fmt.Fprintln(w, "duplicate report, skipped")
+		return
+	}
+	// Without a URL in the summary, the report URL stays empty, as there
+	// is nothing to fetch again on a reindex or retry.
+	status.URL = build.ReportUrl
+	if err := u.Ingest.ingestReport(ctx, status, id, header.Filename, report); err != nil {
+		http.Error(w, fmt.Sprintf("build %d: failed to ingest report: %s", id, err), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "build %d\n", id)
+}
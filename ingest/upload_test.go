@@ -0,0 +1,192 @@
+/*-
+ * Copyright (c) 2023
+ *      Benny Siegert <bsiegert@gmail.com>
+ *
+ * Provided that these terms and disclaimer and all copyright notices
+ * are retained or reproduced in an accompanying document, permission
+ * is granted to deal in this work without restriction, including un-
+ * limited rights to use, publicly perform, distribute, sell, modify,
+ * merge, give away, or sublicence.
+ *
+ * This work is provided "AS IS" and WITHOUT WARRANTY of any kind, to
+ * the utmost extent permitted by applicable law, neither express nor
+ * implied; without malicious intent or gross negligence. In no event
+ * may a licensor, author or contributor be held liable for indirect,
+ * direct, other damage, loss, or other issues arising in any way out
+ * of dealing in the work, even if advised of the possibility of such
+ * damage or existence of a defect, except proven that it results out
+ * of said person's immediate fault when using the work as intended.
+ */
+
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bsiegert/BulkTracker/auth"
+	"github.com/bsiegert/BulkTracker/ddao"
+)
+
+const uploadReport = `PKGNAME=foo-1.0
+BUILD_STATUS=failed
+PKG_LOCATION=devel/foo
+PKGNAME=bar-2.0
+BUILD_STATUS=indirect-failed
+PKG_LOCATION=devel/bar
+DEPENDS=foo-1.0
+`
+
+// testSummary returns the summary from report.txt.
+func testSummary(t *testing.T) string {
+	t.Helper()
+	raw, err := os.ReadFile("../testing/btinject/data/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := ParseMultipartMail(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// uploadRequest returns an upload request with the summary from
+// report.txt and the given report file.
+func uploadRequest(t *testing.T, token, filename string, report []byte) *http.Request {
+	t.Helper()
+	return summaryUploadRequest(t, token, testSummary(t), filename, report)
+}
+
+// summaryUploadRequest is like uploadRequest, with the given summary.
+func summaryUploadRequest(t *testing.T, token, summary, filename string, report []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("summary", summary); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.WriteField("branch", "2016Q4"); err != nil {
+		t.Fatal(err)
+	}
+	ff, err := mw.CreateFormFile("report", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ff.Write(report); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+	u := &UploadHandler{
+		Ingest: &IncomingMailHandler{DB: setup(t)},
+		Tokens: auth.Tokens{"s3cret": "joyent"},
+	}
+
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, uploadRequest(t, "guess", "report", []byte(uploadReport)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("upload with wrong token: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(uploadReport))
+	zw.Close()
+	w = httptest.NewRecorder()
+	u.ServeHTTP(w, uploadRequest(t, "s3cret", "report.gz", gz.Bytes()))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: got status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+
+	builds, err := u.Ingest.DB.GetLatestBuildsPerPlatform(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 {
+		t.Fatalf("got %d builds, want 1", len(builds))
+	}
+	b := builds[0]
+	if b.BuildUser != "joyent" || b.Branch != "2016Q4" || b.Platform != "CentOS 6.8/x86_64" {
+		t.Errorf("unexpected build: %+v", b)
+	}
+	results, err := u.Ingest.DB.GetResultsInCategory(ctx, ddao.GetResultsInCategoryParams{
+		Category: "devel/",
+		BuildID:  sql.NullInt64{Int64: b.BuildID, Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("got %d results, want 2", len(results))
+	}
+
+	// The same report again is a duplicate.
+	w = httptest.NewRecorder()
+	u.ServeHTTP(w, uploadRequest(t, "s3cret", "report.gz", gz.Bytes()))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "duplicate") {
+		t.Errorf("duplicate upload: got status %d (%s)", w.Code, w.Body)
+	}
+}
+
+func TestUploadWithoutReportURL(t *testing.T) {
+	ctx := context.Background()
+	u := &UploadHandler{
+		Ingest: &IncomingMailHandler{DB: setup(t)},
+		Tokens: auth.Tokens{"s3cret": "joyent"},
+	}
+
+	// A summary without the link to the machine-readable report.
+	var lines []string
+	for _, l := range strings.Split(testSummary(t), "\n") {
+		if !strings.HasPrefix(l, "Machine readable version:") {
+			lines = append(lines, l)
+		}
+	}
+	w := httptest.NewRecorder()
+	u.ServeHTTP(w, summaryUploadRequest(t, "s3cret", strings.Join(lines, "\n"), "report", []byte(uploadReport)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: got status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+
+	builds, err := u.Ingest.DB.GetLatestBuildsPerPlatform(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 {
+		t.Fatalf("got %d builds, want 1", len(builds))
+	}
+	if got := builds[0].ReportUrl; got != "" {
+		t.Errorf("ReportUrl = %q, want empty", got)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/bsiegert/BulkTracker/auth"
 	"github.com/bsiegert/BulkTracker/bulk"
 	"github.com/bsiegert/BulkTracker/ddao"
 	"github.com/bsiegert/BulkTracker/log"
@@ -53,13 +54,26 @@ const CacheExpiration = 30 * time.Minute
 // marshalled to JSON, or an error.
 type Endpoint func(ctx context.Context, params []string, form url.Values) (interface{}, error)
 
+// uncached lists the endpoints whose results change too quickly to be cached.
+var uncached = map[string]bool{
+	"deletebuild": true,
+	"status":      true,
+}
+
+// adminOnly lists the endpoints that modify data. They must be called with a
+// POST request carrying administrator credentials.
+var adminOnly = map[string]bool{
+	"deletebuild": true,
+}
+
 type cacheEntry struct {
 	timestamp time.Time
 	value     []byte
 }
 
 type API struct {
-	DB *ddao.DB
+	DB    *ddao.DB
+	Admin *auth.Admin
 
 	mu    sync.Mutex
 	cache map[string]cacheEntry
@@ -80,7 +94,16 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(404)
 		return
 	}
-	if a.CacheGet(ctx, cacheKey, w) {
+	if adminOnly[paths[0]] {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.Admin.Check(w, r) {
+			return
+		}
+	}
+	if !uncached[paths[0]] && a.CacheGet(ctx, cacheKey, w) {
 		return
 	}
 
@@ -92,6 +115,10 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Errorf(ctx, err.Error())
 		return
 	}
+	if uncached[paths[0]] {
+		json.NewEncoder(w).Encode(result)
+		return
+	}
 	a.CacheAndWrite(ctx, result, cacheKey, w)
 }
 
@@ -109,10 +136,22 @@ func (a *API) dispatch(ctx context.Context, fn string, params []string, form url
 		return a.PkgsBreakingMostOthers(ctx, params, form)
 	case "pkgsbrokenby":
 		return a.PkgsBrokenBy(ctx, params, form)
+	case "depends":
+		return a.Depends(ctx, params, form)
+	case "rdepends":
+		return a.ReverseDepends(ctx, params, form)
 	case "dir":
 		return a.Dir(ctx, params, form)
 	case "autocomplete":
 		return a.Autocomplete(ctx, params, form)
+	case "diff":
+		return a.Diff(ctx, params, form)
+	case "categorystats":
+		return a.CategoryStats(ctx, params, form)
+	case "status":
+		return a.Status(ctx, params, form)
+	case "deletebuild":
+		return a.DeleteBuild(ctx, params, form)
 	}
 	return nil, errors.New("unknown function name")
 }
@@ -169,41 +208,102 @@ func (a *API) BuildDetails(ctx context.Context, params []string, _ url.Values) (
 	return a.DB.GetBuild(ctx, buildID)
 }
 
+// Status returns the ingestion jobs for the build identified by ID.
+func (a *API) Status(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build ID %q", params[0])
+	}
+	return a.DB.GetIngestJobsForBuild(ctx, buildID)
+}
+
+// CategoryStats returns the number of packages with each build status per
+// category for the build identified by ID.
+func (a *API) CategoryStats(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build ID %q", params[0])
+	}
+	return a.DB.GetCategoryStats(ctx, buildID)
+}
+
+// Diff compares two builds, given by ID. With only one build ID, it
+// compares that build with the previous one from the same builder.
+func (a *API) Diff(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) == 0 || params[0] == "" {
+		return nil, nil
+	}
+	ids := make([]int64, 0, 2)
+	for _, p := range params {
+		if p == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing build ID %q", p)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 1 {
+		return a.DB.DiffWithPrevious(ctx, ids[0])
+	}
+	return a.DB.DiffBuilds(ctx, ids[0], ids[1])
+}
+
+// DeleteBuildResult is returned by the deletebuild endpoint.
+type DeleteBuildResult struct {
+	BuildID int64
+	Deleted bool
+}
+
+// DeleteBuild deletes the build identified by ID and all its results. As
+// this changes the results of most other endpoints, the cache is cleared.
+func (a *API) DeleteBuild(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build ID %q", params[0])
+	}
+	res := &DeleteBuildResult{BuildID: buildID}
+	if err := a.DB.DeleteBuild(ctx, buildID); err != nil {
+		return res, fmt.Errorf("deleting build %v: %w", buildID, err)
+	}
+	res.Deleted = true
+
+	a.mu.Lock()
+	a.cache = nil
+	a.mu.Unlock()
+	return res, nil
+}
+
 // AllBuildDetails returns all build records.
 func (a *API) AllBuildDetails(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
 	return a.DB.LatestBuilds(ctx, false /* filter */)
 }
 
+// PkgResults returns the latest result of a package from each builder.
 func (a *API) PkgResults(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
 	if len(params) < 2 {
-		return []ddao.GetAllPkgResultsRow{}, nil
+		return []ddao.GetLatestPkgResultsRow{}, nil
 	}
 	category, dir := params[0]+"/", params[1]
 
-	all, err := a.DB.GetAllPkgResults(ctx, category, dir)
+	results, err := a.DB.LatestPkgResults(ctx, category, dir)
 	if err != nil {
 		// No results is not an error.
 		if errors.Is(err, sql.ErrNoRows) {
-			return []ddao.GetAllPkgResultsRow{}, nil
+			return []ddao.GetLatestPkgResultsRow{}, nil
 		}
 		return nil, err
 	}
-	var results []ddao.GetAllPkgResultsRow
-
-	// Only keep the first (i.e. most recent) result.
-	buildsSeen := make(map[ddao.Build]bool)
-	for _, r := range all {
-		b := ddao.Build{
-			Platform:  r.Platform,
-			Branch:    r.Branch,
-			Compiler:  r.Compiler,
-			BuildUser: r.BuildUser,
-		}
-		if !buildsSeen[b] {
-			results = append(results, r)
-		}
-		buildsSeen[b] = true
-	}
 	return results, nil
 }
 
@@ -234,6 +334,10 @@ func (a *API) Dir(ctx context.Context, params []string, _ url.Values) (interface
 	}
 }
 
+// autocompleteLimit is the maximum number of packages suggested by
+// Autocomplete.
+const autocompleteLimit = 50
+
 func (a *API) Autocomplete(ctx context.Context, _ []string, form url.Values) (interface{}, error) {
 	term := form.Get("term")
 	if len(term) < 2 {
@@ -242,7 +346,7 @@ func (a *API) Autocomplete(ctx context.Context, _ []string, form url.Values) (in
 			Results: []stateful.Result{},
 		}, nil
 	}
-	names, err := a.DB.GetAllPkgsMatching(ctx, term)
+	docs, err := a.DB.SearchPkgs(ctx, term, autocompleteLimit)
 	if err != nil {
 		return stateful.AutocompleteResponse{
 			// select2 gets confused if the value is null.
@@ -250,11 +354,11 @@ func (a *API) Autocomplete(ctx context.Context, _ []string, form url.Values) (in
 		}, err
 	}
 	resp := &stateful.AutocompleteResponse{
-		Results: make([]stateful.Result, len(names)),
+		Results: make([]stateful.Result, len(docs)),
 	}
-	for i := range names {
-		resp.Results[i].ID = names[i]
-		resp.Results[i].Text = names[i]
+	for i := range docs {
+		resp.Results[i].ID = docs[i].Pkgpath
+		resp.Results[i].Text = docs[i].Pkgpath
 	}
 	return resp, nil
 }
@@ -263,13 +367,10 @@ func (a *API) PkgsBreakingMostOthers(ctx context.Context, params []string, _ url
 	if len(params) == 0 {
 		return nil, nil
 	}
-	var buildID sql.NullInt64
-	var err error
-	buildID.Int64, err = strconv.ParseInt(params[0], 10, 64)
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing build ID %q", params[0])
 	}
-	buildID.Valid = true
 	return a.DB.GetPkgsBreakingMostOthers(ctx, buildID)
 }
 
@@ -284,3 +385,37 @@ func (a *API) PkgsBrokenBy(ctx context.Context, params []string, _ url.Values) (
 
 	return a.DB.GetPkgsBrokenBy(ctx, resultID)
 }
+
+// Depends returns the dependencies of a package in a build. The parameters
+// are the build ID, category and dir.
+func (a *API) Depends(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) < 3 {
+		return []ddao.GetDependenciesRow{}, nil
+	}
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build ID %q", params[0])
+	}
+	return a.DB.GetDependencies(ctx, ddao.GetDependenciesParams{
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+		Category: params[1] + "/",
+		Dir:      params[2],
+	})
+}
+
+// ReverseDepends returns the packages depending on a package in a build.
+// The parameters are the build ID, category and dir.
+func (a *API) ReverseDepends(ctx context.Context, params []string, _ url.Values) (interface{}, error) {
+	if len(params) < 3 {
+		return []ddao.GetReverseDependenciesRow{}, nil
+	}
+	buildID, err := strconv.ParseInt(params[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing build ID %q", params[0])
+	}
+	return a.DB.GetReverseDependencies(ctx, ddao.GetReverseDependenciesParams{
+		BuildID:  sql.NullInt64{Int64: buildID, Valid: true},
+		Category: params[1] + "/",
+		Dir:      params[2],
+	})
+}
@@ -31,7 +31,9 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/bsiegert/BulkTracker/auth"
 	"github.com/bsiegert/BulkTracker/ddao"
+	"github.com/bsiegert/BulkTracker/ingest"
 	"github.com/bsiegert/BulkTracker/log"
 	"github.com/bsiegert/BulkTracker/templates"
 )
@@ -72,7 +74,11 @@ func (s *StartPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(builds) == 0 {
 		templates.DatastoreError(w, err)
 	}
-	writeBuildListAll(ctx, w, builds)
+	regressions, err := s.DB.LatestRegressions(ctx)
+	if err != nil {
+		log.Errorf(ctx, "failed to read regressions: %s", err)
+	}
+	writeBuildListAll(ctx, w, builds, regressions)
 	templates.DataTable(w, nil, `"order": [0, "desc"]`)
 }
 
@@ -86,27 +92,43 @@ func ShowBuilds(w http.ResponseWriter, r *http.Request) {
 	templates.LoadScript(w, "builds.js")
 }
 
-func writeBuildListAll(ctx context.Context, w http.ResponseWriter, builds []ddao.Build) {
+func writeBuildListAll(ctx context.Context, w http.ResponseWriter, builds []ddao.Build, regressions map[int64][]ddao.GetLatestRegressionsRow) {
 	templates.TableBegin(w, "Date", "Branch", "Platform", "Stats", "User")
 	for i := range builds {
-		templates.TableBuilds(w, &builds[i])
+		templates.TableBuilds(w, &builds[i], regressions[builds[i].BuildID])
 	}
 	templates.TableEnd(w)
 }
 
 // writePackageList writes a table of package results from the list of rows to w.
 func writePackageList(ctx context.Context, w http.ResponseWriter, rows []ddao.GetResultsInCategoryRow) {
-	templates.TableBegin(w, "Location", "Package Name", "Status", "Breaks")
+	templates.TableBegin(w, "Location", "Package Name", "Status", "Breaks", "Root causes")
 	templates.TablePkgs(w, rows)
 	templates.TableEnd(w)
 }
 
 type BuildDetails struct {
-	DB *ddao.DB
+	DB     *ddao.DB
+	Ingest *ingest.IncomingMailHandler
+	Admin  *auth.Admin
 }
 
 func (b *BuildDetails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+
+	// Administrative actions need to be checked before writing anything.
+	// Re-fetching changes state right away, so it must not be reachable
+	// by following a link.
+	action := r.URL.Query().Get("a")
+	if action == "reindex" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "re-fetching a report requires a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "" && !b.Admin.Check(w, r) {
+		return
+	}
+
 	templates.PageHeader(w)
 	defer templates.PageFooter(w)
 
@@ -126,13 +148,39 @@ func (b *BuildDetails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	templates.BulkBuildInfo(w, &build)
-	switch r.URL.Query().Get("a") {
+
+	switch action {
 	case "reindex":
-		// ingest.FetchReport(ctx, key, build.ReportURL)
+		if build.ReportUrl == "" {
+			templates.NoReportURL(w)
+			return
+		}
+		log.Infof(ctx, "re-fetching report for build %v from %q", buildID, build.ReportUrl)
+		// The request context is canceled once the response is written.
+		go b.Ingest.FetchReport(context.Background(), buildID, build.ReportUrl)
 		templates.ReindexOK(w)
 		return
 	case "delete":
-		// delete.DeleteBuildDetails.Call(ctx, key)
+		if r.Method != http.MethodPost {
+			templates.DeleteConfirm(w, path.Join(templates.BasePath, r.URL.Path))
+			return
+		}
+		if err := b.DB.DeleteBuild(ctx, buildID); err != nil {
+			log.Errorf(ctx, "DeleteBuild(%v): %v", buildID, err)
+			templates.DatastoreError(w, err)
+			return
+		}
+		templates.DeleteOK(w)
+		return
+	}
+
+	jobs, err := b.DB.GetIngestJobsForBuild(ctx, buildID)
+	if err != nil {
+		log.Errorf(ctx, "GetIngestJobsForBuild: %v", err)
+	}
+	if len(jobs) > 0 {
+		templates.Heading(w, "Ingestion status")
+		templates.IngestJobs(w, jobs)
 	}
 
 	if len(paths) > 1 {
@@ -152,24 +200,180 @@ func (b *BuildDetails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		templates.DataTable(w, nil, `"order": [0, "asc"]`)
 		return
 	}
+	templates.BuildActions(w, path.Join(templates.BasePath, r.URL.Path), buildID, build.ReportUrl != "")
 
-	// NOTE: This used to be the list of categories for the current build.
-	// Approximate by just showing all categories. The list of categories
-	// does not change often.
-	categories, _ := b.DB.GetCategories(ctx)
-	if len(categories) == 0 {
-		templates.NoDetails(w, r.URL.Path)
+	regressions, err := b.DB.GetRegressions(ctx, buildID)
+	if err != nil {
+		log.Errorf(ctx, "GetRegressions: %v", err)
+	}
+	if len(regressions) > 0 {
+		templates.Heading(w, "New failures since last build")
+		templates.Regressions(w, buildID, regressions)
+	}
+
+	stats, err := b.DB.GetCategoryStats(ctx, buildID)
+	if err != nil {
+		log.Errorf(ctx, "GetCategoryStats: %v", err)
+	}
+	if len(stats) == 0 {
+		templates.NoDetails(w, r.URL.Path, build.ReportUrl != "")
 		return
 	}
+	n, err := b.DB.CountResultsForBuild(ctx, sql.NullInt64{Int64: buildID, Valid: true})
+	if err != nil {
+		log.Errorf(ctx, "CountResultsForBuild: %v", err)
+	}
+	// Old results may have been dropped by expireold, which keeps the
+	// statistics.
+	expired := err == nil && n == 0
 	templates.Heading(w, "Results by Category")
-	templates.CategoryList(w, categories, path.Join(templates.BasePath, r.URL.Path))
+	templates.CategoryStats(w, stats, path.Join(templates.BasePath, r.URL.Path), expired)
+	templates.DataTable(w, templates.ID("category-stats"), `"order": [0, "asc"]`)
+	if expired {
+		return
+	}
 
 	templates.Heading(w, "Packages breaking most other packages")
-	templates.TableBegin(w, "Location", "Package Name", "Status", "Breaks")
+	templates.TableBeginID(w, templates.ID("pkgs-breaking"), "Location", "Package Name", "Status", "Breaks", "Root causes")
 	templates.TableEnd(w)
 
 	templates.LoadScript(w, "builddetails.js")
-	templates.BuildDetailsInit(w, ".table", "pkgsbreakingmostothers", buildID)
+	templates.BuildDetailsInit(w, "#pkgs-breaking", "pkgsbreakingmostothers", buildID)
+}
+
+// BuildDiff shows what changed between two builds. The URL is either
+// /diff/<from>/<to>, or /diff/<to> to compare with the previous build from
+// the same builder.
+type BuildDiff struct {
+	DB *ddao.DB
+}
+
+func (BuildDiff) args(r *http.Request) ([]int64, error) {
+	_, arg, ok := strings.Cut(r.URL.Path, "/diff/")
+	if !ok {
+		return nil, errNoArg
+	}
+	var ids []int64
+	for _, p := range strings.Split(arg, "/") {
+		if p == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || len(ids) > 2 {
+		return nil, errNoArg
+	}
+	return ids, nil
+}
+
+func (b *BuildDiff) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ids, err := b.args(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	templates.PageHeader(w)
+	defer templates.PageFooter(w)
+	templates.Heading(w, "Changes between builds")
+
+	var diff *ddao.BuildDiff
+	if len(ids) == 1 {
+		diff, err = b.DB.DiffWithPrevious(ctx, ids[0])
+	} else {
+		diff, err = b.DB.DiffBuilds(ctx, ids[0], ids[1])
+	}
+	if len(ids) == 1 && errors.Is(err, sql.ErrNoRows) {
+		templates.NoPreviousBuild(w, ids[0])
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "diffing builds %v: %v", ids, err)
+		templates.DatastoreError(w, err)
+		return
+	}
+	templates.BuildDiff(w, diff)
+}
+
+// FailedFetches lists the builds for which fetching the report failed
+// permanently, and allows retrying them. It is only accessible to
+// administrators.
+type FailedFetches struct {
+	DB     *ddao.DB
+	Ingest *ingest.IncomingMailHandler
+	Admin  *auth.Admin
+}
+
+func (f *FailedFetches) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if !f.Admin.Check(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		buildID, err := strconv.ParseInt(r.FormValue("build_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid build_id", http.StatusBadRequest)
+			return
+		}
+		retry, err := f.DB.GetFetchRetry(ctx, buildID)
+		if err != nil {
+			log.Errorf(ctx, "GetFetchRetry(%v): %v", buildID, err)
+			http.NotFound(w, r)
+			return
+		}
+		log.Infof(ctx, "re-fetching report for build %v from %q", buildID, retry.Url)
+		// The request context is canceled once the response is written.
+		go f.Ingest.FetchReport(context.Background(), buildID, retry.Url)
+		http.Redirect(w, r, path.Join(templates.BasePath, r.URL.Path), http.StatusSeeOther)
+		return
+	}
+
+	templates.PageHeader(w)
+	defer templates.PageFooter(w)
+	templates.Heading(w, "Failed report fetches")
+
+	fetches, err := f.DB.GetFailedFetches(ctx)
+	if err != nil {
+		log.Errorf(ctx, "GetFailedFetches: %v", err)
+		templates.DatastoreError(w, err)
+		return
+	}
+	templates.FailedFetches(w, fetches)
+}
+
+// searchLimit is the maximum number of results on the search page.
+const searchLimit = 200
+
+// Search is the package search page. The search term is given in the "q"
+// parameter.
+type Search struct {
+	DB *ddao.DB
+}
+
+func (s *Search) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	templates.PageHeader(w)
+	defer templates.PageFooter(w)
+	templates.Heading(w, "Package search")
+
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query == "" {
+		templates.SearchResults(w, "", nil)
+		return
+	}
+	results, err := s.DB.SearchPkgs(ctx, query, searchLimit)
+	if err != nil {
+		log.Errorf(ctx, "SearchPkgs(%q): %v", query, err)
+		templates.DatastoreError(w, err)
+		return
+	}
+	templates.SearchResults(w, query, results)
 }
 
 type PkgDetails struct {
@@ -224,7 +428,7 @@ func (p *PkgDetails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if res.Breaks > 0 {
 		id := templates.ID("breaking")
 		fmt.Fprintf(w, "<h2>This package breaks %d others</h2>", res.Breaks)
-		templates.TableBeginID(w, id, "Location", "Package Name", "Status", "Breaks")
+		templates.TableBeginID(w, id, "Location", "Package Name", "Status", "Breaks", "Root causes")
 		templates.TableEnd(w)
 
 		templates.LoadScript(w, "builddetails.js")
@@ -232,30 +436,17 @@ func (p *PkgDetails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Failed to build because of dependencies.
-	if res.FailedDeps == "" {
+	failedDeps, err := db.GetFailedDependencies(ctx, resultID)
+	if err != nil {
+		log.Errorf(ctx, "GetFailedDependencies: %v", err)
 		return
 	}
-	failedDeps := strings.Split(res.FailedDeps, ",")
-	fmt.Fprintf(w, "<h2>This package has %d failed dependencies</h2>", len(failedDeps))
-	templates.TableBegin(w, "Location", "Package Name", "Status", "Breaks")
-
-	sqlBuildID := sql.NullInt64{
-		Valid: true,
-		Int64: res.BuildID,
-	}
-	rows := make([]ddao.GetSingleResultByPkgNameRow, 0, len(failedDeps))
-	for _, dep := range failedDeps {
-		row, err := db.GetSingleResultByPkgName(ctx, ddao.GetSingleResultByPkgNameParams{
-			PkgName: dep,
-			BuildID: sqlBuildID,
-		})
-		if err != nil {
-			// Swallow and ignore error.
-			continue
-		}
-		rows = append(rows, row)
+	if len(failedDeps) == 0 {
+		return
 	}
-	templates.TablePkgs(w, rows)
+	fmt.Fprintf(w, "<h2>This package is broken by %d failed packages</h2>", len(failedDeps))
+	templates.TableBegin(w, "Location", "Package Name", "Status", "Breaks", "Root causes")
+	templates.TablePkgs(w, failedDeps)
 	templates.TableEnd(w)
 }
 
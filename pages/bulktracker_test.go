@@ -22,6 +22,7 @@ package pages
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -102,3 +103,12 @@ func TestDirArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildDetailsReindexGET(t *testing.T) {
+	b := &BuildDetails{}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/build/1?a=reindex", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET ?a=reindex: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
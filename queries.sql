@@ -2,6 +2,30 @@
 DELETE from results
 WHERE build_id = ?;
 
+-- name: DeleteBuild :execrows
+DELETE FROM builds
+WHERE build_id = ?;
+
+-- name: DeleteUnusedPkgs :exec
+DELETE FROM pkgs
+WHERE pkg_id NOT IN (
+	SELECT DISTINCT pkg_id FROM results WHERE pkg_id IS NOT NULL
+);
+
+-- name: DeleteUnusedSearchDocs :exec
+DELETE FROM search_docs
+WHERE pkg_id NOT IN (
+	SELECT DISTINCT pkg_id FROM results WHERE pkg_id IS NOT NULL
+);
+
+-- name: FindBuilds :many
+
+-- FindBuilds returns the IDs of all builds with the same platform, timestamp,
+-- branch, compiler and user.
+SELECT build_id FROM builds
+WHERE platform = ? AND build_ts = ? AND branch = ? AND compiler = ? AND build_user = ?
+ORDER BY build_id;
+
 -- name: GetBuild :one
 SELECT * FROM builds
 WHERE build_id = ?;
@@ -18,28 +42,45 @@ LIMIT 1000;
 
 -- name: GetLatestBuildsPerPlatform :many
 
--- This relies on the fact that IDs are monotonically increasing, so a newer
--- build will have a higher ID. There is probably a cleaner way.
+-- GetLatestBuildsPerPlatform returns the newest build of each platform, branch,
+-- compiler and user, ordered like GetPreviousBuild.
 SELECT * FROM builds
 WHERE build_id IN (
-	SELECT DISTINCT
-	MAX(build_id) OVER (PARTITION BY platform, branch, compiler, build_user)
-	FROM builds
-) 
+	SELECT build_id FROM (
+		SELECT build_id, ROW_NUMBER() OVER (
+			PARTITION BY platform, branch, compiler, build_user
+			ORDER BY build_ts DESC, build_id DESC
+		) AS n
+		FROM builds
+	) latest
+	WHERE n = 1
+)
 ORDER BY build_ts DESC
 LIMIT 1000;
 
--- name: getAllPkgsMatching :many
-SELECT pkgpath
-FROM pkgpaths
-WHERE pkgpath LIKE @name
-ORDER BY pkgpath;
+-- name: searchPkgsLike :many
+
+-- searchPkgsLike is the package search without a full-text index. Packages
+-- whose base name is term come first, then those where it starts with term.
+SELECT * FROM search_docs
+WHERE LOWER(pkgpath) LIKE LOWER(@pattern)
+	OR LOWER(pkgbase) LIKE LOWER(@pattern)
+	OR LOWER(maintainer) LIKE LOWER(@pattern)
+	OR LOWER(fail_reason) LIKE LOWER(@pattern)
+ORDER BY
+	CASE
+		WHEN LOWER(pkgbase) = LOWER(@term) THEN 0
+		WHEN LOWER(pkgbase) LIKE LOWER(@prefix) THEN 1
+		ELSE 2
+	END,
+	pkgpath
+LIMIT @max_results;
 
 
 -- name: GetAllPkgResults :many
-SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
+SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, r.fail_reason, r.skip_reason, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
 FROM results r, builds b
-WHERE r.build_id == b.build_id AND r.pkg_id == ?
+WHERE r.build_id = b.build_id AND r.pkg_id = ?
 ORDER BY b.build_ts DESC;
 
 -- name: GetSingleResult :one
@@ -49,6 +90,15 @@ SELECT
 	r.build_status,
 	r.failed_deps,
 	r.breaks,
+	r.fail_reason,
+	r.skip_reason,
+	r.maintainer,
+	r.categories,
+	r.pkg_depth,
+	r.multi_version,
+	r.restricted,
+	r.no_bin_on_ftp,
+	r.bootstrap_pkg,
 	p.category,
 	p.dir,
 	b.build_id,
@@ -59,19 +109,7 @@ SELECT
 	b.build_user,
 	b.report_url
 FROM results r, builds b, pkgs p
-WHERE r.build_id == b.build_id AND r.pkg_id == p.pkg_id AND r.result_id == ?;
-
--- name: GetSingleResultByPkgName :one
-SELECT
-	r.result_id,
-	r.pkg_name,
-	r.build_status,
-	r.failed_deps,
-	r.breaks,
-	p.category,
-	p.dir
-FROM results r, pkgs p
-WHERE r.build_id == ? AND r.pkg_id == p.pkg_id AND r.pkg_name == ?;
+WHERE r.build_id = b.build_id AND r.pkg_id = p.pkg_id AND r.result_id = ?;
 
 -- name: GetPkgsInCategory :many
 SELECT DISTINCT dir
@@ -81,13 +119,13 @@ ORDER BY dir;
 
 -- name: GetPkgID :one
 SELECT pkg_id FROM pkgs
-WHERE category == ? and dir == ?;
+WHERE category = ? and dir = ?;
 
 -- name: GetResultsInCategory :many
 SELECT r.*, p.*
 FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE p.category == ? AND r.build_id == ?;
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE p.category = ? AND r.build_id = ?;
 
 -- name: GetPkgsBreakingMostOthers :many
 SELECT
@@ -96,14 +134,19 @@ SELECT
 	r.pkg_name,
 	r.build_status,
 	r.failed_deps,
-	r.breaks
-FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE r.build_id == ? AND r.build_status > 0
-ORDER BY r.breaks DESC
+	COUNT(*) AS breaks
+FROM failed_dependencies f
+JOIN results r ON (f.failed_result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.build_id = ?
+GROUP BY r.result_id, p.pkg_id
+ORDER BY breaks DESC
 LIMIT 100;
 
--- name: getPkgsBrokenBy :many
+-- name: GetPkgsBrokenBy :many
+
+-- GetPkgsBrokenBy returns all packages that were broken by the given
+-- result ID.
 SELECT
 	r.result_id,
 	(p.category || p.dir) AS pkg_path,
@@ -111,9 +154,28 @@ SELECT
 	r.build_status,
 	r.failed_deps,
 	r.breaks
-FROM results r
-JOIN pkgs p ON (r.pkg_id == p.pkg_id)
-WHERE r.failed_deps LIKE ?;
+FROM failed_dependencies f
+JOIN results r ON (f.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.failed_result_id = ?;
+
+-- name: GetFailedDependencies :many
+
+-- GetFailedDependencies returns the failed packages that broke the given
+-- result ID.
+SELECT
+	r.result_id,
+	r.pkg_name,
+	r.build_status,
+	r.failed_deps,
+	r.breaks,
+	p.category,
+	p.dir
+FROM failed_dependencies f
+JOIN results r ON (f.failed_result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE f.result_id = ?
+ORDER BY r.pkg_name;
 
 -- name: PutBuild :one
 
@@ -125,11 +187,422 @@ VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 RETURNING build_id;
 
 -- name: PutPkg :exec
-INSERT OR IGNORE INTO pkgs
+INSERT INTO pkgs
 (category, dir)
-VALUES (?, ?);
+VALUES (?, ?)
+ON CONFLICT DO NOTHING;
 
 -- name: PutResult :exec
 INSERT INTO results
-(build_id, pkg_id, pkg_name, build_status, breaks, failed_deps)
-VALUES (?, ?, ?, ?, ?, ?);
+(build_id, pkg_id, pkg_name, build_status, breaks, failed_deps, fail_reason, skip_reason,
+	maintainer, categories, pkg_depth, multi_version, restricted, no_bin_on_ftp, bootstrap_pkg)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: DeleteIngestJobsForBuild :exec
+DELETE FROM ingest_jobs
+WHERE build_id = ?;
+
+-- name: GetIngestJobsForBuild :many
+SELECT * FROM ingest_jobs
+WHERE build_id = ?
+ORDER BY job_id;
+
+-- name: PutIngestJob :one
+INSERT INTO ingest_jobs
+(build_id, url, phase, pkgs_written, pkgs_total, last_error, message, start_ts, update_ts)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+RETURNING job_id;
+
+-- name: UpdateIngestJob :exec
+UPDATE ingest_jobs
+SET phase = ?, pkgs_written = ?, pkgs_total = ?, last_error = ?, message = ?, update_ts = ?
+WHERE job_id = ?;
+
+-- name: DeleteFetchRetry :exec
+DELETE FROM fetch_retries
+WHERE build_id = ?;
+
+-- name: GetFetchRetry :one
+SELECT * FROM fetch_retries
+WHERE build_id = ?;
+
+-- name: GetPendingFetchRetries :many
+SELECT * FROM fetch_retries
+WHERE NOT gave_up
+ORDER BY next_ts;
+
+-- name: GetFailedFetches :many
+SELECT f.build_id, b.platform, b.branch, b.build_ts, b.build_user, f.url, f.attempts, f.last_error
+FROM fetch_retries f
+JOIN builds b ON (f.build_id = b.build_id)
+WHERE f.gave_up
+ORDER BY b.build_ts DESC;
+
+-- name: PutFetchRetry :exec
+INSERT INTO fetch_retries
+(build_id, url, attempts, next_ts, last_error, gave_up)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (build_id) DO UPDATE SET
+	url = excluded.url,
+	attempts = excluded.attempts,
+	next_ts = excluded.next_ts,
+	last_error = excluded.last_error,
+	gave_up = excluded.gave_up;
+
+-- name: PutReplacedBuild :exec
+INSERT INTO replaced_builds
+(build_id, replaced_build_id)
+VALUES (?, ?)
+ON CONFLICT DO NOTHING;
+
+-- name: GetReplacedBuilds :many
+SELECT replaced_build_id FROM replaced_builds
+WHERE build_id = ?
+ORDER BY replaced_build_id;
+
+-- name: DeleteReplacedBuilds :exec
+
+-- DeleteReplacedBuilds removes the records in which the given build
+-- replaces another one or is replaced itself.
+DELETE FROM replaced_builds
+WHERE build_id = @build_id OR replaced_build_id = @build_id;
+
+-- name: GetAllPkgs :many
+SELECT * FROM pkgs;
+
+-- name: GetMaxResultID :one
+SELECT CAST(COALESCE(MAX(result_id), 0) AS BIGINT) AS max_result_id
+FROM results;
+
+-- name: UpdateResultDeps :exec
+UPDATE results
+SET failed_deps = ?, breaks = ?
+WHERE result_id = ?;
+
+-- name: DeleteDependenciesForBuild :exec
+DELETE FROM dependencies
+WHERE build_id = ?;
+
+-- name: GetDependencies :many
+
+-- GetDependencies returns the dependencies of the package with the given
+-- pkgpath in a build.
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	dr.result_id AS dep_result_id,
+	(dp.category || dp.dir) AS dep_pkg_path,
+	dr.pkg_name AS dep_pkg_name,
+	dr.build_status AS dep_build_status
+FROM results r
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+JOIN dependencies d ON (d.result_id = r.result_id)
+JOIN results dr ON (d.dep_result_id = dr.result_id)
+JOIN pkgs dp ON (dr.pkg_id = dp.pkg_id)
+WHERE r.build_id = ? AND p.category = ? AND p.dir = ?
+ORDER BY r.pkg_name, dep_pkg_path;
+
+-- name: GetReverseDependencies :many
+
+-- GetReverseDependencies returns the packages depending on the package with
+-- the given pkgpath in a build.
+SELECT
+	r.result_id,
+	(p.category || p.dir) AS pkg_path,
+	r.pkg_name,
+	r.build_status,
+	dr.result_id AS dep_result_id,
+	(dp.category || dp.dir) AS dep_pkg_path,
+	dr.pkg_name AS dep_pkg_name,
+	dr.build_status AS dep_build_status
+FROM results dr
+JOIN pkgs dp ON (dr.pkg_id = dp.pkg_id)
+JOIN dependencies d ON (d.dep_result_id = dr.result_id)
+JOIN results r ON (d.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE dr.build_id = ? AND dp.category = ? AND dp.dir = ?
+ORDER BY dr.pkg_name, pkg_path;
+
+-- name: DeleteFailedDependenciesForBuild :exec
+DELETE FROM failed_dependencies
+WHERE build_id = ?;
+
+-- name: GetExpiredBuilds :many
+
+-- GetExpiredBuilds returns the builds that are older than the latest keep
+-- builds with the same platform, branch, compiler and user, oldest first.
+SELECT * FROM builds
+WHERE build_id IN (
+	SELECT ranked.build_id FROM (
+		SELECT
+			build_id,
+			ROW_NUMBER() OVER (
+				PARTITION BY platform, branch, compiler, build_user
+				ORDER BY build_ts DESC, build_id DESC
+			) AS n
+		FROM builds
+	) ranked
+	WHERE ranked.n > @keep
+)
+ORDER BY build_ts, build_id;
+
+-- name: GetBuildsWithResultsBefore :many
+
+-- GetBuildsWithResultsBefore returns the builds older than cutoff that still
+-- have results, oldest first.
+SELECT * FROM builds
+WHERE build_ts < @cutoff AND build_id IN (
+	SELECT DISTINCT build_id FROM results WHERE build_id IS NOT NULL
+)
+ORDER BY build_ts, build_id;
+
+-- name: PutSearchDoc :exec
+INSERT INTO search_docs (pkg_id, pkgpath, pkgbase, maintainer, fail_reason)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (pkg_id) DO UPDATE SET
+	pkgpath = excluded.pkgpath,
+	pkgbase = excluded.pkgbase,
+	maintainer = excluded.maintainer,
+	fail_reason = excluded.fail_reason;
+
+-- name: CountSearchDocs :one
+SELECT COUNT(*) FROM search_docs;
+
+-- name: markSearchIndexStale :exec
+INSERT INTO search_index_stale (id) VALUES (1)
+ON CONFLICT DO NOTHING;
+
+-- name: countSearchIndexStale :one
+SELECT COUNT(*) FROM search_index_stale;
+
+-- name: clearSearchIndexStale :exec
+DELETE FROM search_index_stale;
+
+-- name: getSearchDocSources :many
+
+-- getSearchDocSources returns the package path and the newest result of
+-- every package from any builder, by build timestamp, which its search
+-- document is made from.
+SELECT p.pkg_id, p.category, p.dir, r.pkg_name, r.maintainer, r.fail_reason
+FROM latest_results l
+JOIN pkgs p ON (l.pkg_id = p.pkg_id)
+JOIN results r ON (l.result_id = r.result_id)
+WHERE NOT EXISTS (
+	SELECT 1 FROM latest_results o
+	WHERE o.pkg_id = l.pkg_id AND (
+		o.build_ts > l.build_ts OR (o.build_ts = l.build_ts AND o.build_id > l.build_id)
+	)
+);
+
+-- name: getNewestPkgsForBuild :many
+
+-- getNewestPkgsForBuild returns the packages for which the given build has
+-- the newest result from any builder, by build timestamp.
+SELECT l.pkg_id FROM latest_results l
+WHERE l.build_id = ? AND NOT EXISTS (
+	SELECT 1 FROM latest_results o
+	WHERE o.pkg_id = l.pkg_id AND (
+		o.build_ts > l.build_ts OR (o.build_ts = l.build_ts AND o.build_id > l.build_id)
+	)
+);
+
+-- name: GetBuildsBetween :many
+
+-- GetBuildsBetween returns the builds from since up to, but not including,
+-- until, oldest first.
+SELECT * FROM builds
+WHERE build_ts >= @since AND build_ts < @until
+ORDER BY build_ts, build_id;
+
+-- name: CountResultsForBuild :one
+SELECT COUNT(*) FROM results
+WHERE build_id = ?;
+
+-- name: GetResultsForBuild :many
+SELECT * FROM results
+WHERE build_id = ?
+ORDER BY result_id;
+
+-- name: GetDependenciesForBuild :many
+SELECT * FROM dependencies
+WHERE build_id = ?;
+
+-- name: GetFailedDependenciesForBuild :many
+SELECT * FROM failed_dependencies
+WHERE build_id = ?;
+
+-- name: DeleteCategoryStatsForBuild :exec
+DELETE FROM category_stats
+WHERE build_id = ?;
+
+-- name: PutCategoryStat :exec
+INSERT INTO category_stats
+(build_id, category, num_ok, num_prefailed, num_failed, num_indirect_failed,
+	num_indirect_prefailed)
+VALUES (?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetCategoryStats :many
+SELECT * FROM category_stats
+WHERE build_id = ?
+ORDER BY category;
+
+-- name: DeleteLatestResultsForBuild :execrows
+DELETE FROM latest_results
+WHERE build_id = ?;
+
+-- name: PutLatestResults :exec
+
+-- PutLatestResults makes the results of the given build the latest ones for
+-- its builder, unless there are results from a newer build. Of several
+-- results for the same package, e.g. for different Python versions, the
+-- last one is used, as an upsert may only change each row once.
+INSERT INTO latest_results
+(pkg_id, platform, branch, compiler, build_user, build_id, result_id, build_ts)
+SELECT r.pkg_id, b.platform, b.branch, b.compiler, b.build_user, b.build_id, MAX(r.result_id), b.build_ts
+FROM results r
+JOIN builds b ON (r.build_id = b.build_id)
+WHERE r.build_id = @build_id AND r.pkg_id IS NOT NULL
+GROUP BY r.pkg_id, b.platform, b.branch, b.compiler, b.build_user, b.build_id, b.build_ts
+ON CONFLICT (pkg_id, platform, branch, compiler, build_user) DO UPDATE SET
+	build_id = excluded.build_id,
+	result_id = excluded.result_id,
+	build_ts = excluded.build_ts
+WHERE excluded.build_ts > latest_results.build_ts OR (
+	excluded.build_ts = latest_results.build_ts AND excluded.build_id >= latest_results.build_id
+);
+
+-- name: RefillLatestResults :exec
+
+-- RefillLatestResults adds the latest results for the builder of the given
+-- build, for the packages that have none. This is needed after deleting
+-- results that were the latest ones.
+INSERT INTO latest_results
+(pkg_id, platform, branch, compiler, build_user, build_id, result_id, build_ts)
+SELECT
+	ranked.pkg_id,
+	ranked.platform,
+	ranked.branch,
+	ranked.compiler,
+	ranked.build_user,
+	ranked.build_id,
+	ranked.result_id,
+	ranked.build_ts
+FROM (
+	SELECT
+		r.pkg_id,
+		b.platform,
+		b.branch,
+		b.compiler,
+		b.build_user,
+		b.build_id,
+		r.result_id,
+		b.build_ts,
+		ROW_NUMBER() OVER (
+			PARTITION BY r.pkg_id
+			ORDER BY b.build_ts DESC, b.build_id DESC, r.result_id DESC
+		) AS n
+	FROM builds d
+	JOIN builds b ON (
+		b.platform = d.platform AND b.branch = d.branch AND
+		b.compiler = d.compiler AND b.build_user = d.build_user
+	)
+	JOIN results r ON (r.build_id = b.build_id)
+	WHERE d.build_id = @build_id AND r.pkg_id IS NOT NULL AND NOT EXISTS (
+		SELECT 1 FROM latest_results l
+		WHERE l.pkg_id = r.pkg_id AND l.platform = b.platform AND
+			l.branch = b.branch AND l.compiler = b.compiler AND
+			l.build_user = b.build_user
+	)
+) ranked
+WHERE ranked.n = 1;
+
+-- name: GetLatestPkgResults :many
+
+-- GetLatestPkgResults returns the latest result of the given package for
+-- each builder, newest first.
+SELECT r.result_id, r.pkg_name, r.build_status, r.breaks, r.fail_reason, r.skip_reason, b.build_id, b.platform, b.build_ts, b.branch, b.compiler, b.build_user
+FROM latest_results l
+JOIN results r ON (l.result_id = r.result_id)
+JOIN builds b ON (l.build_id = b.build_id)
+WHERE l.pkg_id = ?
+ORDER BY b.build_ts DESC, b.build_id DESC;
+
+-- name: GetPreviousBuild :one
+
+-- GetPreviousBuild returns the build before the given one with the same
+-- platform, branch, compiler and user. Builds whose results have been
+-- deleted are skipped, as there is nothing to compare with.
+SELECT b.* FROM builds b
+JOIN builds d ON (
+	b.platform = d.platform AND b.branch = d.branch AND
+	b.compiler = d.compiler AND b.build_user = d.build_user
+)
+WHERE d.build_id = ? AND (
+	b.build_ts < d.build_ts OR (b.build_ts = d.build_ts AND b.build_id < d.build_id)
+) AND EXISTS (SELECT 1 FROM results r WHERE r.build_id = b.build_id)
+ORDER BY b.build_ts DESC, b.build_id DESC
+LIMIT 1;
+
+-- name: GetNextBuild :one
+
+-- GetNextBuild returns the build after the given one with the same platform,
+-- branch, compiler and user, skipping builds without results like
+-- GetPreviousBuild.
+SELECT b.* FROM builds b
+JOIN builds d ON (
+	b.platform = d.platform AND b.branch = d.branch AND
+	b.compiler = d.compiler AND b.build_user = d.build_user
+)
+WHERE d.build_id = ? AND (
+	b.build_ts > d.build_ts OR (b.build_ts = d.build_ts AND b.build_id > d.build_id)
+) AND EXISTS (SELECT 1 FROM results r WHERE r.build_id = b.build_id)
+ORDER BY b.build_ts, b.build_id
+LIMIT 1;
+
+-- name: GetResultStatuses :many
+SELECT r.result_id, p.category, p.dir, r.multi_version, r.pkg_name, r.build_status
+FROM results r
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE r.build_id = ?
+ORDER BY p.category, p.dir, r.multi_version;
+
+-- name: DeleteRegressionsForBuild :exec
+DELETE FROM regressions
+WHERE build_id = ?;
+
+-- name: PutRegression :exec
+INSERT INTO regressions (build_id, result_id, prev_build_id, prev_build_status)
+VALUES (?, ?, ?, ?);
+
+-- name: GetRegressions :many
+
+-- GetRegressions returns the packages that failed in the given build but
+-- not in the previous one from the same builder.
+SELECT g.result_id, p.category, p.dir, r.pkg_name, r.build_status, g.prev_build_id, g.prev_build_status
+FROM regressions g
+JOIN results r ON (g.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE g.build_id = ?
+ORDER BY p.category, p.dir;
+
+-- name: GetLatestRegressions :many
+
+-- GetLatestRegressions returns the regressions of the builds listed by
+-- GetLatestBuildsPerPlatform.
+SELECT g.build_id, g.result_id, r.pkg_name
+FROM regressions g
+JOIN results r ON (g.result_id = r.result_id)
+JOIN pkgs p ON (r.pkg_id = p.pkg_id)
+WHERE g.build_id IN (
+	SELECT build_id FROM (
+		SELECT build_id, ROW_NUMBER() OVER (
+			PARTITION BY platform, branch, compiler, build_user
+			ORDER BY build_ts DESC, build_id DESC
+		) AS n
+		FROM builds
+	) latest
+	WHERE n = 1
+)
+ORDER BY g.build_id, p.category, p.dir;
@@ -29,6 +29,7 @@ bt.buildDetails.columns = [
     }
   },
   {data: "Breaks"},
+  {data: "FailedDeps"},
 ];
 
 bt.buildDetails.createdRow = function (row, data) {
@@ -80,6 +80,66 @@ func ReindexOK(w io.Writer) {
 	t.ExecuteTemplate(w, "reindex_ok.html", nil)
 }
 
+func DeleteConfirm(w io.Writer, buildURL string) {
+	t.ExecuteTemplate(w, "delete_confirm.html", buildURL)
+}
+
+func DeleteOK(w io.Writer) {
+	t.ExecuteTemplate(w, "delete_ok.html", bp{})
+}
+
+// BuildActions writes the administrative actions for a build. Re-fetching
+// the report is only offered if reindex is true, as uploaded builds have
+// no report URL.
+func BuildActions(w io.Writer, buildURL string, buildID int64, reindex bool) {
+	t.ExecuteTemplate(w, "build_actions.html", struct {
+		URL     string
+		BuildID int64
+		Reindex bool
+		bp
+	}{URL: buildURL, BuildID: buildID, Reindex: reindex})
+}
+
+// Regressions writes the new failures of a build compared with the
+// previous build from the same builder. rows must not be empty.
+func Regressions(w io.Writer, buildID int64, rows []ddao.GetRegressionsRow) {
+	err := t.ExecuteTemplate(w, "build_regressions.html", struct {
+		BuildID     int64
+		PrevBuildID int64
+		Rows        []ddao.GetRegressionsRow
+		bp
+	}{BuildID: buildID, PrevBuildID: rows[0].PrevBuildID, Rows: rows})
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.Regressions: %v", err)
+	}
+}
+
+type diffSection struct {
+	Title   string
+	Changes []ddao.PkgChange
+}
+
+func BuildDiff(w io.Writer, diff *ddao.BuildDiff) {
+	err := t.ExecuteTemplate(w, "build_diff.html", struct {
+		*ddao.BuildDiff
+		Sections []diffSection
+		bp
+	}{
+		BuildDiff: diff,
+		Sections: []diffSection{
+			{"Newly failed", diff.NewlyFailed},
+			{"Newly fixed", diff.NewlyFixed},
+			{"Newly prefailed", diff.NewlyPrefailed},
+			{"Version changed", diff.VersionChanged},
+			{"Added", diff.Added},
+			{"Removed", diff.Removed},
+		},
+	})
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.BuildDiff: %v", err)
+	}
+}
+
 func TableEnd(w io.Writer) {
 	t.ExecuteTemplate(w, "table_end.html", nil)
 }
@@ -109,13 +169,24 @@ func TableBeginID(w io.Writer, id *id, columns ...string) {
 	}
 }
 
-func TableBuilds(w io.Writer, b *ddao.Build) {
+// maxRegressions is the number of regressed packages listed per build in
+// the build table.
+const maxRegressions = 5
+
+func TableBuilds(w io.Writer, b *ddao.Build, regressions []ddao.GetLatestRegressionsRow) {
 	s := struct {
 		*ddao.Build
+		Regressions     []ddao.GetLatestRegressionsRow
+		MoreRegressions int
 		bp
 	}{
-		Build: b,
-		bp:    bp{},
+		Build:       b,
+		Regressions: regressions,
+		bp:          bp{},
+	}
+	if len(regressions) > maxRegressions {
+		s.Regressions = regressions[:maxRegressions]
+		s.MoreRegressions = len(regressions) - maxRegressions
 	}
 	err := t.ExecuteTemplate(w, "table_builds.html", s)
 	if err != nil {
@@ -141,8 +212,54 @@ func PkgInfo(w io.Writer, res ddao.GetSingleResultRow) {
 	t.ExecuteTemplate(w, "pkg_info.html", res)
 }
 
-func NoDetails(w io.Writer, path string) {
-	t.ExecuteTemplate(w, "no_details.html", path)
+func IngestJobs(w io.Writer, jobs []ddao.IngestJob) {
+	err := t.ExecuteTemplate(w, "ingest_jobs.html", jobs)
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.IngestJobs: %v", err)
+	}
+}
+
+func FailedFetches(w io.Writer, fetches []ddao.GetFailedFetchesRow) {
+	err := t.ExecuteTemplate(w, "failed_fetches.html", struct {
+		Fetches []ddao.GetFailedFetchesRow
+		bp
+	}{Fetches: fetches})
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.FailedFetches: %v", err)
+	}
+}
+
+func SearchResults(w io.Writer, query string, results []ddao.SearchDoc) {
+	err := t.ExecuteTemplate(w, "search_results.html", struct {
+		Query   string
+		Results []ddao.SearchDoc
+		bp
+	}{Query: query, Results: results})
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.SearchResults: %v", err)
+	}
+}
+
+// NoDetails says that there are no results for a build, with a button to
+// re-fetch the report if reindex is true.
+func NoDetails(w io.Writer, path string, reindex bool) {
+	t.ExecuteTemplate(w, "no_details.html", struct {
+		Path    string
+		Reindex bool
+	}{path, reindex})
+}
+
+// NoReportURL says that the report of an uploaded build cannot be
+// re-fetched.
+func NoReportURL(w io.Writer) {
+	t.ExecuteTemplate(w, "no_report_url.html", nil)
+}
+
+func NoPreviousBuild(w io.Writer, buildID int64) {
+	t.ExecuteTemplate(w, "no_previous_build.html", struct {
+		BuildID int64
+		bp
+	}{BuildID: buildID})
 }
 
 func DatastoreError(w io.Writer, err error) {
@@ -156,6 +273,20 @@ func CategoryList(w io.Writer, categories []string, path string) {
 	}{categories, path})
 }
 
+// CategoryStats writes the table of category statistics for a build. If
+// expired is true, the results of the build have been removed, so the
+// categories are not linked.
+func CategoryStats(w io.Writer, stats []ddao.CategoryStat, path string, expired bool) {
+	err := t.ExecuteTemplate(w, "category_stats.html", struct {
+		Stats      []ddao.CategoryStat
+		CurrentURL string
+		Expired    bool
+	}{stats, path, expired})
+	if err != nil {
+		log.Errorf(context.TODO(), "templates.CategoryStats: %v", err)
+	}
+}
+
 func Heading(w io.Writer, text string) {
 	t.ExecuteTemplate(w, "heading.html", text)
 }